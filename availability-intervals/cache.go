@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sburnett/bismark-tools/common/atomicfile"
+)
+
+// Increment this when changing how we compute or encode daily intervals.
+const cacheFormatVersion = 3
+
+// A cacheHeader precedes the intervals in each daily cache file and records
+// how we computed them. ProbeSource is the --probes flag and SourceIdentity
+// is what it resolved to, from probeSourceIdentity.
+type cacheHeader struct {
+	Version         int
+	OutageThreshold time.Duration
+	ProbeSource     string
+	SourceIdentity  string
+	Filter          probeFilter
+	ComputedAt      time.Time
+}
+
+func newCacheHeader(filter *probeFilter, sourceIdentity string, computedAt time.Time) *cacheHeader {
+	return &cacheHeader{
+		Version:         cacheFormatVersion,
+		OutageThreshold: outageThreshold,
+		ProbeSource:     probeSourceSpec,
+		SourceIdentity:  sourceIdentity,
+		Filter:          *filter,
+		ComputedAt:      computedAt,
+	}
+}
+
+func cacheFilename(day time.Time) string {
+	return filepath.Join(cacheDirectory, day.Format("2006-01-02.gob"))
+}
+
+// writeCacheFile replaces filename atomically, so an interrupted run never
+// leaves a partial cache file behind.
+func writeCacheFile(filename string, header *cacheHeader, availabilityIntervals map[string][]availabilityInterval) error {
+	err := atomicfile.Write(filename, 0644, func(writer io.Writer) error {
+		encoder := gob.NewEncoder(writer)
+		if err := encoder.Encode(header); err != nil {
+			return err
+		}
+		return encoder.Encode(availabilityIntervals)
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing %s: %s", filename, err)
+	}
+	return nil
+}
+
+// readCacheHeader reads just the header of a cache file.
+func readCacheHeader(filename string) (*cacheHeader, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	var header cacheHeader
+	if err := gob.NewDecoder(handle).Decode(&header); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", filename, err)
+	}
+	return &header, nil
+}
+
+func readCacheFile(filename string) (*cacheHeader, map[string][]availabilityInterval, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer handle.Close()
+
+	decoder := gob.NewDecoder(handle)
+	var header cacheHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, nil, fmt.Errorf("Error reading %s: %s", filename, err)
+	}
+	if header.Version != cacheFormatVersion {
+		return &header, nil, nil
+	}
+	var availabilityIntervals map[string][]availabilityInterval
+	if err := decoder.Decode(&availabilityIntervals); err != nil {
+		return nil, nil, fmt.Errorf("Error reading %s: %s", filename, err)
+	}
+	return &header, availabilityIntervals, nil
+}
+
+func equalLists(a, b []string) bool {
+	return strings.Join(a, "\n") == strings.Join(b, "\n") && len(a) == len(b)
+}
+
+// staleReason explains why we should recompute day given the header of its
+// cache file, or returns the empty string if the cache is fresh. We
+// recompute days that we computed before the next day ended, since probes
+// of devices that were up across midnight arrive during the next day.
+func (header *cacheHeader) staleReason(want *cacheHeader, day time.Time) string {
+	switch {
+	case header.Version != want.Version:
+		return fmt.Sprintf("format version %d, want %d", header.Version, want.Version)
+	case header.OutageThreshold != want.OutageThreshold:
+		return fmt.Sprintf("computed with --outage_threshold=%s, want %s", header.OutageThreshold, want.OutageThreshold)
+	case header.ProbeSource != want.ProbeSource:
+		return fmt.Sprintf("computed with --probes=%s, want %s", header.ProbeSource, want.ProbeSource)
+	case header.SourceIdentity != want.SourceIdentity:
+		return fmt.Sprintf("computed from %s, want %s", header.SourceIdentity, want.SourceIdentity)
+	case !equalLists(header.Filter.ExcludedPrefixes, want.Filter.ExcludedPrefixes):
+		return "computed with different excluded prefixes"
+	case !equalLists(header.Filter.ExcludedNodes, want.Filter.ExcludedNodes):
+		return "computed with different excluded nodes"
+	case header.Filter.RestrictNodes != want.Filter.RestrictNodes || !equalLists(header.Filter.IncludedNodes, want.Filter.IncludedNodes):
+		return "computed with different included nodes"
+	case header.ComputedAt.Before(day.AddDate(0, 0, 2)):
+		return fmt.Sprintf("incomplete; computed at %s", header.ComputedAt.UTC().Format(time.RFC3339))
+	}
+	return ""
+}
+
+// cacheStatus returns why we should recompute the cache file for day, or the
+// empty string if it's fresh. It only reads the file's header, so it doesn't
+// notice if the intervals after it are corrupt; concatenateDailyIntervals
+// reports that when it reads them.
+func cacheStatus(want *cacheHeader, day time.Time) string {
+	header, err := readCacheHeader(cacheFilename(day))
+	if os.IsNotExist(err) {
+		return "missing"
+	} else if err != nil {
+		return fmt.Sprintf("unreadable: %s", err)
+	}
+	return header.staleReason(want, day)
+}
+
+// verifyCache prints the state of the cache file for each day in [minDate,
+// maxDate) that we would recompute, and returns how many there are.
+func verifyCache(want *cacheHeader, minDate, maxDate time.Time) int {
+	var days, stale int
+	for currentDate := minDate; currentDate.Before(maxDate); currentDate = currentDate.AddDate(0, 0, 1) {
+		days++
+		if reason := cacheStatus(want, currentDate); reason != "" {
+			fmt.Printf("%s: %s\n", cacheFilename(currentDate), reason)
+			stale++
+		}
+	}
+	fmt.Printf("%d of %d cache files need recomputing\n", stale, days)
+	return stale
+}
+
+// parseDateFlag parses a date like 2013-07-01, or returns the zero time if
+// value is empty.
+func parseDateFlag(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid --%s %s: %s", name, value, err)
+	}
+	return date, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheStatus(t *testing.T) {
+	directory, err := ioutil.TempDir("", "availability-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	cacheDirectory = directory
+	outageThreshold = 5 * time.Minute
+	probeSourceSpec = "postgres"
+
+	day := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	filter := &probeFilter{ExcludedPrefixes: gatechPrefixes}
+	want := newCacheHeader(filter, `postgres dbname="bismark_mgmt"`, time.Date(2013, 7, 10, 0, 0, 0, 0, time.UTC))
+	intervals := map[string][]availabilityInterval{
+		"OW0000000001": {{exampleTime(1), exampleTime(2)}},
+	}
+
+	// Check that cache files survive a round trip and that we clean up
+	// temporary files.
+	if err := writeCacheFile(cacheFilename(day), want, intervals); err != nil {
+		t.Fatal(err)
+	}
+	header, got, err := readCacheFile(cacheFilename(day))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(header.Filter, want.Filter) || header.ProbeSource != want.ProbeSource || header.SourceIdentity != want.SourceIdentity || !header.ComputedAt.Equal(want.ComputedAt) {
+		t.Errorf("Got header %+v, want %+v", header, want)
+	}
+	if len(got["OW0000000001"]) != 1 || !got["OW0000000001"][0].EndTime.Equal(*exampleTime(2)) {
+		t.Errorf("Got intervals %v", got)
+	}
+	if files, _ := ioutil.ReadDir(directory); len(files) != 1 {
+		t.Errorf("Left %d files in the cache directory", len(files))
+	}
+
+	withHeader := func(change func(*cacheHeader)) func() {
+		return func() {
+			header := *want
+			change(&header)
+			if err := writeCacheFile(cacheFilename(day), &header, intervals); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	testCases := []struct {
+		name   string
+		write  func()
+		reason string
+	}{
+		{
+			name:   "missing",
+			write:  func() {},
+			reason: "missing",
+		},
+		{
+			name:  "fresh",
+			write: withHeader(func(*cacheHeader) {}),
+		},
+		{
+			name:  "empty lists",
+			write: withHeader(func(header *cacheHeader) { header.Filter.ExcludedNodes = []string{} }),
+		},
+		{
+			name:   "old version",
+			write:  withHeader(func(header *cacheHeader) { header.Version = 0 }),
+			reason: "format version 0, want 3",
+		},
+		{
+			name:   "threshold",
+			write:  withHeader(func(header *cacheHeader) { header.OutageThreshold = 10 * time.Minute }),
+			reason: "computed with --outage_threshold=10m0s, want 5m0s",
+		},
+		{
+			name:   "probe source",
+			write:  withHeader(func(header *cacheHeader) { header.ProbeSource = "csv:probes.csv.gz" }),
+			reason: "computed with --probes=csv:probes.csv.gz, want postgres",
+		},
+		{
+			name:   "source identity",
+			write:  withHeader(func(header *cacheHeader) { header.SourceIdentity = `postgres dbname="bismark_staging"` }),
+			reason: `computed from postgres dbname="bismark_staging", want postgres dbname="bismark_mgmt"`,
+		},
+		{
+			name:   "prefixes",
+			write:  withHeader(func(header *cacheHeader) { header.Filter.ExcludedPrefixes = nil }),
+			reason: "computed with different excluded prefixes",
+		},
+		{
+			name:   "included nodes",
+			write:  withHeader(func(header *cacheHeader) { header.Filter.RestrictNodes = true }),
+			reason: "computed with different included nodes",
+		},
+		{
+			name:   "incomplete",
+			write:  withHeader(func(header *cacheHeader) { header.ComputedAt = day.Add(36 * time.Hour) }),
+			reason: "incomplete; computed at 2013-07-02T12:00:00Z",
+		},
+		{
+			name: "no header",
+			write: func() {
+				handle, err := os.Create(cacheFilename(day))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer handle.Close()
+				if err := gob.NewEncoder(handle).Encode(intervals); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "unreadable: ",
+		},
+		{
+			name: "truncated header",
+			write: func() {
+				withHeader(func(*cacheHeader) {})()
+				if err := os.Truncate(cacheFilename(day), 10); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "unreadable: ",
+		},
+	}
+	for _, testCase := range testCases {
+		os.Remove(cacheFilename(day))
+		testCase.write()
+		reason := cacheStatus(want, day)
+		if strings.HasSuffix(testCase.reason, ": ") && strings.HasPrefix(reason, testCase.reason) {
+			continue
+		}
+		if reason != testCase.reason {
+			t.Errorf("%s: got %q, want %q", testCase.name, reason, testCase.reason)
+		}
+	}
+	// Checking the cache only reads headers, so it doesn't notice corrupt
+	// intervals, but reading them does.
+	os.Remove(cacheFilename(day))
+	withHeader(func(*cacheHeader) {})()
+	info, err := os.Stat(cacheFilename(day))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(cacheFilename(day), info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	if reason := cacheStatus(want, day); reason != "" {
+		t.Errorf("Truncated intervals: got %q, want a fresh cache", reason)
+	}
+	if _, _, err := readCacheFile(cacheFilename(day)); err == nil {
+		t.Errorf("Read truncated intervals without an error")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Georgia Tech's prefixes, which --exclude_gatech excludes.
+var gatechPrefixes = []string{"143.215.0.0/16", "130.207.0.0/16", "128.61.0.0/16"}
+
+// A probeFilter selects which rows of devices_log to compute intervals from.
+type probeFilter struct {
+	ExcludedPrefixes []string
+	ExcludedNodes    []string
+	// If RestrictNodes is set, we only consider IncludedNodes.
+	RestrictNodes bool
+	IncludedNodes []string
+}
+
+// readListFile reads one entry per line, ignoring blank lines and everything
+// after a #.
+func readListFile(filename string) ([]string, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(handle)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", filename, err)
+	}
+	return entries, nil
+}
+
+// parsePrefixes checks that each entry is a CIDR prefix or an IP address,
+// which we treat as a prefix containing only that address.
+func parsePrefixes(entries []string) ([]string, error) {
+	var prefixes []string
+	for _, entry := range entries {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			prefixes = append(prefixes, network.String())
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid prefix %q", entry)
+		}
+		if ip.To4() != nil {
+			prefixes = append(prefixes, ip.String()+"/32")
+		} else {
+			prefixes = append(prefixes, ip.String()+"/128")
+		}
+	}
+	return prefixes, nil
+}
+
+// newProbeFilter reads the filter's lists from the given files, any of which
+// may be empty to skip it.
+func newProbeFilter(excludeGatech bool, prefixesFile, excludedNodesFile, includedNodesFile string) (*probeFilter, error) {
+	filter := new(probeFilter)
+	if excludeGatech {
+		filter.ExcludedPrefixes = append(filter.ExcludedPrefixes, gatechPrefixes...)
+	}
+	if prefixesFile != "" {
+		entries, err := readListFile(prefixesFile)
+		if err != nil {
+			return nil, err
+		}
+		prefixes, err := parsePrefixes(entries)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", prefixesFile, err)
+		}
+		filter.ExcludedPrefixes = append(filter.ExcludedPrefixes, prefixes...)
+	}
+	if excludedNodesFile != "" {
+		nodes, err := readListFile(excludedNodesFile)
+		if err != nil {
+			return nil, err
+		}
+		filter.ExcludedNodes = nodes
+	}
+	if includedNodesFile != "" {
+		nodes, err := readListFile(includedNodesFile)
+		if err != nil {
+			return nil, err
+		}
+		filter.RestrictNodes = true
+		filter.IncludedNodes = nodes
+	}
+	return filter, nil
+}
+
+// matcher returns a function that reports whether a probe passes the filter,
+// like the conditions of query. As in Postgres, probes without an IP address
+// don't pass if we exclude any prefixes.
+func (filter *probeFilter) matcher() (func(probe) bool, error) {
+	var networks []*net.IPNet
+	for _, prefix := range filter.ExcludedPrefixes {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid prefix %q", prefix)
+		}
+		networks = append(networks, network)
+	}
+	excluded := make(map[string]bool)
+	for _, nodeId := range filter.ExcludedNodes {
+		excluded[nodeId] = true
+	}
+	included := make(map[string]bool)
+	for _, nodeId := range filter.IncludedNodes {
+		included[nodeId] = true
+	}
+	return func(p probe) bool {
+		if excluded[p.NodeId] || filter.RestrictNodes && !included[p.NodeId] {
+			return false
+		}
+		if len(networks) == 0 {
+			return true
+		}
+		// Postgres writes inet values with their netmask unless it's
+		// the whole address.
+		address := p.Ip
+		if idx := strings.Index(address, "/"); idx >= 0 {
+			address = address[:idx]
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return false
+		}
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+var arrayElementEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// arrayLiteral formats values as a Postgres array literal, so we can bind a
+// whole list to one query parameter.
+func arrayLiteral(values []string) string {
+	quoted := make([]string, len(values))
+	for idx, value := range values {
+		quoted[idx] = `"` + arrayElementEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// query returns a query for the probes seen in [$1, $2) that pass the
+// filter, and the parameters to bind after the start and end times.
+func (filter *probeFilter) query() (string, []interface{}) {
+	conditions := []string{"date_seen >= $1", "date_seen < $2"}
+	var parameters []interface{}
+	parameter := func(value []string, condition string) {
+		parameters = append(parameters, arrayLiteral(value))
+		conditions = append(conditions, fmt.Sprintf(condition, len(parameters)+2))
+	}
+	if len(filter.ExcludedPrefixes) > 0 {
+		parameter(filter.ExcludedPrefixes, "NOT ip <<= ANY ($%d::inet[])")
+	}
+	if len(filter.ExcludedNodes) > 0 {
+		parameter(filter.ExcludedNodes, "id <> ALL ($%d::text[])")
+	}
+	if filter.RestrictNodes {
+		parameter(filter.IncludedNodes, "id = ANY ($%d::text[])")
+	}
+	return "SELECT date_seen, id FROM devices_log WHERE " + strings.Join(conditions, " AND ") + " ORDER BY date_seen", parameters
+}
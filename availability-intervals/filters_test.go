@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func Example_probeFilter() {
+	directory, err := ioutil.TempDir("", "availability-filters")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(directory)
+	write := func(name, contents string) string {
+		filename := filepath.Join(directory, name)
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			fmt.Println(err)
+		}
+		return filename
+	}
+	prefixes := write("prefixes", "# Lab networks\n10.1.0.0/16\n\n192.168.1.7  # Test router\n2001:db8::/32\n")
+	nodes := write("nodes", "OW0000000001\nOW\"quoted\\\n")
+
+	for _, filter := range []*probeFilter{new(probeFilter), {RestrictNodes: true}} {
+		query, parameters := filter.query()
+		fmt.Println(query, parameters)
+	}
+
+	filter, err := newProbeFilter(true, prefixes, nodes, nodes)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	query, parameters := filter.query()
+	fmt.Println(query)
+	for _, parameter := range parameters {
+		fmt.Println(parameter)
+	}
+
+	_, err = newProbeFilter(false, write("invalid", "10.1/16\n"), "", "")
+	fmt.Println(err != nil)
+
+	// Output:
+	// SELECT date_seen, id FROM devices_log WHERE date_seen >= $1 AND date_seen < $2 ORDER BY date_seen []
+	// SELECT date_seen, id FROM devices_log WHERE date_seen >= $1 AND date_seen < $2 AND id = ANY ($3::text[]) ORDER BY date_seen [{}]
+	// SELECT date_seen, id FROM devices_log WHERE date_seen >= $1 AND date_seen < $2 AND NOT ip <<= ANY ($3::inet[]) AND id <> ALL ($4::text[]) AND id = ANY ($5::text[]) ORDER BY date_seen
+	// {"143.215.0.0/16","130.207.0.0/16","128.61.0.0/16","10.1.0.0/16","192.168.1.7/32","2001:db8::/32"}
+	// {"OW0000000001","OW\"quoted\\"}
+	// {"OW0000000001","OW\"quoted\\"}
+	// true
+	//
+}
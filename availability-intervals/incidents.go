@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer/store"
+)
+
+// A nodeOutage is a gap between a node's coalesced intervals, or the time
+// after its last interval if we haven't heard from it since.
+type nodeOutage struct {
+	NodeId     string
+	Start, End time.Time
+}
+
+// nodeOutages returns every node's outages, sorted by start time. Our data
+// ends at maxDate or the last probe, whichever is earlier, so nodes that were
+// up when we last heard from the fleet aren't in an outage.
+func nodeOutages(allIntervals map[string][]availabilityInterval, maxDate time.Time) []nodeOutage {
+	dataEnd := lastProbe(allIntervals)
+	if maxDate.Before(dataEnd) {
+		dataEnd = maxDate
+	}
+	var outages []nodeOutage
+	for nodeId, intervals := range allIntervals {
+		for idx := 1; idx < len(intervals); idx++ {
+			outages = append(outages, nodeOutage{nodeId, *intervals[idx-1].EndTime, *intervals[idx].StartTime})
+		}
+		if len(intervals) == 0 {
+			continue
+		}
+		if lastEnd := *intervals[len(intervals)-1].EndTime; dataEnd.Sub(lastEnd) > outageThreshold {
+			outages = append(outages, nodeOutage{nodeId, lastEnd, dataEnd})
+		}
+	}
+	sort.Slice(outages, func(i, j int) bool {
+		if !outages[i].Start.Equal(outages[j].Start) {
+			return outages[i].Start.Before(outages[j].Start)
+		}
+		return outages[i].NodeId < outages[j].NodeId
+	})
+	return outages
+}
+
+// An incident is a window where many nodes lost contact at once, like when
+// the management server or a national ISP goes down. It starts when the
+// first affected node lost contact and ends when half of them had recovered.
+type incident struct {
+	timeWindow
+	Nodes []string
+}
+
+// upCounter counts the nodes that were up at increasing times.
+type upCounter struct {
+	times  []time.Time
+	deltas []int
+	next   int
+	up     int
+}
+
+func newUpCounter(allIntervals map[string][]availabilityInterval) *upCounter {
+	type event struct {
+		time  time.Time
+		delta int
+	}
+	var events []event
+	for _, intervals := range allIntervals {
+		for _, interval := range intervals {
+			events = append(events, event{*interval.StartTime, 1}, event{*interval.EndTime, -1})
+		}
+	}
+	// Process starts before ends at the same time, so a node that
+	// lost contact exactly at t still counts as up at t.
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].time.Equal(events[j].time) {
+			return events[i].time.Before(events[j].time)
+		}
+		return events[i].delta > events[j].delta
+	})
+	counter := new(upCounter)
+	for _, e := range events {
+		counter.times = append(counter.times, e.time)
+		counter.deltas = append(counter.deltas, e.delta)
+	}
+	return counter
+}
+
+// at returns the number of nodes up at t, which must not precede the time
+// passed to the previous call.
+func (c *upCounter) at(t time.Time) int {
+	for c.next < len(c.times) && (c.times[c.next].Before(t) || c.times[c.next].Equal(t) && c.deltas[c.next] > 0) {
+		c.up += c.deltas[c.next]
+		c.next++
+	}
+	return c.up
+}
+
+// detectIncidents groups the start of every outage into windows of the given
+// size and reports an incident for each run of consecutive windows where at
+// least minNodes nodes, and at least fraction of the nodes up at the start of
+// the window, lost contact.
+func detectIncidents(allIntervals map[string][]availabilityInterval, maxDate time.Time, window time.Duration, fraction float64, minNodes int) []incident {
+	outages := nodeOutages(allIntervals, maxDate)
+	counter := newUpCounter(allIntervals)
+
+	var incidents []incident
+	var current []nodeOutage
+	var currentEnd time.Time
+	finish := func() {
+		if len(current) > 0 {
+			incidents = append(incidents, newIncident(current))
+		}
+		current = nil
+	}
+	for idx := 0; idx < len(outages); {
+		bucketStart := outages[idx].Start.Truncate(window)
+		bucketEnd := bucketStart.Add(window)
+		end := idx
+		for end < len(outages) && outages[end].Start.Before(bucketEnd) {
+			end++
+		}
+		affected := end - idx
+		up := counter.at(bucketStart)
+		if up < affected {
+			up = affected
+		}
+		if affected >= minNodes && float64(affected) >= fraction*float64(up) {
+			if !bucketStart.Equal(currentEnd) {
+				finish()
+			}
+			current = append(current, outages[idx:end]...)
+			currentEnd = bucketEnd
+		} else {
+			finish()
+		}
+		idx = end
+	}
+	finish()
+	return incidents
+}
+
+func newIncident(outages []nodeOutage) incident {
+	var recoveries []time.Time
+	recovered := make(map[string]time.Time)
+	for _, outage := range outages {
+		// A node that lost contact more than once during the incident
+		// counts once, recovering when it last came back.
+		if outage.End.After(recovered[outage.NodeId]) {
+			recovered[outage.NodeId] = outage.End
+		}
+	}
+	var result incident
+	result.Start = outages[0].Start
+	for nodeId, end := range recovered {
+		result.Nodes = append(result.Nodes, nodeId)
+		recoveries = append(recoveries, end)
+	}
+	sort.Strings(result.Nodes)
+	sort.Slice(recoveries, func(i, j int) bool { return recoveries[i].Before(recoveries[j]) })
+	result.End = recoveries[(len(recoveries)-1)/2]
+	return result
+}
+
+// incidentExclusions returns the incident windows affecting each node, in
+// the form computeReliability takes.
+func incidentExclusions(incidents []incident) map[string][]timeWindow {
+	excluded := make(map[string][]timeWindow)
+	for _, incident := range incidents {
+		for _, nodeId := range incident.Nodes {
+			excluded[nodeId] = append(excluded[nodeId], incident.timeWindow)
+		}
+	}
+	return excluded
+}
+
+// incidentCountries summarizes the countries of an incident's nodes, like
+// "GB:1,US:12".
+func incidentCountries(incident incident, countries map[string]string) string {
+	counts := make(map[string]int)
+	for _, nodeId := range incident.Nodes {
+		counts[nodeCountry(countries, nodeId)]++
+	}
+	var names []string
+	for country := range counts {
+		names = append(names, country)
+	}
+	sort.Strings(names)
+	var summary []string
+	for _, country := range names {
+		summary = append(summary, fmt.Sprintf("%s:%d", country, counts[country]))
+	}
+	return strings.Join(summary, ",")
+}
+
+// writeIncidents writes a table of incidents and a table of the nodes each
+// affected, named incidents and incident-nodes followed by suffix.
+func writeIncidents(incidents []incident, countries map[string]string, manager store.Manager, suffix string) error {
+	var start, end, nodes int64
+	var node, country, countrySummary string
+
+	incidentsWriter := manager.Writer("incidents"+suffix, []string{"start"}, []string{"end", "nodes", "countries"}, &start, &end, &nodes, &countrySummary)
+	if err := incidentsWriter.BeginWriting(); err != nil {
+		return fmt.Errorf("Error writing incidents: %s", err)
+	}
+	for _, incident := range incidents {
+		record := store.Record{
+			Key:   lex.EncodeOrDie(incident.Start.Unix()),
+			Value: lex.EncodeOrDie(incident.End.Unix(), int64(len(incident.Nodes)), incidentCountries(incident, countries)),
+		}
+		if err := incidentsWriter.WriteRecord(&record); err != nil {
+			return fmt.Errorf("Error writing incidents: %s", err)
+		}
+	}
+	if err := incidentsWriter.EndWriting(); err != nil {
+		return fmt.Errorf("Error writing incidents: %s", err)
+	}
+
+	nodesWriter := manager.Writer("incident-nodes"+suffix, []string{"start", "node"}, []string{"country"}, &start, &node, &country)
+	if err := nodesWriter.BeginWriting(); err != nil {
+		return fmt.Errorf("Error writing incident nodes: %s", err)
+	}
+	for _, incident := range incidents {
+		for _, nodeId := range incident.Nodes {
+			record := store.Record{
+				Key:   lex.EncodeOrDie(incident.Start.Unix(), nodeId),
+				Value: lex.EncodeOrDie(nodeCountry(countries, nodeId)),
+			}
+			if err := nodesWriter.WriteRecord(&record); err != nil {
+				return fmt.Errorf("Error writing incident nodes: %s", err)
+			}
+		}
+	}
+	if err := nodesWriter.EndWriting(); err != nil {
+		return fmt.Errorf("Error writing incident nodes: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func exampleMinutes(minutes int) *time.Time {
+	t := exampleTime(0).Add(time.Duration(minutes) * time.Minute)
+	return &t
+}
+
+func Example_detectIncidents() {
+	outageThreshold = 5 * time.Minute
+	allIntervals := map[string][]availabilityInterval{
+		// Three of the four nodes lose contact between 10:01 and 10:03.
+		// The first also has an outage of its own at 15:00.
+		"OW0000000001": {
+			{exampleMinutes(0), exampleMinutes(601)},
+			{exampleMinutes(660), exampleMinutes(900)},
+			{exampleMinutes(960), exampleMinutes(1440)},
+		},
+		"OW0000000002": {
+			{exampleMinutes(0), exampleMinutes(602)},
+			{exampleMinutes(690), exampleMinutes(1440)},
+		},
+		"OW0000000003": {
+			{exampleMinutes(0), exampleMinutes(603)},
+			{exampleMinutes(720), exampleMinutes(1440)},
+		},
+		"OW0000000004": {
+			{exampleMinutes(0), exampleMinutes(1440)},
+		},
+	}
+	countries := map[string]string{"OW0000000001": "US", "OW0000000002": "US", "OW0000000003": "GB"}
+	maxDate := *exampleMinutes(1440)
+
+	incidents := detectIncidents(allIntervals, maxDate, 5*time.Minute, 0.5, 2)
+	for _, incident := range incidents {
+		fmt.Println(incident.Start.Format("15:04"), incident.End.Format("15:04"), incident.Nodes, incidentCountries(incident, countries))
+	}
+	fmt.Println(len(detectIncidents(allIntervals, maxDate, 5*time.Minute, 0.8, 2)))
+	fmt.Println(len(detectIncidents(allIntervals, maxDate, 5*time.Minute, 0.5, 4)))
+
+	// The incident ends when half the nodes have recovered, so the third
+	// node's last half hour still counts against it.
+	report, err := computeReliability(allIntervals, countries, incidentExclusions(incidents), "day", *exampleMinutes(0), maxDate, maxDate)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, node := range sortedKeys(report.byNode) {
+		for _, period := range sortedPeriods(report.byNode[node]) {
+			printStats(node, report.byNode[node][period])
+		}
+	}
+
+	// Output:
+	// 10:01 11:30 [OW0000000001 OW0000000002 OW0000000003] GB:1,US:2
+	// 0
+	// 0
+	// OW0000000001: nodes=1 observed=22h31m0s available=21h31m0s availability=9555 outages=1 mtbf=21h31m0s mttr=1h0m0s longest=1h0m0s
+	// OW0000000002: nodes=1 observed=22h31m0s available=22h31m0s availability=10000 outages=0 mtbf=0s mttr=0s longest=0s
+	// OW0000000003: nodes=1 observed=22h31m0s available=22h1m0s availability=9777 outages=1 mtbf=22h1m0s mttr=30m0s longest=30m0s
+	// OW0000000004: nodes=1 observed=24h0m0s available=24h0m0s availability=10000 outages=0 mtbf=0s mttr=0s longest=0s
+	//
+}
+
+func Example_detectIncidents_lastProbe() {
+	outageThreshold = 5 * time.Minute
+	// Every node was up when we last heard from the fleet at noon, so
+	// computing through midnight mustn't make them all lose contact then.
+	// The third node lost contact at 11:00 and never came back.
+	allIntervals := map[string][]availabilityInterval{
+		"OW0000000001": {{exampleMinutes(0), exampleMinutes(720)}},
+		"OW0000000002": {{exampleMinutes(0), exampleMinutes(719)}},
+		"OW0000000003": {{exampleMinutes(0), exampleMinutes(660)}},
+	}
+	for _, outage := range nodeOutages(allIntervals, *exampleMinutes(1440)) {
+		fmt.Println(outage.NodeId, outage.Start.Format("15:04"), outage.End.Format("15:04"))
+	}
+	fmt.Println(len(detectIncidents(allIntervals, *exampleMinutes(1440), 5*time.Minute, 0.5, 2)))
+
+	// Output:
+	// OW0000000003 11:00 12:00
+	// 0
+	//
+}
@@ -1,18 +1,16 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/gob"
 	"encoding/json"
 	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"strings"
 	"time"
 
-	_ "github.com/bmizerany/pq"
+	"github.com/sburnett/bismark-tools/common/config"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer/store"
 )
@@ -24,8 +22,17 @@ type availabilityInterval struct {
 var outageThreshold time.Duration
 var outputFile, cacheDirectory string
 var outputLevelDb string
-var minDate time.Time
+var minDateString string
 var excludeGatech bool
+var excludePrefixesFile, excludeNodesFile, includeNodesFile string
+var probeSourceSpec, postgresConnection, countriesSpec string
+var recomputeFromString, recomputeToString string
+var statsPeriod, statsCsvOutput, statsSqliteFilename string
+var detectCorrelatedOutages, excludeIncidents bool
+var incidentWindow time.Duration
+var incidentFraction float64
+var incidentMinNodes int
+var incidentsCsvOutput, incidentsSqliteFilename string
 
 var rowsProcessed, intervalsCreated *expvar.Int
 
@@ -34,57 +41,44 @@ func init() {
 	flag.StringVar(&outputFile, "output_file", "/tmp/bismark-availability.json", "Write avilability to this file in JSON format")
 	flag.StringVar(&outputLevelDb, "output_leveldb", "/tmp/bismark-availability-leveldb", "Write avilability to this leveldb")
 	flag.StringVar(&cacheDirectory, "cache_dir", "/tmp/bismark-availability-intervals", "Cache avilability intervals in this directory")
+	flag.StringVar(&probeSourceSpec, "probes", "postgres", "Where to read probes from: postgres, csv:PATH (a dump of devices_log with a header row, optionally gzipped) or sqlite:PATH; we read whole CSV and SQLite dumps into memory")
+	flag.StringVar(&postgresConnection, "postgres", "", "Postgres connection string for --probes=postgres, like \"host=localhost dbname=bismark_mgmt\"; PG* environment variables fill in the rest")
 	flag.BoolVar(&excludeGatech, "exclude_gatech", false, "Whether to exclude probes from GT addresses.")
-	var dateString string
-	flag.StringVar(&dateString, "min_date", "2012-04-13", "Calculate intervals starting at this date")
-	flag.Parse()
-
-	dateParsed, err := time.Parse("2006-01-02", dateString)
-	if err != nil {
-		panic(fmt.Errorf("Invalid date %s: %s", dateString, err))
-	}
-	minDate = dateParsed
+	flag.StringVar(&excludePrefixesFile, "exclude_prefixes_file", "", "Exclude probes from the CIDR prefixes listed in this file, one per line; # starts a comment.")
+	flag.StringVar(&excludeNodesFile, "exclude_nodes_file", "", "Exclude probes from the nodes listed in this file, one per line; # starts a comment.")
+	flag.StringVar(&includeNodesFile, "include_nodes_file", "", "Only include probes from the nodes listed in this file, one per line; # starts a comment.")
+	flag.StringVar(&minDateString, "min_date", "2012-04-13", "Calculate intervals starting at this date")
+	flag.StringVar(&recomputeFromString, "recompute_from", "", "Recompute cached intervals starting at this date, even if they're up to date")
+	flag.StringVar(&recomputeToString, "recompute_to", "", "With --recompute_from, recompute cached intervals through this date instead of through today")
+	flag.StringVar(&statsPeriod, "stats_period", "", "Compute reliability stats for each day, week or month; leave empty to skip them.")
+	flag.StringVar(&statsCsvOutput, "stats_csv_output", "/dev/null", "Write reliability stats to CSV files in this directory.")
+	flag.StringVar(&statsSqliteFilename, "stats_sqlite_filename", "/dev/null", "Write reliability stats to this sqlite database.")
+	flag.StringVar(&countriesSpec, "countries_from", "", "Where to read each node's country for stats and incidents: registry:PATH (the country attribute of a node registry) or csv:PATH (a file with node_id and country columns, like the output of bdmq --format=csv devices); leave empty to report every country as ??")
+	flag.BoolVar(&detectCorrelatedOutages, "detect_incidents", false, "Detect incidents where many nodes lost contact at once.")
+	flag.DurationVar(&incidentWindow, "incident_window", 5*time.Minute, "Count nodes that lost contact within windows of this size as losing contact at once.")
+	flag.Float64Var(&incidentFraction, "incident_fraction", 0.2, "Report an incident when at least this fraction of the nodes that were up lost contact within one window.")
+	flag.IntVar(&incidentMinNodes, "incident_min_nodes", 10, "Report an incident only when at least this many nodes lost contact within one window.")
+	flag.StringVar(&incidentsCsvOutput, "incidents_csv_output", "/dev/null", "Write incidents to CSV files in this directory.")
+	flag.StringVar(&incidentsSqliteFilename, "incidents_sqlite_filename", "/dev/null", "Write incidents to this sqlite database.")
+	flag.BoolVar(&excludeIncidents, "exclude_incidents", false, "Leave incidents out of the affected nodes' reliability stats; implies --detect_incidents.")
 
 	rowsProcessed = expvar.NewInt("RowsProcessed")
 	intervalsCreated = expvar.NewInt("IntervalsCreated")
 }
 
-func writeIntervals(availabilityIntervals map[string][]availabilityInterval, outputFile string) error {
-	intervalsFile, err := os.Create(outputFile)
-	if err != nil {
-		return err
-	}
-	defer intervalsFile.Close()
-
-	encoder := gob.NewEncoder(intervalsFile)
-	if err := encoder.Encode(availabilityIntervals); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func processDay(db *sql.DB, startTime time.Time, filename string) error {
+func processDay(source probeSource, want *cacheHeader, startTime time.Time, filename string) error {
 	endTime := startTime.AddDate(0, 0, 1)
 
 	currentStarts := make(map[string]*time.Time)
 	currentEnds := make(map[string]*time.Time)
 	availabilityIntervals := make(map[string][]availabilityInterval)
 
-	var query string
-	if excludeGatech {
-		query = "SELECT date_seen, id FROM devices_log WHERE date_seen >= $1 AND date_seen < $2 AND NOT (ip << inet '143.215/16' OR ip << inet '130.207/16' OR ip << inet '128.61/16') ORDER BY date_seen"
-	} else {
-		query = "SELECT date_seen, id FROM devices_log WHERE date_seen >= $1 AND date_seen < $2 ORDER BY date_seen"
-	}
-	rows, err := db.Query(query, startTime, endTime)
+	probes, err := source.Probes(&want.Filter, startTime, endTime)
 	if err != nil {
 		return err
 	}
-	for rows.Next() {
-		var dateSeen time.Time
-		var nodeId string
-		rows.Scan(&dateSeen, &nodeId)
+	for _, probe := range probes {
+		dateSeen, nodeId := probe.DateSeen, probe.NodeId
 
 		if currentEnds[nodeId] != nil && dateSeen.Sub(*currentEnds[nodeId]) > outageThreshold {
 			currentInterval := availabilityInterval{currentStarts[nodeId], currentEnds[nodeId]}
@@ -99,16 +93,15 @@ func processDay(db *sql.DB, startTime time.Time, filename string) error {
 
 		rowsProcessed.Add(int64(1))
 	}
-	if err := rows.Err(); err != nil {
-		return err
-	}
 	for nodeId := range currentStarts {
 		currentInterval := availabilityInterval{currentStarts[nodeId], currentEnds[nodeId]}
 		availabilityIntervals[nodeId] = append(availabilityIntervals[nodeId], currentInterval)
 		intervalsCreated.Add(int64(1))
 	}
 
-	if err := writeIntervals(availabilityIntervals, filename); err != nil {
+	header := *want
+	header.ComputedAt = time.Now()
+	if err := writeCacheFile(filename, &header, availabilityIntervals); err != nil {
 		return err
 	}
 
@@ -134,20 +127,17 @@ func coalesceIntervals(allIntervals map[string][]availabilityInterval) {
 func concatenateDailyIntervals(minDate, maxDate time.Time) (map[string][]availabilityInterval, error) {
 	availabilityIntervals := make(map[string][]availabilityInterval)
 	for currentDate := minDate; currentDate.Before(maxDate); currentDate = currentDate.AddDate(0, 0, 1) {
-		var currentIntervals map[string][]availabilityInterval
-		filename := filepath.Join(cacheDirectory, currentDate.Format("2006-01-02.gob"))
-		intervalsFile, err := os.Open(filename)
+		filename := cacheFilename(currentDate)
+		header, currentIntervals, err := readCacheFile(filename)
 		if err != nil {
 			return nil, err
 		}
-		decoder := gob.NewDecoder(intervalsFile)
-		if err := decoder.Decode(&currentIntervals); err != nil {
-			return nil, err
+		if header.Version != cacheFormatVersion {
+			return nil, fmt.Errorf("%s has format version %d, want %d", filename, header.Version, cacheFormatVersion)
 		}
 		for nodeId, intervals := range currentIntervals {
 			availabilityIntervals[nodeId] = append(availabilityIntervals[nodeId], intervals...)
 		}
-		intervalsFile.Close()
 	}
 	coalesceIntervals(availabilityIntervals)
 	return availabilityIntervals, nil
@@ -211,28 +201,111 @@ func writeAvailabilityLevelDb(allIntervals map[string][]availabilityInterval) er
 	return nil
 }
 
+// writeAnalyses writes incidents and reliability stats, if we want them.
+// Our data ends with the last probe, not at maxDate, which is in the future.
+func writeAnalyses(allIntervals map[string][]availabilityInterval, countries map[string]string, minDate, maxDate time.Time) error {
+	dataEnd := lastProbe(allIntervals)
+	var excluded map[string][]timeWindow
+	if detectCorrelatedOutages {
+		incidents := detectIncidents(allIntervals, maxDate, incidentWindow, incidentFraction, incidentMinNodes)
+		log.Printf("Detected %d incidents", len(incidents))
+		if err := writeIncidents(incidents, countries, store.NewCsvFileManager(incidentsCsvOutput), ".csv"); err != nil {
+			return err
+		}
+		if err := writeIncidents(incidents, countries, store.NewSqliteManager(incidentsSqliteFilename), ""); err != nil {
+			return err
+		}
+		if excludeIncidents {
+			excluded = incidentExclusions(incidents)
+		}
+	}
+
+	if statsPeriod == "" {
+		return nil
+	}
+	report, err := computeReliability(allIntervals, countries, excluded, statsPeriod, minDate, maxDate, dataEnd)
+	if err != nil {
+		return err
+	}
+	if err := writeReliability(report, store.NewCsvFileManager(statsCsvOutput), ".csv"); err != nil {
+		return err
+	}
+	return writeReliability(report, store.NewSqliteManager(statsSqliteFilename), "")
+}
+
 func main() {
-	db, err := sql.Open("postgres", "")
+	flag.Parse()
+	if err := config.Setup(); err != nil {
+		panic(err)
+	}
+	minDate, err := time.Parse("2006-01-02", minDateString)
+	if err != nil {
+		panic(fmt.Errorf("Invalid date %s: %s", minDateString, err))
+	}
+	if statsPeriod != "" {
+		if _, err := periodStart(statsPeriod, minDate); err != nil {
+			panic(err)
+		}
+	}
+	if excludeIncidents {
+		detectCorrelatedOutages = true
+	}
+	countries, err := nodeCountries(countriesSpec)
+	if err != nil {
+		panic(err)
+	}
+	filter, err := newProbeFilter(excludeGatech, excludePrefixesFile, excludeNodesFile, includeNodesFile)
+	if err != nil {
+		panic(err)
+	}
+
+	recomputeFrom, err := parseDateFlag("recompute_from", recomputeFromString)
+	if err != nil {
+		panic(err)
+	}
+	recomputeTo, err := parseDateFlag("recompute_to", recomputeToString)
 	if err != nil {
 		panic(err)
 	}
-	defer db.Close()
+	if recomputeFrom.IsZero() && !recomputeTo.IsZero() {
+		panic(fmt.Errorf("--recompute_to requires --recompute_from"))
+	}
 
-	now := time.Now()
+	now := time.Now().UTC()
 	maxDate := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
-	firstDate := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
-	for currentDate := minDate; currentDate.Before(maxDate); currentDate = currentDate.AddDate(0, 0, 1) {
-		filename := filepath.Join(cacheDirectory, currentDate.Format("2006-01-02.gob"))
-		if _, err := os.Stat(filename); err != nil {
-			firstDate = currentDate.AddDate(0, 0, -1)
-			break
+	sourceIdentity, err := probeSourceIdentity(probeSourceSpec)
+	if err != nil {
+		panic(err)
+	}
+	want := newCacheHeader(filter, sourceIdentity, now)
+
+	switch strings.Join(flag.Args(), " ") {
+	case "":
+	case "cache verify":
+		if verifyCache(want, minDate, maxDate) > 0 {
+			os.Exit(1)
 		}
+		return
+	default:
+		panic(fmt.Errorf("Unknown command %q; the only command is \"cache verify\"", strings.Join(flag.Args(), " ")))
 	}
 
-	for currentDate := firstDate; currentDate.Before(maxDate); currentDate = currentDate.AddDate(0, 0, 1) {
-		log.Printf("Processing %s", currentDate.Format("2006-01-02"))
-		filename := filepath.Join(cacheDirectory, currentDate.Format("2006-01-02.gob"))
-		if err := processDay(db, currentDate, filename); err != nil {
+	source, err := openProbeSource(probeSourceSpec, filter)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+
+	for currentDate := minDate; currentDate.Before(maxDate); currentDate = currentDate.AddDate(0, 0, 1) {
+		reason := cacheStatus(want, currentDate)
+		if !recomputeFrom.IsZero() && !currentDate.Before(recomputeFrom) && (recomputeTo.IsZero() || !currentDate.After(recomputeTo)) {
+			reason = "in --recompute_from and --recompute_to"
+		}
+		if reason == "" {
+			continue
+		}
+		log.Printf("Processing %s: %s", currentDate.Format("2006-01-02"), reason)
+		if err := processDay(source, want, currentDate, cacheFilename(currentDate)); err != nil {
 			panic(err)
 		}
 	}
@@ -248,4 +321,9 @@ func main() {
 	if err := writeAvailabilityLevelDb(allIntervals); err != nil {
 		panic(err)
 	}
+	if statsPeriod != "" || detectCorrelatedOutages {
+		if err := writeAnalyses(allIntervals, countries, minDate, maxDate); err != nil {
+			panic(err)
+		}
+	}
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// probeAt returns a probe at the given time on July 1st, 2013, or later days
+// if day is more than 1.
+func probeAt(nodeId string, day int, clock string) probe {
+	t, err := time.Parse("2006-01-02 15:04:05", fmt.Sprintf("2013-07-%02d %s", day, clock))
+	if err != nil {
+		panic(err)
+	}
+	return probe{NodeId: nodeId, Ip: "10.0.0.1", DateSeen: t}
+}
+
+func formatIntervals(allIntervals map[string][]availabilityInterval) []string {
+	var nodeIds []string
+	for nodeId := range allIntervals {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Strings(nodeIds)
+	var formatted []string
+	for _, nodeId := range nodeIds {
+		for _, interval := range allIntervals[nodeId] {
+			formatted = append(formatted, fmt.Sprintf("%s %s %s", nodeId, interval.StartTime.Format("01-02 15:04:05"), interval.EndTime.Format("01-02 15:04:05")))
+		}
+	}
+	return formatted
+}
+
+// computeIntervals runs probes through processDay for July 1st and 2nd, 2013
+// and concatenates the results.
+func computeIntervals(t *testing.T, probes []probe, filter *probeFilter) map[string][]availabilityInterval {
+	directory, err := ioutil.TempDir("", "availability-intervals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	cacheDirectory = directory
+
+	source := newMemorySource(probes)
+	minDate := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	maxDate := minDate.AddDate(0, 0, 2)
+	for currentDate := minDate; currentDate.Before(maxDate); currentDate = currentDate.AddDate(0, 0, 1) {
+		filename := filepath.Join(cacheDirectory, currentDate.Format("2006-01-02.gob"))
+		if err := processDay(source, newCacheHeader(filter, "memory", minDate), currentDate, filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allIntervals, err := concatenateDailyIntervals(minDate, maxDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return allIntervals
+}
+
+func TestProcessDay(t *testing.T) {
+	outageThreshold = 5 * time.Minute
+	testCases := []struct {
+		name   string
+		probes []probe
+		filter probeFilter
+		want   []string
+	}{
+		{
+			name: "probes across midnight",
+			probes: []probe{
+				probeAt("OW0000000001", 1, "23:50:00"),
+				probeAt("OW0000000001", 1, "23:55:00"),
+				probeAt("OW0000000001", 1, "23:59:59"),
+				probeAt("OW0000000001", 2, "00:04:00"),
+				probeAt("OW0000000001", 2, "00:09:00"),
+			},
+			want: []string{"OW0000000001 07-01 23:50:00 07-02 00:09:00"},
+		},
+		{
+			name: "gap of exactly the threshold",
+			probes: []probe{
+				probeAt("OW0000000001", 1, "12:00:00"),
+				probeAt("OW0000000001", 1, "12:05:00"),
+			},
+			want: []string{"OW0000000001 07-01 12:00:00 07-01 12:05:00"},
+		},
+		{
+			name: "gap just over the threshold",
+			probes: []probe{
+				probeAt("OW0000000001", 1, "12:00:00"),
+				probeAt("OW0000000001", 1, "12:05:01"),
+				probeAt("OW0000000001", 1, "12:06:00"),
+			},
+			want: []string{
+				"OW0000000001 07-01 12:00:00 07-01 12:00:00",
+				"OW0000000001 07-01 12:05:01 07-01 12:06:00",
+			},
+		},
+		{
+			name: "gap over the threshold across midnight",
+			probes: []probe{
+				probeAt("OW0000000001", 1, "23:54:00"),
+				probeAt("OW0000000001", 1, "23:58:00"),
+				probeAt("OW0000000001", 2, "00:04:00"),
+				probeAt("OW0000000001", 2, "00:05:00"),
+			},
+			want: []string{
+				"OW0000000001 07-01 23:54:00 07-01 23:58:00",
+				"OW0000000001 07-02 00:04:00 07-02 00:05:00",
+			},
+		},
+		{
+			name: "nodes are independent and probes needn't be ordered",
+			probes: []probe{
+				probeAt("OW0000000002", 1, "12:10:00"),
+				probeAt("OW0000000001", 1, "12:04:00"),
+				probeAt("OW0000000002", 1, "12:02:00"),
+				probeAt("OW0000000001", 1, "12:00:00"),
+			},
+			want: []string{
+				"OW0000000001 07-01 12:00:00 07-01 12:04:00",
+				"OW0000000002 07-01 12:02:00 07-01 12:02:00",
+				"OW0000000002 07-01 12:10:00 07-01 12:10:00",
+			},
+		},
+		{
+			name: "probes outside the days",
+			probes: []probe{
+				probeAt("OW0000000001", 1, "00:00:00"),
+				probeAt("OW0000000002", 3, "00:00:00"),
+			},
+			want: []string{"OW0000000001 07-01 00:00:00 07-01 00:00:00"},
+		},
+		{
+			name: "filtered probes",
+			probes: []probe{
+				probeAt("OW0000000001", 1, "12:00:00"),
+				probeAt("OW0000000002", 1, "12:00:00"),
+				{NodeId: "OW0000000001", Ip: "143.215.1.1", DateSeen: probeAt("", 1, "12:03:00").DateSeen},
+				probeAt("OW0000000001", 1, "12:06:00"),
+			},
+			filter: probeFilter{ExcludedPrefixes: gatechPrefixes, ExcludedNodes: []string{"OW0000000002"}},
+			want: []string{
+				"OW0000000001 07-01 12:00:00 07-01 12:00:00",
+				"OW0000000001 07-01 12:06:00 07-01 12:06:00",
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		got := formatIntervals(computeIntervals(t, testCase.probes, &testCase.filter))
+		if !reflect.DeepEqual(got, testCase.want) {
+			t.Errorf("%s: got %q, want %q", testCase.name, got, testCase.want)
+		}
+	}
+}
+
+func TestCoalesceIntervals(t *testing.T) {
+	outageThreshold = 5 * time.Minute
+	at := func(clock string) *time.Time {
+		t := probeAt("", 1, clock).DateSeen
+		return &t
+	}
+	allIntervals := map[string][]availabilityInterval{
+		"OW0000000001": {
+			{at("00:00:00"), at("01:00:00")},
+			{at("01:05:00"), at("02:00:00")},
+			{at("02:05:00"), at("03:00:00")},
+			{at("03:05:01"), at("04:00:00")},
+		},
+		"OW0000000002": {
+			{at("00:00:00"), at("00:00:00")},
+		},
+	}
+	coalesceIntervals(allIntervals)
+	want := []string{
+		"OW0000000001 07-01 00:00:00 07-01 03:00:00",
+		"OW0000000001 07-01 03:05:01 07-01 04:00:00",
+		"OW0000000002 07-01 00:00:00 07-01 00:00:00",
+	}
+	if got := formatIntervals(allIntervals); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
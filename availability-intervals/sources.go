@@ -0,0 +1,255 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sburnett/bismark-tools/common/postgres"
+)
+
+// A probe is one row of devices_log.
+type probe struct {
+	NodeId   string
+	Ip       string
+	DateSeen time.Time
+}
+
+// A probeSource reads probes from devices_log or a dump of it.
+type probeSource interface {
+	// Probes returns the probes seen in [start, end) that pass the
+	// filter, ordered by time.
+	Probes(filter *probeFilter, start, end time.Time) ([]probe, error)
+	Close() error
+}
+
+// openProbeSource opens postgres, csv:PATH or sqlite:PATH for probes that
+// we'll filter with filter. We read the whole of a CSV or SQLite dump into
+// memory when we open it.
+func openProbeSource(spec string, filter *probeFilter) (probeSource, error) {
+	kind, path := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		kind, path = spec[:idx], spec[idx+1:]
+	}
+	switch {
+	case kind == "postgres" && path == "":
+		db, err := postgres.Open(postgresConnection)
+		if err != nil {
+			return nil, err
+		}
+		return postgresSource{db}, nil
+	case kind == "csv" && path != "":
+		probes, err := readCsvProbes(path, len(filter.ExcludedPrefixes) > 0)
+		if err != nil {
+			return nil, err
+		}
+		return newMemorySource(probes), nil
+	case kind == "sqlite" && path != "":
+		probes, err := readSqliteProbes(path)
+		if err != nil {
+			return nil, err
+		}
+		return newMemorySource(probes), nil
+	default:
+		return nil, fmt.Errorf("Invalid probe source: %s", spec)
+	}
+}
+
+// probeSourceIdentity describes the probes that openProbeSource would read
+// for spec, so we can tell when cached intervals came from different probes:
+// the database for postgres (but not its password), or the absolute path,
+// size and modification time of a dump.
+func probeSourceIdentity(spec string) (string, error) {
+	kind, path := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		kind, path = spec[:idx], spec[idx+1:]
+	}
+	switch {
+	case kind == "postgres" && path == "":
+		identity, err := postgres.Identity(postgresConnection, os.Getenv)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("postgres %s", identity), nil
+	case (kind == "csv" || kind == "sqlite") && path != "":
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(absolute)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s:%s (%d bytes, modified %s)", kind, absolute, info.Size(), info.ModTime().UTC().Format(time.RFC3339Nano)), nil
+	default:
+		return "", fmt.Errorf("Invalid probe source: %s", spec)
+	}
+}
+
+// postgresSource queries devices_log directly, filtering in the database.
+type postgresSource struct {
+	db *sql.DB
+}
+
+func (source postgresSource) Probes(filter *probeFilter, start, end time.Time) ([]probe, error) {
+	query, parameters := filter.query()
+	rows, err := source.db.Query(query, append([]interface{}{start, end}, parameters...)...)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying devices_log table: %s", err)
+	}
+	defer rows.Close()
+
+	var probes []probe
+	for rows.Next() {
+		var p probe
+		if err := rows.Scan(&p.DateSeen, &p.NodeId); err != nil {
+			return nil, fmt.Errorf("Error iterating through devices_log table: %s", err)
+		}
+		probes = append(probes, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through devices_log table: %s", err)
+	}
+	return probes, nil
+}
+
+func (source postgresSource) Close() error {
+	return source.db.Close()
+}
+
+// memorySource holds a whole dump of devices_log in memory, sorted by time,
+// so dumps needn't be in any particular order.
+type memorySource struct {
+	probes []probe
+}
+
+func newMemorySource(probes []probe) *memorySource {
+	sort.SliceStable(probes, func(i, j int) bool { return probes[i].DateSeen.Before(probes[j].DateSeen) })
+	return &memorySource{probes}
+}
+
+func (source *memorySource) Probes(filter *probeFilter, start, end time.Time) ([]probe, error) {
+	matches, err := filter.matcher()
+	if err != nil {
+		return nil, err
+	}
+	first := sort.Search(len(source.probes), func(idx int) bool { return !source.probes[idx].DateSeen.Before(start) })
+	var probes []probe
+	for _, p := range source.probes[first:] {
+		if !p.DateSeen.Before(end) {
+			break
+		}
+		if matches(p) {
+			probes = append(probes, p)
+		}
+	}
+	return probes, nil
+}
+
+func (source *memorySource) Close() error {
+	return nil
+}
+
+// readCsvProbes reads a CSV dump of devices_log with a header row naming at
+// least the id and date_seen columns, like the output of
+//
+//	\copy devices_log TO 'probes.csv' WITH CSV HEADER
+//
+// Files ending in .gz are decompressed. If needIps is set then the dump must
+// also have the ip column.
+func readCsvProbes(filename string, needIps bool) ([]probe, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	var reader io.Reader = handle
+	if strings.HasSuffix(filename, ".gz") {
+		gzipReader, err := gzip.NewReader(handle)
+		if err != nil {
+			return nil, fmt.Errorf("Error decompressing %s: %s", filename, err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	csvReader := csv.NewReader(reader)
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading header of %s: %s", filename, err)
+	}
+	columns := map[string]int{"ip": -1}
+	for idx, name := range header {
+		columns[name] = idx
+	}
+	for _, name := range []string{"id", "date_seen"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%s has no %s column", filename, name)
+		}
+	}
+	if needIps && columns["ip"] < 0 {
+		return nil, fmt.Errorf("%s has no ip column, so we can't exclude prefixes", filename)
+	}
+
+	var probes []probe
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", filename, err)
+		}
+		p := probe{NodeId: record[columns["id"]]}
+		if columns["ip"] >= 0 {
+			p.Ip = record[columns["ip"]]
+		}
+		if p.DateSeen, err = postgres.ParseTimestamp(record[columns["date_seen"]]); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", filename, err)
+		}
+		probes = append(probes, p)
+	}
+	return probes, nil
+}
+
+// readSqliteProbes reads the devices_log table (with the id, ip and date_seen
+// columns) from a SQLite database.
+func readSqliteProbes(filename string) ([]probe, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening SQLite database: %s", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, ip, CAST(date_seen AS TEXT) FROM devices_log")
+	if err != nil {
+		return nil, fmt.Errorf("Error querying devices_log table: %s", err)
+	}
+	defer rows.Close()
+
+	var probes []probe
+	for rows.Next() {
+		var p probe
+		var ip sql.NullString
+		var dateSeen string
+		if err := rows.Scan(&p.NodeId, &ip, &dateSeen); err != nil {
+			return nil, fmt.Errorf("Error iterating through devices_log table: %s", err)
+		}
+		p.Ip = ip.String
+		if p.DateSeen, err = postgres.ParseTimestamp(dateSeen); err != nil {
+			return nil, err
+		}
+		probes = append(probes, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through devices_log table: %s", err)
+	}
+	return probes, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const exampleCsvDump = `date_seen,ip,id
+2013-07-01 12:00:00.5-04,143.215.1.1,OW0000000001
+2013-07-01 11:00:00,10.0.0.1,OW0000000001
+2013-07-02 00:00:00+00,10.0.0.1,OW0000000001
+2013-07-01 23:59:59.999999,10.0.0.2/32,OW0000000002
+2013-06-30 23:59:59,10.0.0.2,OW0000000002
+`
+
+func formatProbes(probes []probe) []string {
+	var formatted []string
+	for _, p := range probes {
+		formatted = append(formatted, fmt.Sprintf("%s %s %s", p.NodeId, p.Ip, p.DateSeen.UTC().Format("2006-01-02 15:04:05.999999")))
+	}
+	return formatted
+}
+
+func checkSourceProbes(t *testing.T, spec string) {
+	source, err := openProbeSource(spec, &probeFilter{ExcludedPrefixes: gatechPrefixes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	day := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	for _, testCase := range []struct {
+		filter probeFilter
+		want   []string
+	}{
+		{
+			want: []string{
+				"OW0000000001 10.0.0.1 2013-07-01 11:00:00",
+				"OW0000000001 143.215.1.1 2013-07-01 16:00:00.5",
+				"OW0000000002 10.0.0.2/32 2013-07-01 23:59:59.999999",
+			},
+		},
+		{
+			filter: probeFilter{ExcludedPrefixes: gatechPrefixes, RestrictNodes: true, IncludedNodes: []string{"OW0000000001"}},
+			want:   []string{"OW0000000001 10.0.0.1 2013-07-01 11:00:00"},
+		},
+	} {
+		probes, err := source.Probes(&testCase.filter, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatProbes(probes); !reflect.DeepEqual(got, testCase.want) {
+			t.Errorf("%s: got %q, want %q", spec, got, testCase.want)
+		}
+	}
+}
+
+func TestCsvSource(t *testing.T) {
+	directory, err := ioutil.TempDir("", "availability-sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	filename := filepath.Join(directory, "probes.csv")
+	if err := ioutil.WriteFile(filename, []byte(exampleCsvDump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkSourceProbes(t, "csv:"+filename)
+
+	handle, err := os.Create(filename + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := gzip.NewWriter(handle)
+	writer.Write([]byte(exampleCsvDump))
+	writer.Close()
+	handle.Close()
+	checkSourceProbes(t, "csv:"+filename+".gz")
+
+	if err := ioutil.WriteFile(filename, []byte("node,date_seen\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openProbeSource("csv:"+filename, &probeFilter{}); err == nil {
+		t.Errorf("Read a dump without an id column")
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("id,date_seen\nOW0000000001,2013-07-01 11:00:00\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openProbeSource("csv:"+filename, &probeFilter{}); err != nil {
+		t.Errorf("Couldn't read a dump without an ip column: %s", err)
+	}
+	if _, err := openProbeSource("csv:"+filename, &probeFilter{ExcludedPrefixes: gatechPrefixes}); err == nil {
+		t.Errorf("Excluded prefixes from a dump without an ip column")
+	}
+}
+
+func TestSqliteSource(t *testing.T) {
+	directory, err := ioutil.TempDir("", "availability-sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	filename := filepath.Join(directory, "probes.sqlite")
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{
+		"CREATE TABLE devices_log (id TEXT, ip TEXT, date_seen TEXT)",
+		"INSERT INTO devices_log VALUES ('OW0000000001', '143.215.1.1', '2013-07-01 12:00:00.5-04')",
+		"INSERT INTO devices_log VALUES ('OW0000000001', '10.0.0.1', '2013-07-01T11:00:00Z')",
+		"INSERT INTO devices_log VALUES ('OW0000000001', NULL, '2013-07-02 00:00:00')",
+		"INSERT INTO devices_log VALUES ('OW0000000002', '10.0.0.2/32', '2013-07-01 23:59:59.999999')",
+		"INSERT INTO devices_log VALUES ('OW0000000002', '10.0.0.2', '2013-06-30 23:59:59')",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	checkSourceProbes(t, "sqlite:"+filename)
+}
+
+func TestOpenProbeSource(t *testing.T) {
+	for _, spec := range []string{"postgres:foo", "csv:", "sqlite", "mysql"} {
+		if _, err := openProbeSource(spec, &probeFilter{}); err == nil {
+			t.Errorf("Opened %q", spec)
+		}
+	}
+}
+
+func TestProbeSourceIdentity(t *testing.T) {
+	directory, err := ioutil.TempDir("", "availability-sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	postgresConnection = "dbname=bismark_mgmt host=db1 password=secret"
+	identity, err := probeSourceIdentity("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(identity, `postgres dbname="bismark_mgmt" host="db1"`) || strings.Contains(identity, "secret") {
+		t.Errorf("Got postgres identity %q", identity)
+	}
+	postgresConnection = "dbname=bismark_mgmt host=db2 password=secret"
+	if other, _ := probeSourceIdentity("postgres"); other == identity {
+		t.Errorf("Different databases have the same identity %q", identity)
+	}
+
+	filename := filepath.Join(directory, "probes.csv")
+	if err := ioutil.WriteFile(filename, []byte(exampleCsvDump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	identity, err = probeSourceIdentity("csv:" + filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2013, 7, 3, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := probeSourceIdentity("csv:" + filename); other == identity {
+		t.Errorf("Identity %q didn't change with the modification time", identity)
+	}
+	identity, _ = probeSourceIdentity("csv:" + filename)
+	if err := ioutil.WriteFile(filename, []byte(exampleCsvDump+"2013-07-02 00:00:01,10.0.0.1,OW0000000001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := probeSourceIdentity("csv:" + filename); other == identity {
+		t.Errorf("Identity %q didn't change with the size", identity)
+	}
+
+	for _, spec := range []string{"csv:" + filepath.Join(directory, "missing.csv"), "postgres:foo", "mysql"} {
+		if _, err := probeSourceIdentity(spec); err == nil {
+			t.Errorf("Got an identity for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sburnett/bismark-tools/common/registry"
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer/store"
+)
+
+// reliabilityStats summarize availability over one period, either for a
+// single node or summed over a group of nodes.
+type reliabilityStats struct {
+	Nodes int64
+	// Observed is how long we expected to hear from the nodes: from the
+	// start of the period, or the first time we heard from a node if that
+	// was later, until the end of the period or the end of our data.
+	Observed      time.Duration
+	Available     time.Duration
+	Outages       int64
+	Downtime      time.Duration
+	LongestOutage time.Duration
+}
+
+// AvailabilityBasisPoints is the fraction of the observed time that nodes
+// were available, in hundredths of a percent. We divide seconds because
+// multiplying nanoseconds by 10000 overflows after about 10 days.
+func (s reliabilityStats) AvailabilityBasisPoints() int64 {
+	if s.Observed <= 0 {
+		return 0
+	}
+	return int64(s.Available.Seconds() * 10000 / s.Observed.Seconds())
+}
+
+// Mtbf is the mean time between failures, or 0 if there were no outages.
+func (s reliabilityStats) Mtbf() time.Duration {
+	if s.Outages == 0 {
+		return 0
+	}
+	return s.Available / time.Duration(s.Outages)
+}
+
+// Mttr is the mean time to recovery, or 0 if there were no outages.
+func (s reliabilityStats) Mttr() time.Duration {
+	if s.Outages == 0 {
+		return 0
+	}
+	return s.Downtime / time.Duration(s.Outages)
+}
+
+func (s *reliabilityStats) add(other reliabilityStats) {
+	s.Nodes += other.Nodes
+	s.Observed += other.Observed
+	s.Available += other.Available
+	s.Outages += other.Outages
+	s.Downtime += other.Downtime
+	if other.LongestOutage > s.LongestOutage {
+		s.LongestOutage = other.LongestOutage
+	}
+}
+
+// A timeWindow is the half open range [Start, End).
+type timeWindow struct {
+	Start, End time.Time
+}
+
+// overlap returns how much of [start, end) lies within the window.
+func (w timeWindow) overlap(start, end time.Time) time.Duration {
+	if start.Before(w.Start) {
+		start = w.Start
+	}
+	if end.After(w.End) {
+		end = w.End
+	}
+	if !start.Before(end) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// subtractWindows returns the parts of window not covered by excluded, which
+// must be sorted by start time.
+func subtractWindows(window timeWindow, excluded []timeWindow) []timeWindow {
+	var remaining []timeWindow
+	current := window.Start
+	for _, exclusion := range excluded {
+		if !exclusion.End.After(current) {
+			continue
+		}
+		if !exclusion.Start.Before(window.End) {
+			break
+		}
+		if exclusion.Start.After(current) {
+			remaining = append(remaining, timeWindow{current, exclusion.Start})
+		}
+		current = exclusion.End
+	}
+	if current.Before(window.End) {
+		remaining = append(remaining, timeWindow{current, window.End})
+	}
+	return remaining
+}
+
+func totalOverlap(windows []timeWindow, start, end time.Time) time.Duration {
+	var total time.Duration
+	for _, window := range windows {
+		total += window.overlap(start, end)
+	}
+	return total
+}
+
+// nodeStats computes a node's stats for [periodStart, periodEnd) from its
+// coalesced intervals, ignoring the excluded windows. Gaps between intervals
+// are outages, as is the time after the last interval if it exceeds the
+// outage threshold. We count outages that span several periods once in each.
+func nodeStats(intervals []availabilityInterval, excluded []timeWindow, periodStart, periodEnd, dataEnd time.Time) reliabilityStats {
+	var stats reliabilityStats
+	if len(intervals) == 0 {
+		return stats
+	}
+	window := timeWindow{periodStart, periodEnd}
+	if intervals[0].StartTime.After(window.Start) {
+		window.Start = *intervals[0].StartTime
+	}
+	if dataEnd.Before(window.End) {
+		window.End = dataEnd
+	}
+	if !window.Start.Before(window.End) {
+		return stats
+	}
+	windows := subtractWindows(window, excluded)
+	if len(windows) == 0 {
+		return stats
+	}
+	stats.Nodes = 1
+	stats.Observed = totalOverlap(windows, window.Start, window.End)
+
+	outage := func(start, end time.Time) {
+		duration := totalOverlap(windows, start, end)
+		if duration <= 0 {
+			return
+		}
+		stats.Outages++
+		stats.Downtime += duration
+		if duration > stats.LongestOutage {
+			stats.LongestOutage = duration
+		}
+	}
+	for idx, interval := range intervals {
+		stats.Available += totalOverlap(windows, *interval.StartTime, *interval.EndTime)
+		if idx > 0 {
+			outage(*intervals[idx-1].EndTime, *interval.StartTime)
+		}
+	}
+	if lastEnd := *intervals[len(intervals)-1].EndTime; dataEnd.Sub(lastEnd) > outageThreshold {
+		outage(lastEnd, dataEnd)
+	}
+	return stats
+}
+
+// periodStart returns the start of the calendar period containing t. Weeks
+// start on Monday.
+func periodStart(period string, t time.Time) (time.Time, error) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "day":
+		return day, nil
+	case "week":
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)), nil
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid period %q; must be day, week or month", period)
+}
+
+func nextPeriod(period string, start time.Time) time.Time {
+	switch period {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// periodStarts returns the start of each calendar period overlapping
+// [minDate, maxDate).
+func periodStarts(period string, minDate, maxDate time.Time) ([]time.Time, error) {
+	start, err := periodStart(period, minDate)
+	if err != nil {
+		return nil, err
+	}
+	var starts []time.Time
+	for ; start.Before(maxDate); start = nextPeriod(period, start) {
+		starts = append(starts, start)
+	}
+	return starts, nil
+}
+
+// reliabilityReport holds stats for each node, country and the whole fleet,
+// keyed by the start of each period.
+type reliabilityReport struct {
+	byNode    map[string]map[time.Time]reliabilityStats
+	byCountry map[string]map[time.Time]reliabilityStats
+	fleet     map[time.Time]reliabilityStats
+}
+
+// lastProbe returns the end of the latest interval of any node, which is the
+// end of our data. Nodes that were up then weren't in an outage.
+func lastProbe(allIntervals map[string][]availabilityInterval) time.Time {
+	var last time.Time
+	for _, intervals := range allIntervals {
+		if len(intervals) > 0 && intervals[len(intervals)-1].EndTime.After(last) {
+			last = *intervals[len(intervals)-1].EndTime
+		}
+	}
+	return last
+}
+
+// computeReliability computes stats for every period overlapping [minDate,
+// maxDate), observing nodes until dataEnd. countries maps node ids to
+// country codes; nodes we can't find there roll up into "??". excluded maps
+// node ids to sorted windows to leave out of their stats.
+func computeReliability(allIntervals map[string][]availabilityInterval, countries map[string]string, excluded map[string][]timeWindow, period string, minDate, maxDate, dataEnd time.Time) (*reliabilityReport, error) {
+	starts, err := periodStarts(period, minDate, maxDate)
+	if err != nil {
+		return nil, err
+	}
+	report := &reliabilityReport{
+		byNode:    make(map[string]map[time.Time]reliabilityStats),
+		byCountry: make(map[string]map[time.Time]reliabilityStats),
+		fleet:     make(map[time.Time]reliabilityStats),
+	}
+	for nodeId, intervals := range allIntervals {
+		country := nodeCountry(countries, nodeId)
+		for _, start := range starts {
+			stats := nodeStats(intervals, excluded[nodeId], start, nextPeriod(period, start), dataEnd)
+			if stats.Nodes == 0 {
+				continue
+			}
+			if report.byNode[nodeId] == nil {
+				report.byNode[nodeId] = make(map[time.Time]reliabilityStats)
+			}
+			report.byNode[nodeId][start] = stats
+			if report.byCountry[country] == nil {
+				report.byCountry[country] = make(map[time.Time]reliabilityStats)
+			}
+			countryStats := report.byCountry[country][start]
+			countryStats.add(stats)
+			report.byCountry[country][start] = countryStats
+			fleetStats := report.fleet[start]
+			fleetStats.add(stats)
+			report.fleet[start] = fleetStats
+		}
+	}
+	return report, nil
+}
+
+func sortedKeys(m map[string]map[time.Time]reliabilityStats) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPeriods(m map[time.Time]reliabilityStats) []time.Time {
+	var periods []time.Time
+	for period := range m {
+		periods = append(periods, period)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].Before(periods[j]) })
+	return periods
+}
+
+var reliabilityValueNames = []string{"nodes", "observed_seconds", "available_seconds", "availability_basis_points", "outages", "mtbf_seconds", "mttr_seconds", "longest_outage_seconds"}
+
+func (s reliabilityStats) encodeValue() []byte {
+	return lex.EncodeOrDie(s.Nodes, int64(s.Observed.Seconds()), int64(s.Available.Seconds()), s.AvailabilityBasisPoints(), s.Outages, int64(s.Mtbf().Seconds()), int64(s.Mttr().Seconds()), int64(s.LongestOutage.Seconds()))
+}
+
+// writeGroupedStats writes stats keyed by a group (a node or a country) and
+// the start of each period, as a Unix timestamp.
+func writeGroupedStats(writer store.Writer, stats map[string]map[time.Time]reliabilityStats) error {
+	if err := writer.BeginWriting(); err != nil {
+		return err
+	}
+	for _, group := range sortedKeys(stats) {
+		for _, period := range sortedPeriods(stats[group]) {
+			record := store.Record{
+				Key:   lex.EncodeOrDie(group, period.Unix()),
+				Value: stats[group][period].encodeValue(),
+			}
+			if err := writer.WriteRecord(&record); err != nil {
+				return err
+			}
+		}
+	}
+	return writer.EndWriting()
+}
+
+func writeFleetStats(writer store.Writer, stats map[time.Time]reliabilityStats) error {
+	if err := writer.BeginWriting(); err != nil {
+		return err
+	}
+	for _, period := range sortedPeriods(stats) {
+		record := store.Record{
+			Key:   lex.EncodeOrDie(period.Unix()),
+			Value: stats[period].encodeValue(),
+		}
+		if err := writer.WriteRecord(&record); err != nil {
+			return err
+		}
+	}
+	return writer.EndWriting()
+}
+
+// writeReliability writes node, country and fleet stats to the manager, in
+// tables named node-stats, country-stats and fleet-stats followed by suffix.
+func writeReliability(report *reliabilityReport, manager store.Manager, suffix string) error {
+	var node, country string
+	var period, nodes, observed, available, availability, outages, mtbf, mttr, longest int64
+	values := []interface{}{&nodes, &observed, &available, &availability, &outages, &mtbf, &mttr, &longest}
+
+	nodeWriter := manager.Writer(append([]interface{}{"node-stats" + suffix, []string{"node", "period"}, reliabilityValueNames, &node, &period}, values...)...)
+	if err := writeGroupedStats(nodeWriter, report.byNode); err != nil {
+		return fmt.Errorf("Error writing node stats: %s", err)
+	}
+	countryWriter := manager.Writer(append([]interface{}{"country-stats" + suffix, []string{"country", "period"}, reliabilityValueNames, &country, &period}, values...)...)
+	if err := writeGroupedStats(countryWriter, report.byCountry); err != nil {
+		return fmt.Errorf("Error writing country stats: %s", err)
+	}
+	fleetWriter := manager.Writer(append([]interface{}{"fleet-stats" + suffix, []string{"period"}, reliabilityValueNames, &period}, values...)...)
+	if err := writeFleetStats(fleetWriter, report.fleet); err != nil {
+		return fmt.Errorf("Error writing fleet stats: %s", err)
+	}
+	return nil
+}
+
+func nodeCountry(countries map[string]string, nodeId string) string {
+	if country := countries[nodeId]; country != "" {
+		return country
+	}
+	return "??"
+}
+
+// nodeCountries reads the country of each node from registry:PATH, the
+// country attribute of each node in a registry, or csv:PATH, a file with a
+// header row naming the node_id (or id) and country columns. If spec is
+// empty we don't know any countries.
+func nodeCountries(spec string) (map[string]string, error) {
+	countries := make(map[string]string)
+	kind, path := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		kind, path = spec[:idx], spec[idx+1:]
+	}
+	switch {
+	case spec == "":
+		return countries, nil
+	case kind == "registry" && path != "":
+		nodeRegistry, err := registry.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, nodeId := range nodeRegistry.Ids() {
+			if country := nodeRegistry.Lookup(nodeId).Attribute("country"); country != "" {
+				countries[nodeId] = strings.ToUpper(country)
+			}
+		}
+		return countries, nil
+	case kind == "csv" && path != "":
+		return readCsvCountries(path)
+	default:
+		return nil, fmt.Errorf("Invalid --countries_from: %s", spec)
+	}
+}
+
+func readCsvCountries(filename string) (map[string]string, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	records, err := csv.NewReader(handle).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", filename, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s has no header row", filename)
+	}
+	idColumn, countryColumn := -1, -1
+	for idx, name := range records[0] {
+		switch name {
+		case "node_id", "id":
+			idColumn = idx
+		case "country":
+			countryColumn = idx
+		}
+	}
+	if idColumn < 0 || countryColumn < 0 {
+		return nil, fmt.Errorf("%s needs node_id and country columns", filename)
+	}
+
+	countries := make(map[string]string)
+	for _, record := range records[1:] {
+		countries[record[idColumn]] = record[countryColumn]
+	}
+	return countries, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func exampleTime(hours int) *time.Time {
+	t := time.Date(2013, 6, 30, 0, 0, 0, 0, time.UTC).Add(time.Duration(hours) * time.Hour)
+	return &t
+}
+
+func printStats(label string, stats reliabilityStats) {
+	fmt.Printf("%s: nodes=%d observed=%s available=%s availability=%d outages=%d mtbf=%s mttr=%s longest=%s\n", label, stats.Nodes, stats.Observed, stats.Available, stats.AvailabilityBasisPoints(), stats.Outages, stats.Mtbf(), stats.Mttr(), stats.LongestOutage)
+}
+
+func Example_computeReliability() {
+	outageThreshold = 5 * time.Minute
+	allIntervals := map[string][]availabilityInterval{
+		// Up until 20:00 on June 30th, down across midnight until 4:00 on
+		// July 1st, then up until noon, then down until the end of our data.
+		"OW0000000001": {
+			{exampleTime(0), exampleTime(20)},
+			{exampleTime(28), exampleTime(36)},
+		},
+		// First heard from at noon on July 1st and never went down.
+		"OW0000000002": {
+			{exampleTime(36), exampleTime(48)},
+		},
+		"OW0000000003": {
+			{exampleTime(12), exampleTime(18)},
+			{exampleTime(19), exampleTime(24)},
+		},
+	}
+	countries := map[string]string{"OW0000000001": "US", "OW0000000002": "US"}
+	report, err := computeReliability(allIntervals, countries, nil, "day", exampleTime(0).Add(time.Minute), *exampleTime(48), *exampleTime(48))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, node := range sortedKeys(report.byNode) {
+		for _, period := range sortedPeriods(report.byNode[node]) {
+			printStats(fmt.Sprintf("%s %s", node, period.Format("2006-01-02")), report.byNode[node][period])
+		}
+	}
+	for _, country := range sortedKeys(report.byCountry) {
+		for _, period := range sortedPeriods(report.byCountry[country]) {
+			printStats(fmt.Sprintf("%s %s", country, period.Format("2006-01-02")), report.byCountry[country][period])
+		}
+	}
+	for _, period := range sortedPeriods(report.fleet) {
+		printStats(period.Format("2006-01-02"), report.fleet[period])
+	}
+
+	_, err = computeReliability(allIntervals, countries, nil, "year", *exampleTime(0), *exampleTime(48), *exampleTime(48))
+	fmt.Println(err)
+
+	// Output:
+	// OW0000000001 2013-06-30: nodes=1 observed=24h0m0s available=20h0m0s availability=8333 outages=1 mtbf=20h0m0s mttr=4h0m0s longest=4h0m0s
+	// OW0000000001 2013-07-01: nodes=1 observed=24h0m0s available=8h0m0s availability=3333 outages=2 mtbf=4h0m0s mttr=8h0m0s longest=12h0m0s
+	// OW0000000002 2013-07-01: nodes=1 observed=12h0m0s available=12h0m0s availability=10000 outages=0 mtbf=0s mttr=0s longest=0s
+	// OW0000000003 2013-06-30: nodes=1 observed=12h0m0s available=11h0m0s availability=9166 outages=1 mtbf=11h0m0s mttr=1h0m0s longest=1h0m0s
+	// OW0000000003 2013-07-01: nodes=1 observed=24h0m0s available=0s availability=0 outages=1 mtbf=0s mttr=24h0m0s longest=24h0m0s
+	// ?? 2013-06-30: nodes=1 observed=12h0m0s available=11h0m0s availability=9166 outages=1 mtbf=11h0m0s mttr=1h0m0s longest=1h0m0s
+	// ?? 2013-07-01: nodes=1 observed=24h0m0s available=0s availability=0 outages=1 mtbf=0s mttr=24h0m0s longest=24h0m0s
+	// US 2013-06-30: nodes=1 observed=24h0m0s available=20h0m0s availability=8333 outages=1 mtbf=20h0m0s mttr=4h0m0s longest=4h0m0s
+	// US 2013-07-01: nodes=2 observed=36h0m0s available=20h0m0s availability=5555 outages=2 mtbf=10h0m0s mttr=8h0m0s longest=12h0m0s
+	// 2013-06-30: nodes=2 observed=36h0m0s available=31h0m0s availability=8611 outages=2 mtbf=15h30m0s mttr=2h30m0s longest=4h0m0s
+	// 2013-07-01: nodes=3 observed=60h0m0s available=20h0m0s availability=3333 outages=3 mtbf=6h40m0s mttr=13h20m0s longest=24h0m0s
+	// Invalid period "year"; must be day, week or month
+	//
+}
+
+func Example_computeReliability_month() {
+	outageThreshold = 5 * time.Minute
+	at := func(day, hour int) *time.Time {
+		t := time.Date(2013, 7, day, hour, 0, 0, 0, time.UTC)
+		return &t
+	}
+	allIntervals := map[string][]availabilityInterval{
+		// Down for 12 hours on July 10th.
+		"OW0000000001": {
+			{at(1, 0), at(10, 6)},
+			{at(10, 18), at(32, 0)},
+		},
+		"OW0000000002": {
+			{at(1, 0), at(32, 0)},
+		},
+		"OW0000000003": {
+			{at(1, 0), at(32, 0)},
+		},
+	}
+	countries := map[string]string{"OW0000000001": "US", "OW0000000002": "US", "OW0000000003": "GB"}
+	report, err := computeReliability(allIntervals, countries, nil, "month", *at(1, 0), *at(32, 0), *at(32, 0))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	july := *at(1, 0)
+	printStats("OW0000000001", report.byNode["OW0000000001"][july])
+	printStats("US", report.byCountry["US"][july])
+	printStats("fleet", report.fleet[july])
+
+	// Output:
+	// OW0000000001: nodes=1 observed=744h0m0s available=732h0m0s availability=9838 outages=1 mtbf=732h0m0s mttr=12h0m0s longest=12h0m0s
+	// US: nodes=2 observed=1488h0m0s available=1476h0m0s availability=9919 outages=1 mtbf=1476h0m0s mttr=12h0m0s longest=12h0m0s
+	// fleet: nodes=3 observed=2232h0m0s available=2220h0m0s availability=9946 outages=1 mtbf=2220h0m0s mttr=12h0m0s longest=12h0m0s
+	//
+}
+
+func Example_computeReliability_dataEnd() {
+	outageThreshold = 5 * time.Minute
+	// Both nodes were up when we last heard from them at noon on July
+	// 1st, so they weren't in an outage even though we compute stats
+	// through midnight.
+	allIntervals := map[string][]availabilityInterval{
+		"OW0000000001": {
+			{exampleTime(0), exampleTime(36)},
+		},
+		"OW0000000002": {
+			{exampleTime(0), exampleTime(20)},
+			{exampleTime(28), exampleTime(36)},
+		},
+	}
+	dataEnd := lastProbe(allIntervals)
+	fmt.Println("data ends", dataEnd.Format(time.RFC3339))
+	report, err := computeReliability(allIntervals, nil, nil, "day", *exampleTime(0), *exampleTime(48), dataEnd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	july := *exampleTime(24)
+	printStats("OW0000000001", report.byNode["OW0000000001"][july])
+	printStats("OW0000000002", report.byNode["OW0000000002"][july])
+	printStats("fleet", report.fleet[july])
+
+	// Output:
+	// data ends 2013-07-01T12:00:00Z
+	// OW0000000001: nodes=1 observed=12h0m0s available=12h0m0s availability=10000 outages=0 mtbf=0s mttr=0s longest=0s
+	// OW0000000002: nodes=1 observed=12h0m0s available=8h0m0s availability=6666 outages=1 mtbf=8h0m0s mttr=4h0m0s longest=4h0m0s
+	// fleet: nodes=2 observed=24h0m0s available=20h0m0s availability=8333 outages=1 mtbf=20h0m0s mttr=4h0m0s longest=4h0m0s
+	//
+}
+
+func Example_periodStarts() {
+	// July 1st, 2013 was a Monday.
+	minDate := time.Date(2013, 6, 29, 0, 0, 0, 0, time.UTC)
+	maxDate := time.Date(2013, 7, 9, 0, 0, 0, 0, time.UTC)
+	for _, period := range []string{"week", "month"} {
+		starts, _ := periodStarts(period, minDate, maxDate)
+		for _, start := range starts {
+			fmt.Println(period, start.Format("2006-01-02 Mon"))
+		}
+	}
+
+	// Output:
+	// week 2013-06-24 Mon
+	// week 2013-07-01 Mon
+	// week 2013-07-08 Mon
+	// month 2013-06-01 Sat
+	// month 2013-07-01 Mon
+	//
+}
+
+func TestNodeCountries(t *testing.T) {
+	directory, err := ioutil.TempDir("", "availability-countries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	files := map[string]string{
+		"devices.csv":  "node_id,ip_address,country\nOW0000000001,1.1.1.1,US\nOW0000000002,81.2.3.4,GB\n",
+		"registry.csv": "id,tags,country\now0000000001,,us\nOW0000000003,,\n",
+		"bad.csv":      "node_id,ip_address\nOW0000000001,1.1.1.1\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, testCase := range []struct {
+		spec string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"csv:" + filepath.Join(directory, "devices.csv"), map[string]string{"OW0000000001": "US", "OW0000000002": "GB"}},
+		{"registry:" + filepath.Join(directory, "registry.csv"), map[string]string{"OW0000000001": "US"}},
+	} {
+		got, err := nodeCountries(testCase.spec)
+		if err != nil {
+			t.Errorf("%s: %s", testCase.spec, err)
+		} else if !reflect.DeepEqual(got, testCase.want) {
+			t.Errorf("%s: got %v, want %v", testCase.spec, got, testCase.want)
+		}
+	}
+	for _, spec := range []string{"csv:" + filepath.Join(directory, "bad.csv"), "csv:", "postgres"} {
+		if _, err := nodeCountries(spec); err == nil {
+			t.Errorf("Read countries from %q", spec)
+		}
+	}
+}
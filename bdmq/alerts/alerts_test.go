@@ -0,0 +1,108 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+func ExampleParseRules() {
+	rules, err := ParseRules(strings.NewReader(`
+# Alert when the Georgia Tech router is gone for a while.
+gatech: node OW0000000001 offline > 6h
+kenya: country ke offline > 20%
+old-firmware: version 1.0 online = 0
+`), "rules.txt")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, rule := range rules {
+		fmt.Println(rule)
+	}
+
+	// Output:
+	//
+	// gatech: node OW0000000001 offline > 6h0m0s
+	// kenya: country KE offline > 20%
+	// old-firmware: version 1.0 online = 0
+}
+
+func ExampleParseRules_errors() {
+	for _, text := range []string{
+		"no rule name",
+		"bad-scope: city Atlanta offline > 1",
+		"bad-operator: country US offline ~ 1",
+		"bad-threshold: country US offline > lots",
+		"bad-duration: node OW0000000001 offline > 2 days",
+		"online-node: node OW0000000001 online > 6h",
+		"dup: country US offline > 1\ndup: country KE offline > 1",
+	} {
+		_, err := ParseRules(strings.NewReader(text), "rules.txt")
+		fmt.Println(err)
+	}
+
+	// Output:
+	//
+	// rules.txt:1: Missing rule name
+	// rules.txt:1: Invalid scope: city
+	// rules.txt:1: Invalid operator: ~
+	// rules.txt:1: Invalid threshold: lots
+	// rules.txt:1: Expected <scope> <key> <online|offline> <op> <threshold>
+	// rules.txt:1: Node rules must use offline
+	// rules.txt:2: Duplicate rule name: dup
+}
+
+// newTestDatastore returns a fleet of three routers. OW0000000001 goes
+// offline at midnight and comes back at 10am.
+func newTestDatastore(now time.Time) datastore.Datastore {
+	start := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	lastSeen := start
+	if now.Sub(start) >= 10*time.Hour {
+		lastSeen = now
+	}
+	return datastore.NewMemoryDatastore([]datastore.DevicesResult{
+		{NodeId: "OW0000000001", CountryCode: "US", Version: "1.0", LastSeen: lastSeen},
+		{NodeId: "OW0000000002", CountryCode: "KE", Version: "1.1", LastSeen: start.Add(2 * time.Hour)},
+		{NodeId: "OW0000000003", CountryCode: "KE", Version: "1.1", LastSeen: start.Add(24 * time.Hour)},
+	}, nil, now, nil)
+}
+
+func ExampleEvaluate() {
+	rules, err := ParseRules(strings.NewReader(`
+router: node OW0000000001 offline > 6h
+kenya: country KE offline > 50%
+old-firmware: version 1.0 online = 0
+`), "rules.txt")
+	if err != nil {
+		panic(err)
+	}
+	state := NewState()
+	for _, hours := range []int{0, 1, 8, 12, 25} {
+		now := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(hours) * time.Hour)
+		notifications, err := Evaluate(context.Background(), newTestDatastore(now), rules, state, now)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("After %d hours: %d firing\n", hours, len(state.Firing))
+		for _, n := range notifications {
+			fmt.Println(n)
+		}
+	}
+
+	// Output:
+	//
+	// After 0 hours: 0 firing
+	// After 1 hours: 1 firing
+	// [firing] old-firmware: 0 of 1 devices (0%) with version 1.0 are online
+	// After 8 hours: 2 firing
+	// [firing] router: OW0000000001 is down and last probed 8h0m0s ago
+	// After 12 hours: 0 firing
+	// [resolved] router: OW0000000001 is up and last probed 0s ago
+	// [resolved] old-firmware: 1 of 1 devices (100%) with version 1.0 are online
+	// After 25 hours: 1 firing
+	// [firing] kenya: 2 of 2 devices (100%) with country KE are offline
+}
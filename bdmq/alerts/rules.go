@@ -0,0 +1,291 @@
+package alerts
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+// A rules file has one rule per line. Blank lines and lines starting with #
+// are ignored. Each rule has a unique name and a condition:
+//
+//	<name>: node <node id> offline > <duration>
+//	<name>: country <country code> <online|offline> <op> <count>[%]
+//	<name>: version <version> <online|offline> <op> <count>[%]
+//
+// where <op> is one of =, <, <=, > or >=. For example,
+//
+//	gatech-router: node OW0123456789AB offline > 6h
+//	kenya: country KE offline > 20%
+//	old-firmware: version 1.0 online = 0
+
+type Scope int
+
+const (
+	NodeScope Scope = iota
+	CountryScope
+	VersionScope
+)
+
+func (scope Scope) String() string {
+	switch scope {
+	case NodeScope:
+		return "node"
+	case CountryScope:
+		return "country"
+	case VersionScope:
+		return "version"
+	default:
+		panic(fmt.Errorf("Missing Scope.String() case"))
+	}
+}
+
+type Rule struct {
+	Name  string
+	Scope Scope
+	// Key is the node ID, country code or version the rule applies to.
+	Key string
+	// Online is true if the rule counts online devices and false if it
+	// counts offline devices. Stale devices count as neither. Node rules
+	// always look at offline devices.
+	Online   bool
+	Operator datastore.Operator
+	// Threshold is a count of devices, or a percentage if Percent is set.
+	// Node rules use Duration instead.
+	Threshold float64
+	Percent   bool
+	Duration  time.Duration
+}
+
+func (rule *Rule) String() string {
+	metric := "offline"
+	if rule.Online {
+		metric = "online"
+	}
+	var threshold string
+	switch {
+	case rule.Scope == NodeScope:
+		threshold = rule.Duration.String()
+	case rule.Percent:
+		threshold = strconv.FormatFloat(rule.Threshold, 'f', -1, 64) + "%"
+	default:
+		threshold = strconv.FormatFloat(rule.Threshold, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%s: %s %s %s %s %s", rule.Name, rule.Scope, rule.Key, metric, rule.Operator, threshold)
+}
+
+func parseOperator(text string) (datastore.Operator, error) {
+	switch text {
+	case "=", "==":
+		return datastore.Equals, nil
+	case "<":
+		return datastore.LessThan, nil
+	case "<=":
+		return datastore.LessOrEqual, nil
+	case ">":
+		return datastore.GreaterThan, nil
+	case ">=":
+		return datastore.GreaterOrEqual, nil
+	default:
+		return datastore.Equals, fmt.Errorf("Invalid operator: %s", text)
+	}
+}
+
+func parseRule(line string) (*Rule, error) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return nil, fmt.Errorf("Missing rule name")
+	}
+	rule := Rule{Name: strings.TrimSpace(line[:colon])}
+	if rule.Name == "" {
+		return nil, fmt.Errorf("Missing rule name")
+	}
+	words := strings.Fields(line[colon+1:])
+	if len(words) != 5 {
+		return nil, fmt.Errorf("Expected <scope> <key> <online|offline> <op> <threshold>")
+	}
+
+	switch strings.ToLower(words[0]) {
+	case "node":
+		rule.Scope = NodeScope
+		rule.Key = words[1]
+	case "country":
+		rule.Scope = CountryScope
+		rule.Key = strings.ToUpper(words[1])
+	case "version":
+		rule.Scope = VersionScope
+		rule.Key = words[1]
+	default:
+		return nil, fmt.Errorf("Invalid scope: %s", words[0])
+	}
+	switch strings.ToLower(words[2]) {
+	case "online", "up":
+		rule.Online = true
+	case "offline", "down":
+		rule.Online = false
+	default:
+		return nil, fmt.Errorf("Invalid metric: %s", words[2])
+	}
+	operator, err := parseOperator(words[3])
+	if err != nil {
+		return nil, err
+	}
+	rule.Operator = operator
+
+	if rule.Scope == NodeScope {
+		if rule.Online {
+			return nil, fmt.Errorf("Node rules must use offline")
+		}
+		if rule.Duration, err = datastore.ParseDuration(words[4]); err != nil {
+			return nil, err
+		}
+		return &rule, nil
+	}
+	threshold := words[4]
+	if strings.HasSuffix(threshold, "%") {
+		rule.Percent = true
+		threshold = strings.TrimSuffix(threshold, "%")
+	}
+	if rule.Threshold, err = strconv.ParseFloat(threshold, 64); err != nil {
+		return nil, fmt.Errorf("Invalid threshold: %s", words[4])
+	}
+	return &rule, nil
+}
+
+// ParseRules parses a rules file. name is only used in error messages.
+func ParseRules(reader io.Reader, name string) ([]*Rule, error) {
+	var rules []*Rule
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, lineNumber, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("%s:%d: Duplicate rule name: %s", name, lineNumber, rule.Name)
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func ReadRules(filename string) ([]*Rule, error) {
+	handle, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	return ParseRules(handle, filename)
+}
+
+// A fleet holds everything rules are evaluated against.
+type fleet struct {
+	devices   map[string]*datastore.DevicesResult
+	countries map[string]*datastore.CountriesResult
+	versions  map[string]*datastore.VersionsResult
+}
+
+func selectFleet(ctx context.Context, db datastore.Datastore) (*fleet, error) {
+	f := fleet{
+		devices:   make(map[string]*datastore.DevicesResult),
+		countries: make(map[string]*datastore.CountriesResult),
+		versions:  make(map[string]*datastore.VersionsResult),
+	}
+	devices := db.SelectDevices(ctx, nil, nil, 0, nil)
+	defer devices.Close()
+	for devices.Next() {
+		f.devices[strings.ToUpper(devices.Result().NodeId)] = devices.Result()
+	}
+	if err := devices.Err(); err != nil {
+		return nil, err
+	}
+	countries := db.SelectCountries(ctx)
+	defer countries.Close()
+	for countries.Next() {
+		f.countries[countries.Result().Country] = countries.Result()
+	}
+	if err := countries.Err(); err != nil {
+		return nil, err
+	}
+	versions := db.SelectVersions(ctx)
+	defer versions.Close()
+	for versions.Next() {
+		f.versions[versions.Result().Version] = versions.Result()
+	}
+	if err := versions.Err(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func compare(value float64, operator datastore.Operator, threshold float64) bool {
+	switch operator {
+	case datastore.Equals:
+		return value == threshold
+	case datastore.LessThan:
+		return value < threshold
+	case datastore.LessOrEqual:
+		return value <= threshold
+	case datastore.GreaterThan:
+		return value > threshold
+	case datastore.GreaterOrEqual:
+		return value >= threshold
+	default:
+		panic(fmt.Errorf("Missing compare() case"))
+	}
+}
+
+// evaluate returns whether the rule's condition holds and a description of
+// the current situation.
+func (rule *Rule) evaluate(f *fleet) (bool, string, error) {
+	if rule.Scope == NodeScope {
+		device, ok := f.devices[strings.ToUpper(rule.Key)]
+		if !ok {
+			return false, "", fmt.Errorf("Unknown node: %s", rule.Key)
+		}
+		firing := compare(device.OutageDuration.Seconds(), rule.Operator, rule.Duration.Seconds())
+		return firing, fmt.Sprintf("%s is %s and last probed %s ago", device.NodeId, device.DeviceStatus, device.OutageDuration), nil
+	}
+
+	var total, online, offline int
+	switch rule.Scope {
+	case CountryScope:
+		if r, ok := f.countries[rule.Key]; ok {
+			total, online, offline = r.Count, r.OnlineCount, r.OfflineCount
+		}
+	case VersionScope:
+		if r, ok := f.versions[rule.Key]; ok {
+			total, online, offline = r.Count, r.OnlineCount, r.OfflineCount
+		}
+	}
+	count, metric := offline, "offline"
+	if rule.Online {
+		count, metric = online, "online"
+	}
+	var percentage float64
+	if total > 0 {
+		percentage = float64(count) / float64(total) * 100
+	}
+	value := float64(count)
+	if rule.Percent {
+		value = percentage
+	}
+	firing := compare(value, rule.Operator, rule.Threshold)
+	return firing, fmt.Sprintf("%d of %d devices (%d%%) with %s %s are %s", count, total, int(percentage), rule.Scope, rule.Key, metric), nil
+}
@@ -0,0 +1,129 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Sink delivers notifications somewhere. Send is only called with a
+// non-empty list of notifications.
+type Sink interface {
+	Send(notifications []*Notification) error
+}
+
+// Deliver sends notifications to each of sinks, which are keyed by name,
+// along with the notifications from earlier runs that the sink failed to
+// receive. It records in state which notifications each sink still needs,
+// so callers should save state even if Deliver fails. Pending notifications
+// for sinks that are no longer configured are dropped. Deliver tries every
+// sink and returns the first error.
+func Deliver(state *State, sinks map[string]Sink, notifications []*Notification) error {
+	for name := range state.Pending {
+		if _, ok := sinks[name]; !ok {
+			delete(state.Pending, name)
+		}
+	}
+	var names []string
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var firstErr error
+	for _, name := range names {
+		queue := append(state.Pending[name], notifications...)
+		if len(queue) == 0 {
+			continue
+		}
+		if err := sinks[name].Send(queue); err != nil {
+			state.Pending[name] = queue
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Error sending notifications to %s: %s", name, err)
+			}
+			continue
+		}
+		delete(state.Pending, name)
+	}
+	return firstErr
+}
+
+type writerSink struct {
+	writer io.Writer
+}
+
+// NewWriterSink writes one line per notification, e.g., to stdout.
+func NewWriterSink(writer io.Writer) Sink {
+	return &writerSink{writer}
+}
+
+func (s *writerSink) Send(notifications []*Notification) error {
+	for _, n := range notifications {
+		if _, err := fmt.Fprintf(s.writer, "%s %s\n", n.Timestamp.Format("2006-01-02 15:04:05"), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink POSTs notifications to url as a JSON array.
+func NewWebhookSink(url string) Sink {
+	return &webhookSink{url, &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *webhookSink) Send(notifications []*Notification) error {
+	body, err := json.Marshal(notifications)
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Error posting to webhook: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("Error posting to webhook: %s", response.Status)
+	}
+	return nil
+}
+
+type smtpSink struct {
+	server, from string
+	to           []string
+}
+
+// NewSmtpSink emails all notifications in a single message through server
+// (host:port), without authentication.
+func NewSmtpSink(server, from string, to []string) Sink {
+	return &smtpSink{server, from, to}
+}
+
+func (s *smtpSink) Send(notifications []*Notification) error {
+	subject := fmt.Sprintf("BISmark alerts: %s", notifications[0])
+	if len(notifications) > 1 {
+		subject = fmt.Sprintf("BISmark alerts: %d changes", len(notifications))
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", s.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "\r\n")
+	for _, n := range notifications {
+		fmt.Fprintf(&message, "%s %s\r\n", n.Timestamp.Format("2006-01-02 15:04:05"), n)
+	}
+	if err := smtp.SendMail(s.server, nil, s.from, s.to, message.Bytes()); err != nil {
+		return fmt.Errorf("Error sending mail: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package alerts
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNotifications = []*Notification{
+	{Rule: "kenya", State: Firing, Message: "2 of 2 devices (100%) with country KE are offline", Timestamp: time.Date(2013, 7, 1, 8, 0, 0, 0, time.UTC), Since: time.Date(2013, 7, 1, 8, 0, 0, 0, time.UTC)},
+	{Rule: "router", State: Resolved, Message: "OW0000000001 is up and last probed 0s ago", Timestamp: time.Date(2013, 7, 1, 8, 0, 0, 0, time.UTC), Since: time.Date(2013, 7, 1, 2, 0, 0, 0, time.UTC)},
+}
+
+func TestWebhookSink(t *testing.T) {
+	var received []*Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Error decoding request: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	if err := NewWebhookSink(server.URL).Send(testNotifications); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != len(testNotifications) {
+		t.Fatalf("Received %d notifications, want %d", len(received), len(testNotifications))
+	}
+	for idx, n := range received {
+		want := testNotifications[idx]
+		if n.Rule != want.Rule || n.State != want.State || n.Message != want.Message || !n.Timestamp.Equal(want.Timestamp) || !n.Since.Equal(want.Since) {
+			t.Errorf("Received %+v, want %+v", n, want)
+		}
+	}
+}
+
+func TestWebhookSinkError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if err := NewWebhookSink(server.URL).Send(testNotifications); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+// fakeSmtpServer accepts a single message over SMTP and sends its envelope
+// and data on the returned channel.
+func fakeSmtpServer(t *testing.T) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		var transcript []string
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "MAIL FROM"), strings.HasPrefix(command, "RCPT TO"):
+				transcript = append(transcript, strings.TrimSpace(line))
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 Go ahead")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					transcript = append(transcript, strings.TrimRight(line, "\r\n"))
+				}
+				reply("250 OK")
+			case command == "QUIT":
+				reply("221 Bye")
+				received <- transcript
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSmtpSink(t *testing.T) {
+	address, received := fakeSmtpServer(t)
+	sink := NewSmtpSink(address, "bdmq@example.com", []string{"ops@example.com", "oncall@example.com"})
+	if err := sink.Send(testNotifications); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"MAIL FROM:<bdmq@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<oncall@example.com>",
+		"From: bdmq@example.com",
+		"To: ops@example.com, oncall@example.com",
+		"Subject: BISmark alerts: 2 changes",
+		"",
+		"2013-07-01 08:00:00 [firing] kenya: 2 of 2 devices (100%) with country KE are offline",
+		"2013-07-01 08:00:00 [resolved] router: OW0000000001 is up and last probed 0s ago",
+	}
+	select {
+	case transcript := <-received:
+		if strings.Join(transcript, "\n") != strings.Join(want, "\n") {
+			t.Errorf("Received:\n%s\nWant:\n%s", strings.Join(transcript, "\n"), strings.Join(want, "\n"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
+
+// recordingSink records what it receives, or fails if err is set.
+type recordingSink struct {
+	received [][]*Notification
+	err      error
+}
+
+func (s *recordingSink) Send(notifications []*Notification) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.received = append(s.received, notifications)
+	return nil
+}
+
+func TestDeliver(t *testing.T) {
+	directory, err := ioutil.TempDir("", "bdmq-alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	filename := filepath.Join(directory, "state.json")
+
+	working, broken := &recordingSink{}, &recordingSink{err: errors.New("connection refused")}
+	sinks := map[string]Sink{"stdout": working, "webhook": broken}
+	state := NewState()
+	if err := Deliver(state, sinks, testNotifications[:1]); err == nil || !strings.Contains(err.Error(), "webhook") {
+		t.Errorf("Got error %v, want an error from the webhook", err)
+	}
+	if len(working.received) != 1 || len(working.received[0]) != 1 {
+		t.Errorf("Working sink received %v, want one notification", working.received)
+	}
+
+	// The broken sink's notification survives a round trip through the
+	// state file. The next run sends it along with the new notification,
+	// but only to the sink that missed it.
+	if err := WriteState(filename, state); err != nil {
+		t.Fatal(err)
+	}
+	state, err = ReadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.err = nil
+	if err := Deliver(state, sinks, testNotifications[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(working.received) != 2 || len(working.received[1]) != 1 || working.received[1][0].Rule != "router" {
+		t.Errorf("Working sink received %v, want only the router notification the second time", working.received)
+	}
+	if len(broken.received) != 1 || len(broken.received[0]) != 2 || broken.received[0][0].Rule != "kenya" || broken.received[0][1].Rule != "router" {
+		t.Errorf("Broken sink received %v, want the kenya and router notifications", broken.received)
+	}
+	if len(state.Pending) != 0 {
+		t.Errorf("Still pending: %v", state.Pending)
+	}
+
+	// Pending notifications for sinks we no longer use are dropped.
+	state.Pending["smtp"] = testNotifications
+	if err := Deliver(state, sinks, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Pending) != 0 || len(working.received) != 2 {
+		t.Errorf("Delivered notifications for a removed sink: pending %v", state.Pending)
+	}
+}
@@ -0,0 +1,117 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+	"github.com/sburnett/bismark-tools/common/atomicfile"
+)
+
+// State records which rules are firing and since when, so that each alert
+// fires once and resolves once across runs. Pending holds the notifications
+// that each sink, by name, failed to receive, so Deliver can retry them
+// without sending duplicates to the sinks that got them.
+type State struct {
+	Firing  map[string]time.Time       `json:"firing"`
+	Pending map[string][]*Notification `json:"pending,omitempty"`
+}
+
+func NewState() *State {
+	return &State{Firing: make(map[string]time.Time), Pending: make(map[string][]*Notification)}
+}
+
+// ReadState reads state written by WriteState. A missing file is an empty
+// state, since that's what the first run sees.
+func ReadState(filename string) (*State, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return NewState(), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading alert state: %s", err)
+	}
+	state := NewState()
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("Error parsing alert state %s: %s", filename, err)
+	}
+	if state.Firing == nil {
+		state.Firing = make(map[string]time.Time)
+	}
+	if state.Pending == nil {
+		state.Pending = make(map[string][]*Notification)
+	}
+	return state, nil
+}
+
+// WriteState replaces filename atomically, so an interrupted run can't leave
+// behind a truncated state file.
+func WriteState(filename string, state *State) error {
+	contents, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(filename, contents, 0644); err != nil {
+		return fmt.Errorf("Error writing alert state: %s", err)
+	}
+	return nil
+}
+
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+type Notification struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+	// Since is when the rule started firing.
+	Since time.Time `json:"since"`
+}
+
+func (n *Notification) String() string {
+	return fmt.Sprintf("[%s] %s: %s", n.State, n.Rule, n.Message)
+}
+
+// Evaluate checks every rule against the datastore and returns a notification
+// for each rule that started or stopped firing since the previous run. It
+// updates state in place. Rules for unknown nodes are skipped with a warning.
+// Rules that are no longer in the rules file are forgotten silently.
+func Evaluate(ctx context.Context, db datastore.Datastore, rules []*Rule, state *State, now time.Time) ([]*Notification, error) {
+	f, err := selectFleet(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []*Notification
+	names := make(map[string]bool)
+	for _, rule := range rules {
+		names[rule.Name] = true
+		firing, message, err := rule.evaluate(f)
+		if err != nil {
+			log.Printf("Skipping rule %s: %s", rule.Name, err)
+			continue
+		}
+		since, wasFiring := state.Firing[rule.Name]
+		switch {
+		case firing && !wasFiring:
+			state.Firing[rule.Name] = now
+			notifications = append(notifications, &Notification{rule.Name, Firing, message, now, now})
+		case !firing && wasFiring:
+			delete(state.Firing, rule.Name)
+			notifications = append(notifications, &Notification{rule.Name, Resolved, message, now, since})
+		}
+	}
+	for name := range state.Firing {
+		if !names[name] {
+			delete(state.Firing, name)
+		}
+	}
+	return notifications, nil
+}
@@ -0,0 +1,45 @@
+package alerts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	directory, err := ioutil.TempDir("", "bdmq-alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	filename := filepath.Join(directory, "state.json")
+
+	state, err := ReadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Firing) != 0 {
+		t.Fatalf("Missing state file should be empty, got %v", state.Firing)
+	}
+	since := time.Date(2013, 7, 1, 8, 0, 0, 0, time.UTC)
+	state.Firing["kenya"] = since
+	if err := WriteState(filename, state); err != nil {
+		t.Fatal(err)
+	}
+	state, err = ReadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Firing) != 1 || !state.Firing["kenya"].Equal(since) {
+		t.Fatalf("Read %v, want kenya firing since %s", state.Firing, since)
+	}
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("WriteState left temporary files behind: %d entries", len(entries))
+	}
+}
@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/alerts"
+)
+
+type alert struct{}
+
+func NewAlert() BdmCommand {
+	return new(alert)
+}
+
+func (alert) Name() string {
+	return "alert"
+}
+
+func (alert) Description() string {
+	return "Evaluate alert rules and send notifications: alert --rules=<file> [--state_file=<file>] [--webhook=<url>] [--smtp_server=<host:port> --smtp_from=<address> --smtp_to=<addresses>]"
+}
+
+func (alert) Run(args []string) error {
+	flagset := flag.NewFlagSet("alert", flag.ContinueOnError)
+	rulesFile := flagset.String("rules", "", "Read alert rules from this file")
+	stateFile := flagset.String("state_file", "/tmp/bdmq-alert-state.json", "Remember which alerts are firing, and which notifications each sink missed, in this file")
+	webhook := flagset.String("webhook", "", "POST notifications as JSON to this URL")
+	smtpServer := flagset.String("smtp_server", "", "Email notifications through this SMTP server (host:port)")
+	smtpFrom := flagset.String("smtp_from", "", "Send email notifications from this address")
+	smtpTo := flagset.String("smtp_to", "", "Send email notifications to these comma separated addresses")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if *rulesFile == "" {
+		return fmt.Errorf("Usage: alert --rules=<file>")
+	}
+	if flagset.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments: %v", flagset.Args())
+	}
+
+	sinks := map[string]alerts.Sink{"stdout": alerts.NewWriterSink(output)}
+	if *webhook != "" {
+		sinks["webhook"] = alerts.NewWebhookSink(*webhook)
+	}
+	if *smtpServer != "" {
+		if *smtpFrom == "" || *smtpTo == "" {
+			return fmt.Errorf("--smtp_server requires --smtp_from and --smtp_to")
+		}
+		sinks["smtp"] = alerts.NewSmtpSink(*smtpServer, *smtpFrom, strings.Split(*smtpTo, ","))
+	}
+
+	rules, err := alerts.ReadRules(*rulesFile)
+	if err != nil {
+		return err
+	}
+	state, err := alerts.ReadState(*stateFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	notifications, err := alerts.Evaluate(ctx, db, rules, state, time.Now())
+	if err != nil {
+		return err
+	}
+	// Save state even if a sink failed, since it records which sinks still
+	// need which notifications; the next run retries just those.
+	deliverErr := alerts.Deliver(state, sinks, notifications)
+	if err := alerts.WriteState(*stateFile, state); err != nil {
+		return err
+	}
+	return deliverErr
+}
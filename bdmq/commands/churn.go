@@ -0,0 +1,194 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type churn struct{}
+
+func NewChurn() BdmCommand {
+	return new(churn)
+}
+
+func (churn) Name() string {
+	return "churn"
+}
+
+func (churn) Description() string {
+	return "Count routers that joined, stayed or left each month or week, by country and version: churn [--by=month|week] [--inactivity=<duration>]"
+}
+
+// periodStart returns the start of the month or week (starting on Monday)
+// containing timestamp, in UTC.
+func periodStart(by string, timestamp time.Time) time.Time {
+	year, month, day := timestamp.UTC().Date()
+	if by == "week" {
+		weekday := (int(timestamp.UTC().Weekday()) + 6) % 7
+		return time.Date(year, month, day-weekday, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextPeriod(by string, start time.Time) time.Time {
+	if by == "week" {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+func periodLabel(by string, start time.Time) string {
+	if by == "week" {
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	return start.Format("2006-01")
+}
+
+type churnKey struct {
+	Period           time.Time
+	Country, Version string
+}
+
+// churnCounts classifies the nodes in one group during one period. New
+// counts nodes whose first probe was during the period and Retired counts
+// nodes that stopped probing and whose inactivity window ran out during it;
+// a node can be both. Otherwise, a node is Active if it probed during the
+// period and Dormant if it's waiting out its inactivity window.
+type churnCounts struct {
+	churnKey
+	New, Active, Dormant, Retired int
+}
+
+// A slice of churnCounts that implements sort.Interface to sort by period,
+// then by country and version.
+type churnCountsList []*churnCounts
+
+func (l churnCountsList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l churnCountsList) Len() int      { return len(l) }
+func (l churnCountsList) Less(i, j int) bool {
+	switch {
+	case !l[i].Period.Equal(l[j].Period):
+		return l[i].Period.Before(l[j].Period)
+	case l[i].Country != l[j].Country:
+		return l[i].Country < l[j].Country
+	default:
+		return l[i].Version < l[j].Version
+	}
+}
+
+// countChurn classifies each node in every period from its first probe until
+// the last probe in the log, which stands in for the current time so that old
+// dumps of the log give the same answer. Lifetimes only have the first and
+// last probe, so a node is active in every period between them even if it
+// went quiet for a while.
+func countChurn(lifetimes []*datastore.LifetimesResult, devices map[string]*datastore.DevicesResult, by string, inactivity time.Duration) churnCountsList {
+	var horizon time.Time
+	for _, lifetime := range lifetimes {
+		if lifetime.LastProbe.After(horizon) {
+			horizon = lifetime.LastProbe
+		}
+	}
+
+	groups := make(map[churnKey]*churnCounts)
+	var counts churnCountsList
+	for _, lifetime := range lifetimes {
+		country, version := "??", "??"
+		if device, ok := devices[lifetime.NodeId]; ok {
+			country, version = device.CountryCode, device.Version
+		}
+		retiredAt := lifetime.LastProbe.Add(inactivity)
+		for start := periodStart(by, lifetime.FirstProbe); !start.After(horizon); start = nextPeriod(by, start) {
+			end := nextPeriod(by, start)
+			key := churnKey{start, country, version}
+			group, ok := groups[key]
+			if !ok {
+				group = &churnCounts{churnKey: key}
+				groups[key] = group
+				counts = append(counts, group)
+			}
+
+			isNew := !lifetime.FirstProbe.Before(start)
+			isRetired := retiredAt.Before(end) && !retiredAt.After(horizon)
+			switch {
+			case isNew || isRetired:
+				if isNew {
+					group.New++
+				}
+				if isRetired {
+					group.Retired++
+				}
+			case !lifetime.LastProbe.Before(start):
+				group.Active++
+			default:
+				group.Dormant++
+			}
+			if isRetired {
+				break
+			}
+		}
+	}
+	sort.Sort(counts)
+	return counts
+}
+
+func selectLifetimes(ctx context.Context, db datastore.Datastore) ([]*datastore.LifetimesResult, error) {
+	var lifetimes []*datastore.LifetimesResult
+	results := db.SelectLifetimes(ctx)
+	defer results.Close()
+	for results.Next() {
+		lifetimes = append(lifetimes, results.Result())
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	return lifetimes, nil
+}
+
+func (churn) Run(args []string) error {
+	flagset := flag.NewFlagSet("churn", flag.ContinueOnError)
+	by := flagset.String("by", "month", "Count nodes by month or week")
+	inactivity := flagset.Duration("inactivity", 30*24*time.Hour, "Consider a node retired after it has been silent this long")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if flagset.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments: %v", flagset.Args())
+	}
+	if *by != "month" && *by != "week" {
+		return fmt.Errorf("Invalid period: %s", *by)
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	devices, err := selectSnapshot(ctx, db)
+	if err != nil {
+		return err
+	}
+	lifetimes, err := selectLifetimes(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	writer, err := newRecordWriter(output, "period", "country", "version", "new", "active", "dormant", "retired")
+	if err != nil {
+		return err
+	}
+	for _, group := range countChurn(lifetimes, devices, *by, *inactivity) {
+		if err := writer.WriteRecord(periodLabel(*by, group.Period), group.Country, group.Version, group.New, group.Active, group.Dormant, group.Retired); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,261 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type collisions struct{}
+
+func NewCollisions() BdmCommand {
+	return new(collisions)
+}
+
+func (collisions) Name() string {
+	return "collisions"
+}
+
+func (collisions) Description() string {
+	return "Find nodes sharing an IP address or prefix and nodes hopping between countries or ASNs: collisions [--since=<time>] [--until=<time>] [--overlap=<duration>] [--hop_window=<duration>]"
+}
+
+// A collision is a group of nodes that probed from the same address or
+// prefix (Kind "address" or "prefix") within the overlap of each other, or a
+// single node whose probes moved to another country or AS (Kind "country" or
+// "asn") within the hop window. First and Last bound the probes involved.
+type collision struct {
+	Kind, Key   string
+	Nodes       []string
+	First, Last time.Time
+	Change      string
+}
+
+// Kinds of collisions in the order we list them.
+var collisionKinds = []string{"address", "prefix", "country", "asn"}
+
+// A slice of collisions that implements sort.Interface to sort by the order
+// of collisionKinds, then by time and key.
+type collisionList []*collision
+
+func (l collisionList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l collisionList) Len() int      { return len(l) }
+func (l collisionList) Less(i, j int) bool {
+	switch {
+	case l[i].Kind != l[j].Kind:
+		return collisionKindIndex(l[i].Kind) < collisionKindIndex(l[j].Kind)
+	case !l[i].First.Equal(l[j].First):
+		return l[i].First.Before(l[j].First)
+	default:
+		return l[i].Key < l[j].Key
+	}
+}
+
+func collisionKindIndex(kind string) int {
+	for idx, k := range collisionKinds {
+		if k == kind {
+			return idx
+		}
+	}
+	return len(collisionKinds)
+}
+
+// A slice of probes that implements sort.Interface to sort by Timestamp.
+type probesByTime []*datastore.ProbesResult
+
+func (p probesByTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p probesByTime) Len() int           { return len(p) }
+func (p probesByTime) Less(i, j int) bool { return p[i].Timestamp.Before(p[j].Timestamp) }
+
+// addressPrefix returns the network containing ipAddress, or "" if it isn't
+// an IP address.
+func addressPrefix(ipAddress string, ipv4Length, ipv6Length int) string {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(ipv4Length, 32)), Mask: net.CIDRMask(ipv4Length, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(ipv6Length, 128)), Mask: net.CIDRMask(ipv6Length, 128)}).String()
+}
+
+// findSharing groups probes by key and reports each group in which different
+// nodes probed within overlap of each other. If differentAddresses is set,
+// the nodes must also have probed from different addresses, so that prefix
+// collisions don't repeat address collisions.
+func findSharing(kind string, probes []*datastore.ProbesResult, key func(*datastore.ProbesResult) string, differentAddresses bool, overlap time.Duration) collisionList {
+	groups := make(map[string]probesByTime)
+	for _, probe := range probes {
+		if k := key(probe); k != "" {
+			groups[k] = append(groups[k], probe)
+		}
+	}
+
+	var collisions collisionList
+	for k, group := range groups {
+		sort.Stable(group)
+		nodes := make(map[string]bool)
+		var current *collision
+		for i, first := range group {
+			for _, second := range group[i+1:] {
+				if second.Timestamp.Sub(first.Timestamp) > overlap {
+					break
+				}
+				if first.NodeId == second.NodeId || (differentAddresses && first.IpAddress == second.IpAddress) {
+					continue
+				}
+				if current == nil {
+					current = &collision{Kind: kind, Key: k, First: first.Timestamp}
+				}
+				if second.Timestamp.After(current.Last) {
+					current.Last = second.Timestamp
+				}
+				nodes[first.NodeId], nodes[second.NodeId] = true, true
+			}
+		}
+		if current == nil {
+			continue
+		}
+		for node := range nodes {
+			current.Nodes = append(current.Nodes, node)
+		}
+		sort.Strings(current.Nodes)
+		collisions = append(collisions, current)
+	}
+	return collisions
+}
+
+// findHops reports each time a node's consecutive probes, no more than window
+// apart, came from different known countries or ASNs.
+func findHops(probes []*datastore.ProbesResult, window time.Duration) collisionList {
+	byNode := make(map[string]probesByTime)
+	for _, probe := range probes {
+		byNode[probe.NodeId] = append(byNode[probe.NodeId], probe)
+	}
+
+	var collisions collisionList
+	for nodeId, nodeProbes := range byNode {
+		sort.Stable(nodeProbes)
+		for idx := 1; idx < len(nodeProbes); idx++ {
+			before, after := nodeProbes[idx-1], nodeProbes[idx]
+			if after.Timestamp.Sub(before.Timestamp) > window {
+				continue
+			}
+			if before.CountryCode != "??" && after.CountryCode != "??" && before.CountryCode != after.CountryCode {
+				collisions = append(collisions, &collision{"country", nodeId, []string{nodeId}, before.Timestamp, after.Timestamp, before.CountryCode + " -> " + after.CountryCode})
+			}
+			if before.Asn != 0 && after.Asn != 0 && before.Asn != after.Asn {
+				collisions = append(collisions, &collision{"asn", nodeId, []string{nodeId}, before.Timestamp, after.Timestamp, fmt.Sprintf("%s -> %s", asnValue(before.Asn), asnValue(after.Asn))})
+			}
+		}
+	}
+	return collisions
+}
+
+// collectProbes returns every probe in [since, until) from every node in the
+// probe log, plus each device's current address as of its last probe.
+func collectProbes(ctx context.Context, db datastore.Datastore, since, until time.Time) ([]*datastore.ProbesResult, error) {
+	var probes []*datastore.ProbesResult
+	devices, err := selectSnapshot(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range devices {
+		if !r.LastSeen.Before(since) && r.LastSeen.Before(until) {
+			probes = append(probes, &datastore.ProbesResult{
+				NodeId:      r.NodeId,
+				IpAddress:   r.IpAddress,
+				CountryCode: r.CountryCode,
+				Asn:         r.Asn,
+				Timestamp:   r.LastSeen,
+			})
+		}
+	}
+
+	results := db.SelectAllProbes(ctx, since, until)
+	defer results.Close()
+	for results.Next() {
+		probes = append(probes, results.Result())
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	return probes, nil
+}
+
+func (collisions) Run(args []string) error {
+	flagset := flag.NewFlagSet("collisions", flag.ContinueOnError)
+	sinceText := flagset.String("since", "", "Look at probes starting at this time (default: one week before --until)")
+	untilText := flagset.String("until", "", "Look at probes until this time (default: now)")
+	overlap := flagset.Duration("overlap", 10*time.Minute, "Nodes share an address if they probe from it within this long of each other")
+	hopWindow := flagset.Duration("hop_window", 24*time.Hour, "Report nodes whose country or ASN changes between probes this close together")
+	ipv4Prefix := flagset.Int("ipv4_prefix", 24, "Group IPv4 addresses into prefixes of this length")
+	ipv6Prefix := flagset.Int("ipv6_prefix", 64, "Group IPv6 addresses into prefixes of this length")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if flagset.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments: %v", flagset.Args())
+	}
+
+	until := time.Now()
+	if *untilText != "" {
+		parsed, err := parseTimestamp(*untilText)
+		if err != nil {
+			return err
+		}
+		until = parsed
+	}
+	since := until.AddDate(0, 0, -7)
+	if *sinceText != "" {
+		parsed, err := parseTimestamp(*sinceText)
+		if err != nil {
+			return err
+		}
+		since = parsed
+	}
+	if !since.Before(until) {
+		return fmt.Errorf("--since must be before --until")
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	probes, err := collectProbes(ctx, db, since, until)
+	if err != nil {
+		return err
+	}
+
+	var found collisionList
+	found = append(found, findSharing("address", probes, func(probe *datastore.ProbesResult) string {
+		return probe.IpAddress
+	}, false, *overlap)...)
+	found = append(found, findSharing("prefix", probes, func(probe *datastore.ProbesResult) string {
+		return addressPrefix(probe.IpAddress, *ipv4Prefix, *ipv6Prefix)
+	}, true, *overlap)...)
+	found = append(found, findHops(probes, *hopWindow)...)
+	sort.Sort(found)
+
+	writer, err := newRecordWriter(output, "kind", "key", "nodes", "first", "last", "change")
+	if err != nil {
+		return err
+	}
+	for _, c := range found {
+		if err := writer.WriteRecord(c.Kind, c.Key, strings.Join(c.Nodes, ","), c.First, c.Last, c.Change); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
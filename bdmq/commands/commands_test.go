@@ -0,0 +1,512 @@
+package commands
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"testing"
+	"time"
+)
+
+// Each test runs a command against testdata/fleet.json. For readability, want
+// starts with an extra newline.
+type commandTest struct {
+	command BdmCommand
+	args    []string
+	format  string
+	want    string
+}
+
+var commandTests = []commandTest{
+	{NewDevices(), nil, "table", `
+NODE ID       IP ADDRESS   COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION   ASN      ISP                                 CITY
+OW0000000001  1.1.1.1      US       1.0      2013-07-02 11:59:30  up      00:00:30          AS7922   Comcast Cable Communications, Inc.  Atlanta
+OW0000000002  2.2.2.2      US       1.0      2013-07-02 11:55:00  stale   00:05:00          AS7922   Comcast Cable Communications, Inc.  Boston
+OW0000000003  143.215.1.2  US       1.1      2013-07-02 11:30:00  down    00:30:00          AS2637   Georgia Institute of Technology     Atlanta
+OW0000000004  41.1.1.1     KE       1.1      2013-06-30 12:00:00  down    2 days 00:00:00   AS33771  Safaricom Limited                   Nairobi
+OW00000000AB  81.2.3.4     GB       1.0      2013-05-01 00:00:00  down    62 days 12:00:00  AS2856   British Telecommunications PLC      London
+OW00000000CD  2001:db8::1  GB       1.1      2013-07-02 11:59:50  up      00:00:10                   ??                                  ??
+`},
+	{NewDevices(), []string{"where", "country", "=", "us", "order", "by", "id", "desc"}, "table", `
+NODE ID       IP ADDRESS   COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION  ASN     ISP                                 CITY
+OW0000000003  143.215.1.2  US       1.1      2013-07-02 11:30:00  down    00:30:00         AS2637  Georgia Institute of Technology     Atlanta
+OW0000000002  2.2.2.2      US       1.0      2013-07-02 11:55:00  stale   00:05:00         AS7922  Comcast Cable Communications, Inc.  Boston
+OW0000000001  1.1.1.1      US       1.0      2013-07-02 11:59:30  up      00:00:30         AS7922  Comcast Cable Communications, Inc.  Atlanta
+`},
+	{NewDevices(), []string{"where", "status", "=", "down", "and", "outage", ">", "1d", "order", "by", "outage", "desc", "limit", "1"}, "table", `
+NODE ID       IP ADDRESS  COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION   ASN     ISP                             CITY
+OW00000000AB  81.2.3.4    GB       1.0      2013-05-01 00:00:00  down    62 days 12:00:00  AS2856  British Telecommunications PLC  London
+`},
+	{NewDevices(), []string{"where", "(country", "=", "gb", "or", "country", "=", "ke)", "and", "not", "version", "=", "1.0"}, "jsonl", `
+{"node_id":"OW0000000004","ip_address":"41.1.1.1","country":"KE","version":"1.1","last_probe":"2013-06-30T12:00:00Z","status":"down","outage_duration":172800,"asn":33771,"isp":"Safaricom Limited","city":"Nairobi"}
+{"node_id":"OW00000000CD","ip_address":"2001:db8::1","country":"GB","version":"1.1","last_probe":"2013-07-02T11:59:50Z","status":"up","outage_duration":10,"asn":null,"isp":"??","city":"??"}
+`},
+	{NewDevices(), []string{"where", "id", "like", "ab"}, "csv", `
+node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW00000000AB,81.2.3.4,GB,1.0,2013-05-01T00:00:00Z,down,5400000,2856,British Telecommunications PLC,London
+`},
+	{NewDevices(), []string{"where", "ip", "in", "(143.215/16,", "2001:db8::/32)", "order", "by", "ip"}, "json", `
+[
+  {"node_id":"OW0000000003","ip_address":"143.215.1.2","country":"US","version":"1.1","last_probe":"2013-07-02T11:30:00Z","status":"down","outage_duration":1800,"asn":2637,"isp":"Georgia Institute of Technology","city":"Atlanta"},
+  {"node_id":"OW00000000CD","ip_address":"2001:db8::1","country":"GB","version":"1.1","last_probe":"2013-07-02T11:59:50Z","status":"up","outage_duration":10,"asn":null,"isp":"??","city":"??"}
+]
+`},
+	{NewList(), nil, "table", `
+NODE ID       IP ADDRESS   COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION   ASN      ISP                                 CITY
+OW0000000001  1.1.1.1      US       1.0      2013-07-02 11:59:30  up      00:00:30          AS7922   Comcast Cable Communications, Inc.  Atlanta
+OW0000000002  2.2.2.2      US       1.0      2013-07-02 11:55:00  stale   00:05:00          AS7922   Comcast Cable Communications, Inc.  Boston
+OW0000000003  143.215.1.2  US       1.1      2013-07-02 11:30:00  down    00:30:00          AS2637   Georgia Institute of Technology     Atlanta
+OW0000000004  41.1.1.1     KE       1.1      2013-06-30 12:00:00  down    2 days 00:00:00   AS33771  Safaricom Limited                   Nairobi
+OW00000000AB  81.2.3.4     GB       1.0      2013-05-01 00:00:00  down    62 days 12:00:00  AS2856   British Telecommunications PLC      London
+OW00000000CD  2001:db8::1  GB       1.1      2013-07-02 11:59:50  up      00:00:10                   ??                                  ??
+`},
+	{NewStatus(), nil, "table", `
+DEVICE STATUS  COUNT  PERCENTAGE
+Online         2      33%
+Stale          1      16%
+Offline        3      50%
+  past hour    1      16%
+  past day     1      16%
+  past week    2      33%
+  past month   2      33%
+Total          6      100%
+`},
+	{NewStatus(), nil, "json", `
+[
+  {"device_status":"online","count":2,"percentage":33.33333333333333},
+  {"device_status":"stale","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline","count":3,"percentage":50},
+  {"device_status":"offline_past_hour","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline_past_day","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline_past_week","count":2,"percentage":33.33333333333333},
+  {"device_status":"offline_past_month","count":2,"percentage":33.33333333333333},
+  {"device_status":"total","count":6,"percentage":100}
+]
+`},
+	{NewStatus(), []string{"down"}, "table", `
+Query: devices where status is down order by status,id
+NODE ID       IP ADDRESS   COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION   ASN      ISP                              CITY
+OW00000000AB  81.2.3.4     GB       1.0      2013-05-01 00:00:00  down    62 days 12:00:00  AS2856   British Telecommunications PLC   London
+OW0000000004  41.1.1.1     KE       1.1      2013-06-30 12:00:00  down    2 days 00:00:00   AS33771  Safaricom Limited                Nairobi
+OW0000000003  143.215.1.2  US       1.1      2013-07-02 11:30:00  down    00:30:00          AS2637   Georgia Institute of Technology  Atlanta
+`},
+	{NewStatus(), []string{"143.215.0.0/16", "gb"}, "table", `
+Query: devices where ip in 143.215.0.0/16 order by ip,duration
+NODE ID       IP ADDRESS   COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION  ASN     ISP                              CITY
+OW0000000003  143.215.1.2  US       1.1      2013-07-02 11:30:00  down    00:30:00         AS2637  Georgia Institute of Technology  Atlanta
+
+Query: devices where country = gb
+NODE ID       IP ADDRESS   COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION   ASN     ISP                             CITY
+OW00000000AB  81.2.3.4     GB       1.0      2013-05-01 00:00:00  down    62 days 12:00:00  AS2856  British Telecommunications PLC  London
+OW00000000CD  2001:db8::1  GB       1.1      2013-07-02 11:59:50  up      00:00:10                  ??                              ??
+`},
+	{NewStatus(), []string{"143.215.0.0/16", "gb"}, "json", `
+[
+  {"node_id":"OW0000000003","ip_address":"143.215.1.2","country":"US","version":"1.1","last_probe":"2013-07-02T11:30:00Z","status":"down","outage_duration":1800,"asn":2637,"isp":"Georgia Institute of Technology","city":"Atlanta"},
+  {"node_id":"OW00000000AB","ip_address":"81.2.3.4","country":"GB","version":"1.0","last_probe":"2013-05-01T00:00:00Z","status":"down","outage_duration":5400000,"asn":2856,"isp":"British Telecommunications PLC","city":"London"},
+  {"node_id":"OW00000000CD","ip_address":"2001:db8::1","country":"GB","version":"1.1","last_probe":"2013-07-02T11:59:50Z","status":"up","outage_duration":10,"asn":null,"isp":"??","city":"??"}
+]
+`},
+	{NewStatus(), []string{"0cd"}, "csv", `
+node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW00000000CD,2001:db8::1,GB,1.1,2013-07-02T11:59:50Z,up,10,,??,??
+`},
+	{NewVersions(), nil, "table", `
+VERSION  TOTAL  PERCENTAGE  ONLINE  STALE  OFFLINE  ONLINE PERCENTAGE
+1.0      3      50%         1       1      1        33%
+1.1      3      50%         1       0      2        33%
+`},
+	{NewVersions(), nil, "csv", `
+version,total,percentage,online,stale,offline,online_percentage
+1.0,3,50,1,1,1,33.33333333333333
+1.1,3,50,1,0,2,33.33333333333333
+`},
+	{NewCountries(), nil, "table", `
+COUNTRY  TOTAL  PERCENTAGE  ONLINE  STALE  OFFLINE  ONLINE PERCENTAGE
+US       3      50%         1       1      1        33%
+GB       2      33%         1       0      1        50%
+KE       1      16%         0       0      1        0%
+`},
+	{NewCountries(), nil, "json", `
+[
+  {"country":"US","total":3,"percentage":50,"online":1,"stale":1,"offline":1,"online_percentage":33.33333333333333},
+  {"country":"GB","total":2,"percentage":33.33333333333333,"online":1,"stale":0,"offline":1,"online_percentage":50},
+  {"country":"KE","total":1,"percentage":16.666666666666664,"online":0,"stale":0,"offline":1,"online_percentage":0}
+]
+`},
+	{NewDevices(), []string{"where", "asn", "=", "7922", "or", "isp", "=", "'safaricom limited'"}, "csv", `
+node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW0000000001,1.1.1.1,US,1.0,2013-07-02T11:59:30Z,up,30,7922,"Comcast Cable Communications, Inc.",Atlanta
+OW0000000002,2.2.2.2,US,1.0,2013-07-02T11:55:00Z,stale,300,7922,"Comcast Cable Communications, Inc.",Boston
+OW0000000004,41.1.1.1,KE,1.1,2013-06-30T12:00:00Z,down,172800,33771,Safaricom Limited,Nairobi
+`},
+	{NewDevices(), []string{"where", "city", "=", "atlanta", "and", "asn", "!=", "AS7922"}, "table", `
+NODE ID       IP ADDRESS   COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION  ASN     ISP                              CITY
+OW0000000003  143.215.1.2  US       1.1      2013-07-02 11:30:00  down    00:30:00         AS2637  Georgia Institute of Technology  Atlanta
+`},
+	{NewIsps(), nil, "table", `
+ASN      ISP                                 TOTAL  PERCENTAGE  ONLINE  STALE  OFFLINE  ONLINE PERCENTAGE
+AS7922   Comcast Cable Communications, Inc.  2      33%         1       1      0        50%
+         ??                                  1      16%         1       0      0        100%
+AS2637   Georgia Institute of Technology     1      16%         0       0      1        0%
+AS2856   British Telecommunications PLC      1      16%         0       0      1        0%
+AS33771  Safaricom Limited                   1      16%         0       0      1        0%
+`},
+	{NewIsps(), nil, "json", `
+[
+  {"asn":7922,"isp":"Comcast Cable Communications, Inc.","total":2,"percentage":33.33333333333333,"online":1,"stale":1,"offline":0,"online_percentage":50},
+  {"asn":null,"isp":"??","total":1,"percentage":16.666666666666664,"online":1,"stale":0,"offline":0,"online_percentage":100},
+  {"asn":2637,"isp":"Georgia Institute of Technology","total":1,"percentage":16.666666666666664,"online":0,"stale":0,"offline":1,"online_percentage":0},
+  {"asn":2856,"isp":"British Telecommunications PLC","total":1,"percentage":16.666666666666664,"online":0,"stale":0,"offline":1,"online_percentage":0},
+  {"asn":33771,"isp":"Safaricom Limited","total":1,"percentage":16.666666666666664,"online":0,"stale":0,"offline":1,"online_percentage":0}
+]
+`},
+	{NewSummarize(), []string{"by", "country,", "status"}, "table", `
+COUNTRY  STATUS  TOTAL  PERCENTAGE  ONLINE  STALE  OFFLINE  ONLINE PERCENTAGE
+GB       down    1      16%         0       0      1        0%
+GB       up      1      16%         1       0      0        100%
+KE       down    1      16%         0       0      1        0%
+US       down    1      16%         0       0      1        0%
+US       stale   1      16%         0       1      0        0%
+US       up      1      16%         1       0      0        100%
+`},
+	{NewSummarize(), []string{"by", "version", "where", "country", "!=", "ke"}, "csv", `
+version,total,percentage,online,stale,offline,online_percentage
+1.0,3,60,1,1,1,33.33333333333333
+1.1,2,40,1,0,1,50
+`},
+	{NewSummarize(), []string{"by", "asn", "where", "city", "=", "atlanta"}, "jsonl", `
+{"asn":2637,"total":1,"percentage":50,"online":0,"stale":0,"offline":1,"online_percentage":0}
+{"asn":7922,"total":1,"percentage":50,"online":1,"stale":0,"offline":0,"online_percentage":100}
+`},
+	{NewVersions(), []string{"where", "status", "!=", "stale"}, "table", `
+VERSION  TOTAL  PERCENTAGE  ONLINE  STALE  OFFLINE  ONLINE PERCENTAGE
+1.1      3      60%         1       0      2        33%
+1.0      2      40%         1       0      1        50%
+`},
+	{NewHistory(), []string{"OW0000000001", "--since=2013-07-02T10:00:00Z", "--until=2013-07-02T12:00:00Z"}, "table", `
+STATE         START                END                  DURATION  IP ADDRESS  PERCENTAGE
+online        2013-07-02 10:00:00  2013-07-02 10:10:00  10m0s     1.1.1.1     8%
+offline       2013-07-02 10:10:00  2013-07-02 11:00:00  50m0s                 41%
+online        2013-07-02 11:00:00  2013-07-02 11:10:00  10m0s     1.1.1.1     8%
+online        2013-07-02 11:10:00  2013-07-02 11:15:00  5m0s      1.1.1.9     4%
+offline       2013-07-02 11:15:00  2013-07-02 11:59:30  44m30s                37%
+online        2013-07-02 11:59:30  2013-07-02 12:00:00  30s       1.1.1.9     0%
+availability  2013-07-02 10:00:00  2013-07-02 12:00:00  25m30s                21%
+`},
+	{NewHistory(), []string{"--since=2013-07-02", "OW0000000002", "--until=2013-07-02T11:00:00Z"}, "csv", `
+state,start,end,duration,ip_address,percentage
+offline,2013-07-02T00:00:00Z,2013-07-02T11:00:00Z,39600,,100
+availability,2013-07-02T00:00:00Z,2013-07-02T11:00:00Z,0,,0
+`},
+}
+
+func runCommandTest(test commandTest) (string, error) {
+	var buffer bytes.Buffer
+	output = &buffer
+	outputFormat = test.format
+	defer func() {
+		output = os.Stdout
+		outputFormat = "table"
+	}()
+	err := test.command.Run(test.args)
+	return buffer.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/fleet.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+
+	for _, test := range commandTests {
+		got, err := runCommandTest(test)
+		if err != nil {
+			t.Errorf("%s %v: %s", test.command.Name(), test.args, err)
+			continue
+		}
+		if "\n"+got != test.want {
+			t.Errorf("%s %v (%s): got\n%s\nwant\n%s", test.command.Name(), test.args, test.format, got, test.want)
+		}
+	}
+}
+
+func TestCommandsInvalidQuery(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/fleet.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+
+	_, err := runCommandTest(commandTest{NewDevices(), []string{"where", "colour", "=", "red"}, "table", ""})
+	if err == nil || err.Error() != `Invalid query: Invalid field: colour near "colour" at position 7` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCommandsThresholds(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/fleet.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+	if err := flag.Set("thresholds_file", "testdata/thresholds.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("thresholds_file", "")
+
+	// OW0000000003 runs version 1.1 and has been gone for 30 minutes, so
+	// every command should count it as stale.
+	for _, test := range []commandTest{
+		{NewDevices(), []string{"where", "version", "=", "1.1", "and", "status", "!=", "down"}, "csv", `
+node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW0000000003,143.215.1.2,US,1.1,2013-07-02T11:30:00Z,stale,1800,2637,Georgia Institute of Technology,Atlanta
+OW00000000CD,2001:db8::1,GB,1.1,2013-07-02T11:59:50Z,up,10,,??,??
+`},
+		{NewVersions(), nil, "csv", `
+version,total,percentage,online,stale,offline,online_percentage
+1.0,3,50,1,1,1,33.33333333333333
+1.1,3,50,1,1,1,33.33333333333333
+`},
+		{NewCountries(), nil, "csv", `
+country,total,percentage,online,stale,offline,online_percentage
+US,3,50,1,2,0,33.33333333333333
+GB,2,33.33333333333333,1,0,1,50
+KE,1,16.666666666666664,0,0,1,0
+`},
+	} {
+		got, err := runCommandTest(test)
+		if err != nil {
+			t.Errorf("%s %v: %s", test.command.Name(), test.args, err)
+			continue
+		}
+		if "\n"+got != test.want {
+			t.Errorf("%s %v (%s): got\n%s\nwant\n%s", test.command.Name(), test.args, test.format, got, test.want)
+		}
+	}
+}
+
+func TestCommandsAsOf(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/fleet.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+	if err := flag.Set("snapshot_dir", "testdata/snapshots"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("snapshot_dir", "/tmp/bdmq-snapshots")
+
+	for _, test := range []commandTest{
+		{NewDevices(), []string{"--as_of=2013-07-01T11:00:00Z", "where", "status", "!=", "down"}, "table", `
+NODE ID       IP ADDRESS  COUNTRY  VERSION  LAST PROBE           STATUS  OUTAGE DURATION  ASN     ISP                                 CITY
+OW0000000002  2.2.2.2     US       1.0      2013-07-01 11:59:00  up      00:01:00         AS7922  Comcast Cable Communications, Inc.  Boston
+OW00000000EF  5.6.7.8     DE       1.0      2013-07-01 11:59:45  up      00:00:15         AS3320  Deutsche Telekom AG                 Berlin
+`},
+		{NewStatus(), []string{"--as_of=2013-07-01"}, "csv", `
+device_status,count,percentage
+online,2,33.33333333333333
+stale,0,0
+offline,4,66.66666666666666
+offline_past_hour,1,16.666666666666664
+offline_past_day,3,50
+offline_past_week,3,50
+offline_past_month,3,50
+total,6,100
+`},
+		{NewStatus(), []string{"--as_of=2013-07-01", "de"}, "csv", `
+node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW00000000EF,5.6.7.8,DE,1.0,2013-07-01T11:59:45Z,up,15,3320,Deutsche Telekom AG,Berlin
+`},
+		{NewVersions(), []string{"--as_of=2013-07-01"}, "csv", `
+version,total,percentage,online,stale,offline,online_percentage
+1.0,5,83.33333333333334,2,0,3,40
+1.1,1,16.666666666666664,0,0,1,0
+`},
+		{NewCountries(), []string{"--as_of=2013-07-02", "where", "version", "=", "1.1"}, "csv", `
+country,total,percentage,online,stale,offline,online_percentage
+GB,1,33.33333333333333,1,0,0,100
+KE,1,33.33333333333333,0,0,1,0
+US,1,33.33333333333333,0,0,1,0
+`},
+		{NewSnapshot(), []string{"--list"}, "table", `
+TAKEN
+2013-07-01 12:00:00
+2013-07-02 12:00:00
+`},
+		{NewDiff(), []string{"2013-07-01", "2013-07-02"}, "jsonl", `
+{"node_id":"OW0000000001","change":"status","before":"down","after":"up"}
+{"node_id":"OW0000000002","change":"status","before":"up","after":"stale"}
+{"node_id":"OW0000000003","change":"upgraded","before":"1.0","after":"1.1"}
+{"node_id":"OW00000000CD","change":"added","before":"","after":"1.1"}
+{"node_id":"OW00000000EF","change":"removed","before":"1.0","after":""}
+`},
+		{NewDiff(), []string{"2013-07-01", "now"}, "csv", `
+node_id,change,before,after
+OW0000000001,status,down,up
+OW0000000002,status,up,stale
+OW0000000003,upgraded,1.0,1.1
+OW00000000CD,added,,1.1
+OW00000000EF,removed,1.0,
+`},
+	} {
+		got, err := runCommandTest(test)
+		if err != nil {
+			t.Errorf("%s %v: %s", test.command.Name(), test.args, err)
+			continue
+		}
+		if "\n"+got != test.want {
+			t.Errorf("%s %v (%s): got\n%s\nwant\n%s", test.command.Name(), test.args, test.format, got, test.want)
+		}
+	}
+}
+
+func TestCommandsChurn(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/churn.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+
+	for _, test := range []commandTest{
+		{NewChurn(), nil, "table", `
+PERIOD   COUNTRY  VERSION  NEW  ACTIVE  DORMANT  RETIRED
+2013-05  ??       ??       1    0       0        0
+2013-05  KE       1.0      1    0       0        0
+2013-05  US       1.0      1    0       0        0
+2013-06  ??       ??       0    0       0        1
+2013-06  KE       1.0      0    1       0        0
+2013-06  US       1.0      0    1       0        0
+2013-06  US       1.1      1    0       0        0
+2013-07  GB       1.1      1    0       0        0
+2013-07  KE       1.0      0    0       0        1
+2013-07  US       1.0      0    1       0        0
+2013-07  US       1.1      0    1       0        0
+2013-08  GB       1.1      0    0       1        0
+2013-08  US       1.0      0    1       0        0
+2013-08  US       1.1      0    1       0        0
+`},
+		{NewChurn(), []string{"--inactivity=1200h"}, "csv", `
+period,country,version,new,active,dormant,retired
+2013-05,??,??,1,0,0,0
+2013-05,KE,1.0,1,0,0,0
+2013-05,US,1.0,1,0,0,0
+2013-06,??,??,0,0,1,0
+2013-06,KE,1.0,0,1,0,0
+2013-06,US,1.0,0,1,0,0
+2013-06,US,1.1,1,0,0,0
+2013-07,??,??,0,0,0,1
+2013-07,GB,1.1,1,0,0,0
+2013-07,KE,1.0,0,0,0,1
+2013-07,US,1.0,0,1,0,0
+2013-07,US,1.1,0,1,0,0
+2013-08,GB,1.1,0,0,1,0
+2013-08,US,1.0,0,1,0,0
+2013-08,US,1.1,0,1,0,0
+`},
+	} {
+		got, err := runCommandTest(test)
+		if err != nil {
+			t.Errorf("%s %v: %s", test.command.Name(), test.args, err)
+			continue
+		}
+		if "\n"+got != test.want {
+			t.Errorf("%s %v (%s): got\n%s\nwant\n%s", test.command.Name(), test.args, test.format, got, test.want)
+		}
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	for _, test := range []struct {
+		by, timestamp, want, label string
+	}{
+		{"month", "2013-07-02T12:00:00Z", "2013-07-01T00:00:00Z", "2013-07"},
+		{"month", "2013-12-31T23:59:59Z", "2013-12-01T00:00:00Z", "2013-12"},
+		{"week", "2013-07-02T12:00:00Z", "2013-07-01T00:00:00Z", "2013-W27"},
+		{"week", "2013-07-07T23:00:00Z", "2013-07-01T00:00:00Z", "2013-W27"},
+		{"week", "2013-07-08T00:00:00Z", "2013-07-08T00:00:00Z", "2013-W28"},
+		{"week", "2013-01-01T00:00:00Z", "2012-12-31T00:00:00Z", "2013-W01"},
+	} {
+		timestamp, _ := time.Parse(time.RFC3339, test.timestamp)
+		start := periodStart(test.by, timestamp)
+		if got := start.Format(time.RFC3339); got != test.want {
+			t.Errorf("periodStart(%s, %s) = %s, want %s", test.by, test.timestamp, got, test.want)
+		}
+		if got := periodLabel(test.by, start); got != test.label {
+			t.Errorf("periodLabel(%s, %s) = %s, want %s", test.by, start, got, test.label)
+		}
+	}
+}
+
+func TestCommandsCollisions(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/collisions.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+
+	for _, test := range []commandTest{
+		{NewCollisions(), []string{"--until=2013-07-02T12:00:00Z"}, "csv", `
+kind,key,nodes,first,last,change
+address,2.2.2.2,"OW0000000001,OW00000000AB",2013-07-01T10:00:00Z,2013-07-01T10:05:00Z,
+address,10.0.0.5,"OW0000000001,OW0000000002",2013-07-02T11:55:00Z,2013-07-02T11:59:00Z,
+prefix,10.0.0.0/24,"OW0000000001,OW0000000002,OW0000000003",2013-07-02T11:55:00Z,2013-07-02T11:59:00Z,
+country,OW0000000004,OW0000000004,2013-07-02T08:00:00Z,2013-07-02T09:00:00Z,US -> KE
+asn,OW0000000004,OW0000000004,2013-07-02T08:00:00Z,2013-07-02T09:00:00Z,AS7922 -> AS33771
+`},
+		{NewCollisions(), []string{"--since=2013-06-01", "--until=2013-07-02T12:00:00Z", "--overlap=1h", "--hop_window=30m", "--ipv4_prefix=8"}, "jsonl", `
+{"kind":"address","key":"2.2.2.2","nodes":"OW0000000001,OW00000000AB","first":"2013-07-01T10:00:00Z","last":"2013-07-01T10:05:00Z","change":""}
+{"kind":"address","key":"10.0.0.5","nodes":"OW0000000001,OW0000000002","first":"2013-07-02T11:55:00Z","last":"2013-07-02T11:59:00Z","change":""}
+{"kind":"prefix","key":"10.0.0.0/8","nodes":"OW0000000001,OW0000000002,OW0000000003","first":"2013-07-02T11:55:00Z","last":"2013-07-02T11:59:00Z","change":""}
+`},
+	} {
+		got, err := runCommandTest(test)
+		if err != nil {
+			t.Errorf("%s %v: %s", test.command.Name(), test.args, err)
+			continue
+		}
+		if "\n"+got != test.want {
+			t.Errorf("%s %v (%s): got\n%s\nwant\n%s", test.command.Name(), test.args, test.format, got, test.want)
+		}
+	}
+}
+
+func TestCommandsRegistry(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/fleet.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+	if err := flag.Set("registry", "testdata/registry.csv"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("registry", "")
+
+	for _, test := range []commandTest{
+		{NewDevices(), []string{"where", "tag", "=", "COHORT2013"}, "csv", `
+node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW0000000001,1.1.1.1,US,1.0,2013-07-02T11:59:30Z,up,30,7922,"Comcast Cable Communications, Inc.",Atlanta
+OW0000000003,143.215.1.2,US,1.1,2013-07-02T11:30:00Z,down,1800,2637,Georgia Institute of Technology,Atlanta
+OW00000000CD,2001:db8::1,GB,1.1,2013-07-02T11:59:50Z,up,10,,??,??
+`},
+		{NewDevices(), []string{"where", "attr.partner", "=", "gatech", "and", "not", "tag", "=", "pilot"}, "csv", `
+node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW0000000003,143.215.1.2,US,1.1,2013-07-02T11:30:00Z,down,1800,2637,Georgia Institute of Technology,Atlanta
+`},
+		{NewDevices(), []string{"where", "attr.model", "in", "(wndr3800,", "'')"}, "csv", `
+node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW0000000002,2.2.2.2,US,1.0,2013-07-02T11:55:00Z,stale,300,7922,"Comcast Cable Communications, Inc.",Boston
+OW0000000003,143.215.1.2,US,1.1,2013-07-02T11:30:00Z,down,1800,2637,Georgia Institute of Technology,Atlanta
+OW00000000AB,81.2.3.4,GB,1.0,2013-05-01T00:00:00Z,down,5400000,2856,British Telecommunications PLC,London
+OW00000000CD,2001:db8::1,GB,1.1,2013-07-02T11:59:50Z,up,10,,??,??
+`},
+		{NewSummarize(), []string{"by", "version", "where", "tag", "!=", "cohort2013"}, "csv", `
+version,total,percentage,online,stale,offline,online_percentage
+1.0,2,66.66666666666666,0,1,1,0
+1.1,1,33.33333333333333,0,0,1,0
+`},
+	} {
+		got, err := runCommandTest(test)
+		if err != nil {
+			t.Errorf("%s %v: %s", test.command.Name(), test.args, err)
+			continue
+		}
+		if "\n"+got != test.want {
+			t.Errorf("%s %v (%s): got\n%s\nwant\n%s", test.command.Name(), test.args, test.format, got, test.want)
+		}
+	}
+}
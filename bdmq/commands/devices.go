@@ -1,9 +1,9 @@
 package commands
 
 import (
-	"os"
+	"context"
+	"flag"
 	"strings"
-	"text/tabwriter"
 
 	"github.com/sburnett/bismark-tools/bdmq/datastore"
 )
@@ -19,39 +19,66 @@ func (devices) Name() string {
 }
 
 func (devices) Description() string {
-	return "Query device information"
+	return "Query device information: devices [--as_of=<time>] [where ...] [order by ...] [limit ...]"
+}
+
+var deviceFields = []string{"node_id", "ip_address", "country", "version", "last_probe", "status", "outage_duration", "asn", "isp", "city"}
+
+func deviceRecord(r *datastore.DevicesResult) []interface{} {
+	outage := durationValue{r.OutageDuration, r.OutageDurationText}
+	return []interface{}{r.NodeId, r.IpAddress, r.CountryCode, r.Version, r.LastSeen, r.DeviceStatus, outage, asnValue(r.Asn), r.Isp, r.City}
+}
+
+// selectDevices runs a parsed query, ordering by node ID unless the query
+// says otherwise.
+func selectDevices(ctx context.Context, db datastore.Datastore, params *DeviceQuery) *datastore.DevicesIterator {
+	orderBy, order := params.OrderBy, params.Order
+	if len(order) == 0 {
+		orderBy = []datastore.Identifier{datastore.NodeId}
+		order = []datastore.Order{datastore.Ascending}
+	}
+	return db.SelectDevices(ctx, orderBy, order, params.Limit, params.Filter)
+}
+
+// writeDevices writes a record for each device that a parsed query selects,
+// without flushing the writer.
+func writeDevices(ctx context.Context, db datastore.Datastore, params *DeviceQuery, writer recordWriter) error {
+	results := selectDevices(ctx, db, params)
+	defer results.Close()
+	for results.Next() {
+		if err := writer.WriteRecord(deviceRecord(results.Result())...); err != nil {
+			return err
+		}
+	}
+	return results.Err()
 }
 
 func (devices) Run(args []string) error {
-	db, err := datastore.NewPostgresDatastore()
+	flagset := flag.NewFlagSet("devices", flag.ContinueOnError)
+	asOf := addAsOfFlag(flagset)
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDatastore(*asOf)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	params, err := parseDeviceQuery(strings.Join(args, " "))
+	params, err := parseDeviceQuery(strings.Join(flagset.Args(), " "))
 	if err != nil {
 		return err
 	}
 
-	if len(params.Order) == 0 {
-		params.OrderBy = append(params.OrderBy, datastore.NodeId)
-		params.Order = append(params.Order, datastore.Ascending)
+	ctx, cancel := queryContext()
+	defer cancel()
+	writer, err := newRecordWriter(output, deviceFields...)
+	if err != nil {
+		return err
 	}
-
-	results := db.SelectDevices(params.OrderBy, params.Order, params.Limit, params.NodeLike, params.IpWithin, params.CountryCode, params.VersionEquals, params.StatusEquals)
-	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
-	defer writer.Flush()
-	fprintWithTabs(writer, "NODE ID", "IP ADDRESS", "COUNTRY", "VERSION", "LAST PROBE", "STATUS", "OUTAGE DURATION")
-	for r := range results {
-		if r.Error != nil {
-			return r.Error
-		}
-
-		lastSeenText := r.LastSeen.Format("2006-01-02 15:04:05")
-
-		fprintWithTabs(writer, r.NodeId, r.IpAddress, r.CountryCode, r.Version, lastSeenText, r.DeviceStatus, r.OutageDurationText)
+	if err := writeDevices(ctx, db, params, writer); err != nil {
+		return err
 	}
-
-	return nil
+	return writer.Flush()
 }
@@ -0,0 +1,121 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type diff struct{}
+
+func NewDiff() BdmCommand {
+	return new(diff)
+}
+
+func (diff) Name() string {
+	return "diff"
+}
+
+func (diff) Description() string {
+	return "Show devices added, removed, upgraded or whose status changed between two snapshots: diff <time> <time|now>"
+}
+
+// A deviceChange is one difference between two snapshots. Added and removed
+// devices show their version; upgrades show both versions and status changes
+// show both statuses.
+type deviceChange struct {
+	NodeId, Change, Before, After string
+}
+
+// Changes in the order diff lists them for each device.
+var changeKinds = []string{"added", "removed", "upgraded", "status"}
+
+// A slice of deviceChanges that implements sort.Interface to sort by node ID,
+// then by the order of changeKinds.
+type deviceChangeList []deviceChange
+
+func (l deviceChangeList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l deviceChangeList) Len() int      { return len(l) }
+func (l deviceChangeList) Less(i, j int) bool {
+	if l[i].NodeId != l[j].NodeId {
+		return l[i].NodeId < l[j].NodeId
+	}
+	return changeIndex(l[i].Change) < changeIndex(l[j].Change)
+}
+
+func changeIndex(change string) int {
+	for idx, kind := range changeKinds {
+		if kind == change {
+			return idx
+		}
+	}
+	return len(changeKinds)
+}
+
+func diffDevices(before, after map[string]*datastore.DevicesResult) []deviceChange {
+	var changes deviceChangeList
+	for nodeId, old := range before {
+		current, ok := after[nodeId]
+		if !ok {
+			changes = append(changes, deviceChange{nodeId, "removed", old.Version, ""})
+			continue
+		}
+		if old.Version != current.Version {
+			changes = append(changes, deviceChange{nodeId, "upgraded", old.Version, current.Version})
+		}
+		if old.DeviceStatus != current.DeviceStatus {
+			changes = append(changes, deviceChange{nodeId, "status", old.DeviceStatus.String(), current.DeviceStatus.String()})
+		}
+	}
+	for nodeId, current := range after {
+		if _, ok := before[nodeId]; !ok {
+			changes = append(changes, deviceChange{nodeId, "added", "", current.Version})
+		}
+	}
+	sort.Sort(changes)
+	return changes
+}
+
+// snapshotDevices reads every device from the snapshot nearest to when, or
+// from the live datastore if when is "now".
+func snapshotDevices(when string) (map[string]*datastore.DevicesResult, error) {
+	asOf := when
+	if when == "now" {
+		asOf = ""
+	}
+	db, err := openDatastore(asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	return selectSnapshot(ctx, db)
+}
+
+func (diff) Run(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: diff <time> <time|now>")
+	}
+	before, err := snapshotDevices(args[0])
+	if err != nil {
+		return err
+	}
+	after, err := snapshotDevices(args[1])
+	if err != nil {
+		return err
+	}
+
+	writer, err := newRecordWriter(output, "node_id", "change", "before", "after")
+	if err != nil {
+		return err
+	}
+	for _, change := range diffDevices(before, after) {
+		if err := writer.WriteRecord(change.NodeId, change.Change, change.Before, change.After); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
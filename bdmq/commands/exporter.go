@@ -0,0 +1,299 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type exporter struct{}
+
+func NewExporter() BdmCommand {
+	return new(exporter)
+}
+
+func (exporter) Name() string {
+	return "exporter"
+}
+
+func (exporter) Description() string {
+	return "Serve fleet status metrics for Prometheus at /metrics: exporter [--listen=<address>] [--timeout=<duration>] [--cache_ttl=<duration>]"
+}
+
+// Upper bounds of the outage duration histogram's buckets, in seconds: a
+// minute, 90 seconds (the default online threshold), 5 and 10 minutes (the
+// default stale threshold), half an hour, an hour, 6 hours, a day, a week and
+// 30 days.
+var outageBuckets = []float64{60, 90, 300, 600, 1800, 3600, 6 * 3600, 86400, 7 * 86400, 30 * 86400}
+
+var exporterStatuses = []datastore.DeviceStatus{datastore.Online, datastore.Stale, datastore.Offline}
+
+// fleetMetrics are the metrics computed from the datastore on each scrape.
+type fleetMetrics struct {
+	byStatus  map[datastore.DeviceStatus]int
+	byVersion map[[2]string]int
+	byCountry map[[2]string]int
+	// outageCounts[i] counts the devices with outages no longer than
+	// outageBuckets[i]; the last element counts every device.
+	outageCounts []int
+	outageSum    float64
+}
+
+func collectFleetMetrics(ctx context.Context, db datastore.Datastore) (*fleetMetrics, error) {
+	metrics := &fleetMetrics{
+		byStatus:     make(map[datastore.DeviceStatus]int),
+		byVersion:    make(map[[2]string]int),
+		byCountry:    make(map[[2]string]int),
+		outageCounts: make([]int, len(outageBuckets)+1),
+	}
+	devices := db.SelectDevices(ctx, nil, nil, 0, nil)
+	defer devices.Close()
+	for devices.Next() {
+		r := devices.Result()
+		status := r.DeviceStatus.String()
+		metrics.byStatus[r.DeviceStatus]++
+		metrics.byVersion[[2]string{r.Version, status}]++
+		metrics.byCountry[[2]string{r.CountryCode, status}]++
+
+		seconds := r.OutageDuration.Seconds()
+		for idx, bound := range outageBuckets {
+			if seconds <= bound {
+				metrics.outageCounts[idx]++
+			}
+		}
+		metrics.outageCounts[len(outageBuckets)]++
+		metrics.outageSum += seconds
+	}
+	if err := devices.Err(); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// A metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	buffer *bytes.Buffer
+}
+
+func (w metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(w.buffer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample of a metric. labels alternates label names and
+// values.
+func (w metricsWriter) sample(name string, value interface{}, labels ...string) {
+	w.buffer.WriteString(name)
+	for idx := 0; idx+1 < len(labels); idx += 2 {
+		separator := ","
+		if idx == 0 {
+			separator = "{"
+		}
+		fmt.Fprintf(w.buffer, `%s%s="%s"`, separator, labels[idx], labelEscaper.Replace(labels[idx+1]))
+	}
+	if len(labels) > 0 {
+		w.buffer.WriteByte('}')
+	}
+	if number, ok := value.(float64); ok {
+		value = strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	fmt.Fprintf(w.buffer, " %v\n", value)
+}
+
+// groups writes a sample for each key of counts, which pair a group with a
+// device status, in order.
+func (w metricsWriter) groups(name, label string, counts map[[2]string]int) {
+	var keys [][2]string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		w.sample(name, counts[key], label, key[0], "status", key[1])
+	}
+}
+
+func (metrics *fleetMetrics) write(w metricsWriter) {
+	w.header("bdmq_devices", "gauge", "Number of devices by status.")
+	for _, status := range exporterStatuses {
+		w.sample("bdmq_devices", metrics.byStatus[status], "status", status.String())
+	}
+	w.header("bdmq_devices_by_version", "gauge", "Number of devices by firmware version and status.")
+	w.groups("bdmq_devices_by_version", "version", metrics.byVersion)
+	w.header("bdmq_devices_by_country", "gauge", "Number of devices by country and status.")
+	w.groups("bdmq_devices_by_country", "country", metrics.byCountry)
+
+	w.header("bdmq_outage_duration_seconds", "histogram", "Time since each device's last probe.")
+	for idx, bound := range outageBuckets {
+		w.sample("bdmq_outage_duration_seconds_bucket", metrics.outageCounts[idx], "le", strconv.FormatFloat(bound, 'f', -1, 64))
+	}
+	total := metrics.outageCounts[len(outageBuckets)]
+	w.sample("bdmq_outage_duration_seconds_bucket", total, "le", "+Inf")
+	w.sample("bdmq_outage_duration_seconds_sum", metrics.outageSum)
+	w.sample("bdmq_outage_duration_seconds_count", total)
+}
+
+// metricsServer computes metrics from a datastore, reusing them for ttl so
+// that several Prometheus servers scraping us don't each hit the database.
+type metricsServer struct {
+	db  datastore.Datastore
+	ttl time.Duration
+	// timeout limits each datastore query. Queries don't use the context
+	// of the scrape that started them, since other scrapes may be waiting
+	// for them.
+	timeout time.Duration
+	now     func() time.Time
+
+	// mutex guards the rest of the fields. We never hold it while querying.
+	mutex          sync.Mutex
+	cached         *fleetMetrics
+	expires        time.Time
+	inFlight       *metricsQuery
+	queries        int
+	errors         int
+	lastDuration   time.Duration
+	lastSuccessful bool
+}
+
+// A metricsQuery is a datastore query that concurrent scrapes share. done is
+// closed once metrics and err are set.
+type metricsQuery struct {
+	done    chan struct{}
+	metrics *fleetMetrics
+	err     error
+}
+
+func newMetricsHandler(db datastore.Datastore, ttl, timeout time.Duration) http.Handler {
+	server := &metricsServer{db: db, ttl: ttl, timeout: timeout, now: time.Now}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server)
+	return mux
+}
+
+// refresh returns the cached metrics, or waits for them to be recomputed if
+// they've expired, starting a query unless one is already running. It stops
+// waiting when ctx is done, but the query carries on for the other scrapes.
+func (s *metricsServer) refresh(ctx context.Context) (*fleetMetrics, error) {
+	s.mutex.Lock()
+	if s.cached != nil && s.now().Before(s.expires) {
+		defer s.mutex.Unlock()
+		return s.cached, nil
+	}
+	query := s.inFlight
+	if query == nil {
+		query = &metricsQuery{done: make(chan struct{})}
+		s.inFlight = query
+		go s.query(query)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-query.done:
+		return query.metrics, query.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// query runs query against the datastore and records the outcome.
+func (s *metricsServer) query(query *metricsQuery) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	start := s.now()
+	metrics, err := collectFleetMetrics(ctx, s.db)
+	duration := s.now().Sub(start)
+
+	s.mutex.Lock()
+	s.inFlight = nil
+	s.queries++
+	s.lastDuration = duration
+	s.lastSuccessful = err == nil
+	if err != nil {
+		s.errors++
+	} else if s.ttl > 0 {
+		s.cached, s.expires = metrics, s.now().Add(s.ttl)
+	}
+	s.mutex.Unlock()
+
+	query.metrics, query.err = metrics, err
+	close(query.done)
+}
+
+func (s *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var buffer bytes.Buffer
+	writer := metricsWriter{&buffer}
+	metrics, err := s.refresh(r.Context())
+	if err != nil {
+		log.Printf("Error collecting metrics: %s", err)
+	} else {
+		metrics.write(writer)
+	}
+
+	s.mutex.Lock()
+	up := 0
+	if s.lastSuccessful {
+		up = 1
+	}
+	lastDuration, queries, errors := s.lastDuration, s.queries, s.errors
+	s.mutex.Unlock()
+
+	writer.header("bdmq_up", "gauge", "Whether the last datastore query succeeded.")
+	writer.sample("bdmq_up", up)
+	writer.header("bdmq_scrape_duration_seconds", "gauge", "How long the last datastore query took.")
+	writer.sample("bdmq_scrape_duration_seconds", lastDuration.Seconds())
+	writer.header("bdmq_scrapes_total", "counter", "Number of datastore queries, not counting scrapes answered from the cache.")
+	writer.sample("bdmq_scrapes_total", queries)
+	writer.header("bdmq_scrape_errors_total", "counter", "Number of datastore queries that failed.")
+	writer.sample("bdmq_scrape_errors_total", errors)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
+
+func (exporter) Run(args []string) error {
+	flagset := flag.NewFlagSet("exporter", flag.ContinueOnError)
+	listen := flagset.String("listen", ":9523", "Listen for HTTP requests on this address")
+	timeout := flagset.Duration("timeout", 30*time.Second, "Give up on scrapes, and on datastore queries, that take longer than this")
+	cacheTtl := flagset.Duration("cache_ttl", 15*time.Second, "Reuse metrics for this long; 0 disables caching")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if flagset.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments: %v", flagset.Args())
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	server := &http.Server{
+		Addr:    *listen,
+		Handler: http.TimeoutHandler(newMetricsHandler(db, *cacheTtl, *timeout), *timeout, "Scrape timed out\n"),
+	}
+
+	log.Printf("Serving metrics on %s", *listen)
+	return listenAndServe(server, *timeout)
+}
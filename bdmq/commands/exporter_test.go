@@ -0,0 +1,185 @@
+package commands
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+func TestExporter(t *testing.T) {
+	db, err := datastore.NewFixtureDatastore("testdata/fleet.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newMetricsHandler(db, time.Minute, time.Minute))
+	defer server.Close()
+
+	response, body := get(t, server.URL+"/metrics", nil)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Got status %d", response.StatusCode)
+	}
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Got Content-Type %s", contentType)
+	}
+	// The scrape duration depends on the wall clock.
+	var lines []string
+	for _, line := range strings.SplitAfter(body, "\n") {
+		if !strings.HasPrefix(line, "bdmq_scrape_duration_seconds ") {
+			lines = append(lines, line)
+		}
+	}
+	body = strings.Join(lines, "")
+	want := `# HELP bdmq_devices Number of devices by status.
+# TYPE bdmq_devices gauge
+bdmq_devices{status="up"} 2
+bdmq_devices{status="stale"} 1
+bdmq_devices{status="down"} 3
+# HELP bdmq_devices_by_version Number of devices by firmware version and status.
+# TYPE bdmq_devices_by_version gauge
+bdmq_devices_by_version{version="1.0",status="down"} 1
+bdmq_devices_by_version{version="1.0",status="stale"} 1
+bdmq_devices_by_version{version="1.0",status="up"} 1
+bdmq_devices_by_version{version="1.1",status="down"} 2
+bdmq_devices_by_version{version="1.1",status="up"} 1
+# HELP bdmq_devices_by_country Number of devices by country and status.
+# TYPE bdmq_devices_by_country gauge
+bdmq_devices_by_country{country="GB",status="down"} 1
+bdmq_devices_by_country{country="GB",status="up"} 1
+bdmq_devices_by_country{country="KE",status="down"} 1
+bdmq_devices_by_country{country="US",status="down"} 1
+bdmq_devices_by_country{country="US",status="stale"} 1
+bdmq_devices_by_country{country="US",status="up"} 1
+# HELP bdmq_outage_duration_seconds Time since each device's last probe.
+# TYPE bdmq_outage_duration_seconds histogram
+bdmq_outage_duration_seconds_bucket{le="60"} 2
+bdmq_outage_duration_seconds_bucket{le="90"} 2
+bdmq_outage_duration_seconds_bucket{le="300"} 3
+bdmq_outage_duration_seconds_bucket{le="600"} 3
+bdmq_outage_duration_seconds_bucket{le="1800"} 4
+bdmq_outage_duration_seconds_bucket{le="3600"} 4
+bdmq_outage_duration_seconds_bucket{le="21600"} 4
+bdmq_outage_duration_seconds_bucket{le="86400"} 4
+bdmq_outage_duration_seconds_bucket{le="604800"} 5
+bdmq_outage_duration_seconds_bucket{le="2592000"} 5
+bdmq_outage_duration_seconds_bucket{le="+Inf"} 6
+bdmq_outage_duration_seconds_sum 5574940
+bdmq_outage_duration_seconds_count 6
+# HELP bdmq_up Whether the last datastore query succeeded.
+# TYPE bdmq_up gauge
+bdmq_up 1
+# HELP bdmq_scrape_duration_seconds How long the last datastore query took.
+# TYPE bdmq_scrape_duration_seconds gauge
+# HELP bdmq_scrapes_total Number of datastore queries, not counting scrapes answered from the cache.
+# TYPE bdmq_scrapes_total counter
+bdmq_scrapes_total 1
+# HELP bdmq_scrape_errors_total Number of datastore queries that failed.
+# TYPE bdmq_scrape_errors_total counter
+bdmq_scrape_errors_total 0
+`
+	if body != want {
+		t.Errorf("Got\n%s\nwant\n%s", body, want)
+	}
+
+	if response, _ := get(t, server.URL+"/other", nil); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Got status %d for another path", response.StatusCode)
+	}
+}
+
+func TestExporterCache(t *testing.T) {
+	db, err := datastore.NewFixtureDatastore("testdata/fleet.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2013, 7, 2, 12, 0, 0, 0, time.UTC)
+	// A negative timeout makes queries fail until we fix it.
+	server := &metricsServer{db: db, ttl: time.Minute, timeout: -1, now: func() time.Time { return now }}
+
+	scrape := func(want ...string) {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Got status %d", recorder.Code)
+		}
+		for _, line := range want {
+			if !strings.Contains(recorder.Body.String(), "\n"+line+"\n") {
+				t.Errorf("Missing %s in\n%s", line, recorder.Body.String())
+			}
+		}
+	}
+
+	scrape("bdmq_up 0", "bdmq_scrapes_total 1", "bdmq_scrape_errors_total 1")
+	server.timeout = time.Minute
+	scrape("bdmq_up 1", "bdmq_scrapes_total 2", "bdmq_scrape_errors_total 1", `bdmq_devices{status="up"} 2`)
+	now = now.Add(59 * time.Second)
+	server.timeout = -1
+	scrape("bdmq_up 1", "bdmq_scrapes_total 2", `bdmq_devices{status="up"} 2`)
+	now = now.Add(time.Second)
+	server.timeout = time.Minute
+	scrape("bdmq_up 1", "bdmq_scrapes_total 3", "bdmq_scrape_errors_total 1")
+}
+
+// blockingDatastore signals started when a query starts and then waits for
+// release.
+type blockingDatastore struct {
+	datastore.Datastore
+	started, release chan struct{}
+}
+
+func (d *blockingDatastore) SelectDevices(ctx context.Context, orderBy []datastore.Identifier, order []datastore.Order, limit int, filter datastore.Filter) *datastore.DevicesIterator {
+	d.started <- struct{}{}
+	<-d.release
+	return d.Datastore.SelectDevices(ctx, orderBy, order, limit, filter)
+}
+
+// TestExporterConcurrentScrapes checks that concurrent scrapes share one
+// query, which outlives the scrape that started it.
+func TestExporterConcurrentScrapes(t *testing.T) {
+	fixture, err := datastore.NewFixtureDatastore("testdata/fleet.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &blockingDatastore{fixture, make(chan struct{}), make(chan struct{})}
+	server := &metricsServer{db: db, ttl: time.Minute, timeout: time.Minute, now: time.Now}
+
+	scrape := func(ctx context.Context) <-chan string {
+		body := make(chan string, 1)
+		go func() {
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil).WithContext(ctx))
+			body <- recorder.Body.String()
+		}()
+		return body
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := scrape(ctx)
+	<-db.started
+	second := scrape(context.Background())
+
+	// The first scrape gives up without holding up the query or the
+	// second scrape.
+	cancel()
+	if body := <-first; strings.Contains(body, "bdmq_devices{") {
+		t.Errorf("Canceled scrape returned metrics:\n%s", body)
+	}
+	close(db.release)
+	body := <-second
+	for _, line := range []string{`bdmq_devices{status="up"} 2`, "bdmq_up 1", "bdmq_scrapes_total 1"} {
+		if !strings.Contains(body, "\n"+line+"\n") {
+			t.Errorf("Missing %s in\n%s", line, body)
+		}
+	}
+	if body := <-scrape(context.Background()); !strings.Contains(body, "\nbdmq_scrapes_total 1\n") {
+		t.Errorf("Cached scrape queried again:\n%s", body)
+	}
+	select {
+	case <-db.started:
+		t.Errorf("Started a second query")
+	default:
+	}
+}
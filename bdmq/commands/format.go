@@ -0,0 +1,275 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var outputFormat string
+
+func init() {
+	flag.StringVar(&outputFormat, "format", "table", "Output format: table, json, jsonl or csv")
+}
+
+func isTableFormat() bool {
+	return outputFormat == "table"
+}
+
+// A recordWriter renders a sequence of records with the same named fields.
+// Field names are lower case with underscores, e.g., "last_probe"; they
+// become the keys of JSON objects, the header of CSV files and the (upper
+// cased) column titles of tables.
+type recordWriter interface {
+	WriteRecord(values ...interface{}) error
+	Flush() error
+}
+
+func newRecordWriter(writer io.Writer, fields ...string) (recordWriter, error) {
+	switch outputFormat {
+	case "table":
+		return newTableWriter(writer, fields), nil
+	case "json":
+		return &jsonWriter{writer: writer, fields: fields}, nil
+	case "jsonl":
+		return &jsonLinesWriter{writer: writer, fields: fields}, nil
+	case "csv":
+		return newCsvWriter(writer, fields)
+	default:
+		return nil, fmt.Errorf("Invalid output format: %s", outputFormat)
+	}
+}
+
+// Values implementing structuredValuer render differently in tables than in
+// machine-readable formats.
+type structuredValuer interface {
+	StructuredValue() interface{}
+}
+
+func tableValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05")
+	default:
+		return value
+	}
+}
+
+func structuredValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case structuredValuer:
+		return v.StructuredValue()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return value
+	}
+}
+
+type percentage struct {
+	numerator, denominator int
+}
+
+func (p percentage) value() float64 {
+	if p.denominator == 0 {
+		return 0
+	}
+	return float64(p.numerator) / float64(p.denominator) * 100
+}
+
+func (p percentage) String() string {
+	return fmt.Sprintf("%d%%", int(p.value()))
+}
+
+func (p percentage) StructuredValue() interface{} {
+	return p.value()
+}
+
+// A durationValue renders as text (e.g., Postgres's textual interval) in
+// tables and as a number of seconds elsewhere.
+type durationValue struct {
+	duration time.Duration
+	text     string
+}
+
+func (d durationValue) String() string {
+	return d.text
+}
+
+func (d durationValue) StructuredValue() interface{} {
+	return int64(d.duration.Seconds())
+}
+
+// An asnValue is an AS number, or 0 if it's unknown.
+type asnValue int
+
+func (a asnValue) String() string {
+	if a == 0 {
+		return ""
+	}
+	return fmt.Sprintf("AS%d", int(a))
+}
+
+func (a asnValue) StructuredValue() interface{} {
+	if a == 0 {
+		return nil
+	}
+	return int(a)
+}
+
+func checkRecordLength(fields []string, values []interface{}) error {
+	if len(fields) != len(values) {
+		return fmt.Errorf("Record has %d values but %d fields", len(values), len(fields))
+	}
+	return nil
+}
+
+type tableWriter struct {
+	writer *tabwriter.Writer
+	fields []string
+}
+
+// fieldTitle returns the column title of a field, e.g., "LAST PROBE".
+func fieldTitle(field string) string {
+	return strings.ToUpper(strings.Replace(field, "_", " ", -1))
+}
+
+func newTableWriter(writer io.Writer, fields []string) *tableWriter {
+	tw := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+	titles := make([]interface{}, len(fields))
+	for idx, field := range fields {
+		titles[idx] = fieldTitle(field)
+	}
+	fprintWithTabs(tw, titles...)
+	return &tableWriter{tw, fields}
+}
+
+func (w *tableWriter) WriteRecord(values ...interface{}) error {
+	if err := checkRecordLength(w.fields, values); err != nil {
+		return err
+	}
+	formatted := make([]interface{}, len(values))
+	for idx, value := range values {
+		formatted[idx] = tableValue(value)
+	}
+	_, err := fprintWithTabs(w.writer, formatted...)
+	return err
+}
+
+func (w *tableWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+func marshalRecord(fields []string, values []interface{}) ([]byte, error) {
+	if err := checkRecordLength(fields, values); err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for idx, field := range fields {
+		if idx > 0 {
+			buffer.WriteByte(',')
+		}
+		key, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(structuredValue(values[idx]))
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// jsonWriter writes all records as a single JSON array.
+type jsonWriter struct {
+	writer  io.Writer
+	fields  []string
+	started bool
+}
+
+func (w *jsonWriter) WriteRecord(values ...interface{}) error {
+	encoded, err := marshalRecord(w.fields, values)
+	if err != nil {
+		return err
+	}
+	separator := ",\n"
+	if !w.started {
+		separator = "[\n"
+		w.started = true
+	}
+	_, err = fmt.Fprintf(w.writer, "%s  %s", separator, encoded)
+	return err
+}
+
+func (w *jsonWriter) Flush() error {
+	if !w.started {
+		_, err := fmt.Fprintln(w.writer, "[]")
+		return err
+	}
+	_, err := fmt.Fprintln(w.writer, "\n]")
+	return err
+}
+
+// jsonLinesWriter writes one JSON object per line.
+type jsonLinesWriter struct {
+	writer io.Writer
+	fields []string
+}
+
+func (w *jsonLinesWriter) WriteRecord(values ...interface{}) error {
+	encoded, err := marshalRecord(w.fields, values)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.writer, "%s\n", encoded)
+	return err
+}
+
+func (w *jsonLinesWriter) Flush() error {
+	return nil
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+	fields []string
+}
+
+func newCsvWriter(writer io.Writer, fields []string) (*csvWriter, error) {
+	cw := csv.NewWriter(writer)
+	if err := cw.Write(fields); err != nil {
+		return nil, err
+	}
+	return &csvWriter{cw, fields}, nil
+}
+
+func (w *csvWriter) WriteRecord(values ...interface{}) error {
+	if err := checkRecordLength(w.fields, values); err != nil {
+		return err
+	}
+	row := make([]string, len(values))
+	for idx, value := range values {
+		if v := structuredValue(value); v != nil {
+			row[idx] = fmt.Sprint(v)
+		}
+	}
+	return w.writer.Write(row)
+}
+
+func (w *csvWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"os"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+func writeExampleRecords(format string) {
+	outputFormat = format
+	defer func() { outputFormat = "table" }()
+
+	writer, err := newRecordWriter(os.Stdout, "node_id", "last_probe", "status", "outage_duration", "percentage")
+	if err != nil {
+		panic(err)
+	}
+	lastProbe := time.Date(2013, 7, 2, 12, 21, 0, 0, time.UTC)
+	outage := durationValue{26 * time.Hour, "1 day 02:00:00"}
+	if err := writer.WriteRecord("OW0123456789AB", lastProbe, datastore.Offline, outage, percentage{1, 4}); err != nil {
+		panic(err)
+	}
+	if err := writer.WriteRecord("OWBA9876543210", lastProbe, datastore.Online, durationValue{0, "00:00:00"}, percentage{3, 4}); err != nil {
+		panic(err)
+	}
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+func Example_tableFormat() {
+	writeExampleRecords("table")
+
+	// Output:
+	//
+	// NODE ID         LAST PROBE           STATUS  OUTAGE DURATION  PERCENTAGE
+	// OW0123456789AB  2013-07-02 12:21:00  down    1 day 02:00:00   25%
+	// OWBA9876543210  2013-07-02 12:21:00  up      00:00:00         75%
+}
+
+func Example_jsonFormat() {
+	writeExampleRecords("json")
+
+	// Output:
+	//
+	// [
+	//   {"node_id":"OW0123456789AB","last_probe":"2013-07-02T12:21:00Z","status":"down","outage_duration":93600,"percentage":25},
+	//   {"node_id":"OWBA9876543210","last_probe":"2013-07-02T12:21:00Z","status":"up","outage_duration":0,"percentage":75}
+	// ]
+}
+
+func Example_jsonLinesFormat() {
+	writeExampleRecords("jsonl")
+
+	// Output:
+	//
+	// {"node_id":"OW0123456789AB","last_probe":"2013-07-02T12:21:00Z","status":"down","outage_duration":93600,"percentage":25}
+	// {"node_id":"OWBA9876543210","last_probe":"2013-07-02T12:21:00Z","status":"up","outage_duration":0,"percentage":75}
+}
+
+func Example_csvFormat() {
+	writeExampleRecords("csv")
+
+	// Output:
+	//
+	// node_id,last_probe,status,outage_duration,percentage
+	// OW0123456789AB,2013-07-02T12:21:00Z,down,93600,25
+	// OWBA9876543210,2013-07-02T12:21:00Z,up,0,75
+}
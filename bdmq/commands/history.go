@@ -0,0 +1,172 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type history struct{}
+
+func NewHistory() BdmCommand {
+	return new(history)
+}
+
+func (history) Name() string {
+	return "history"
+}
+
+func (history) Description() string {
+	return "Show when a device was online and offline: history <node> [--since=<time>] [--until=<time>]"
+}
+
+// A historyInterval is a period during which a device was either online,
+// sending probes from a single IP address, or offline.
+type historyInterval struct {
+	Online     bool
+	Start, End time.Time
+	IpAddress  string
+}
+
+// collapseProbes turns a node's probes into a sequence of intervals covering
+// [since, until]. A device is online between two probes (and between the edges
+// of the window and its first and last probes) if they are no more than
+// threshold apart; otherwise it's offline. An online interval also ends when
+// the device's IP address changes.
+func collapseProbes(probes []*datastore.ProbesResult, since, until time.Time, threshold time.Duration) []historyInterval {
+	var intervals []historyInterval
+	var current *historyInterval
+	for _, probe := range probes {
+		timestamp := probe.Timestamp
+		switch {
+		case current == nil:
+			start := timestamp
+			if timestamp.Sub(since) <= threshold {
+				start = since
+			} else {
+				intervals = append(intervals, historyInterval{false, since, timestamp, ""})
+			}
+			current = &historyInterval{true, start, timestamp, probe.IpAddress}
+		case timestamp.Sub(current.End) > threshold:
+			intervals = append(intervals, *current, historyInterval{false, current.End, timestamp, ""})
+			current = &historyInterval{true, timestamp, timestamp, probe.IpAddress}
+		case probe.IpAddress != current.IpAddress:
+			current.End = timestamp
+			intervals = append(intervals, *current)
+			current = &historyInterval{true, timestamp, timestamp, probe.IpAddress}
+		default:
+			current.End = timestamp
+		}
+	}
+	switch {
+	case current == nil:
+		intervals = append(intervals, historyInterval{false, since, until, ""})
+	case until.Sub(current.End) <= threshold:
+		current.End = until
+		intervals = append(intervals, *current)
+	default:
+		intervals = append(intervals, *current, historyInterval{false, current.End, until, ""})
+	}
+	return intervals
+}
+
+var historyFields = []string{"state", "start", "end", "duration", "ip_address", "percentage"}
+
+// historyRecords describes each interval with historyFields, followed by a
+// record of the device's availability over [since, until].
+func historyRecords(intervals []historyInterval, since, until time.Time) [][]interface{} {
+	window := until.Sub(since)
+	var records [][]interface{}
+	var online time.Duration
+	for _, interval := range intervals {
+		state := "offline"
+		if interval.Online {
+			state = "online"
+			online += interval.End.Sub(interval.Start)
+		}
+		duration := interval.End.Sub(interval.Start)
+		records = append(records, []interface{}{state, interval.Start, interval.End, durationValue{duration, duration.String()}, interval.IpAddress, percentage{int(duration.Seconds()), int(window.Seconds())}})
+	}
+	return append(records, []interface{}{"availability", since, until, durationValue{online, online.String()}, "", percentage{int(online.Seconds()), int(window.Seconds())}})
+}
+
+// selectProbes returns a node's probes in [since, until) ordered by time.
+func selectProbes(ctx context.Context, db datastore.Datastore, nodeId string, since, until time.Time) ([]*datastore.ProbesResult, error) {
+	var probes []*datastore.ProbesResult
+	results := db.SelectProbes(ctx, nodeId, since, until)
+	defer results.Close()
+	for results.Next() {
+		probes = append(probes, results.Result())
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	return probes, nil
+}
+
+func (history) Run(args []string) error {
+	flagset := flag.NewFlagSet("history", flag.ContinueOnError)
+	sinceText := flagset.String("since", "", "Show history starting at this time (default: one week before --until)")
+	untilText := flagset.String("until", "", "Show history until this time (default: now)")
+	threshold := flagset.Duration("outage_threshold", 10*time.Minute, "Consider a device offline when the time between two of its probes is longer than this threshold")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if flagset.NArg() < 1 {
+		return fmt.Errorf("Usage: history <node> [--since=<time>] [--until=<time>]")
+	}
+	nodeId := flagset.Arg(0)
+	if err := flagset.Parse(flagset.Args()[1:]); err != nil {
+		return err
+	}
+	if flagset.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments: %v", flagset.Args())
+	}
+
+	until := time.Now()
+	if *untilText != "" {
+		parsed, err := parseTimestamp(*untilText)
+		if err != nil {
+			return err
+		}
+		until = parsed
+	}
+	since := until.AddDate(0, 0, -7)
+	if *sinceText != "" {
+		parsed, err := parseTimestamp(*sinceText)
+		if err != nil {
+			return err
+		}
+		since = parsed
+	}
+	if !since.Before(until) {
+		return fmt.Errorf("--since must be before --until")
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	probes, err := selectProbes(ctx, db, nodeId, since, until)
+	if err != nil {
+		return err
+	}
+
+	writer, err := newRecordWriter(output, historyFields...)
+	if err != nil {
+		return err
+	}
+	for _, values := range historyRecords(collapseProbes(probes, since, until, *threshold), since, until) {
+		if err := writer.WriteRecord(values...); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
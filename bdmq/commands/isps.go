@@ -0,0 +1,19 @@
+package commands
+
+type isps struct{}
+
+func NewIsps() BdmCommand {
+	return new(isps)
+}
+
+func (isps) Name() string {
+	return "isps"
+}
+
+func (isps) Description() string {
+	return "Summarize ISPs by AS number; same as summarize by asn,isp [where ...]"
+}
+
+func (isps) Run(args []string) error {
+	return runSummarize("isps", "asn,isp", args)
+}
@@ -2,91 +2,514 @@ package commands
 
 import (
 	"fmt"
-	"github.com/sburnett/bismark-tools/bdmq/datastore"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+// The device query language looks like
+//
+//	[where <expr>] [order by <ident> [asc|desc], ...] [limit <n>]
+//
+// where <expr> combines comparisons like "country = us", "outage > 2d",
+// "version in (1.0, 1.1)", "ip in 143.215/16", "tag = cohort2013" or
+// "attr.partner = gatech" with and, or, not and parentheses. and binds more
+// tightly than or. Tags and attributes come from the node registry.
+
+type tokenKind int
+
+const (
+	wordToken tokenKind = iota
+	stringToken
+	operatorToken
+	punctuationToken
+	endToken
 )
 
-func matchDeviceQuery(query string) ([]string, []string) {
-	statusFilter := `(?:status|state) (?:=|is) (?P<status>[a-z]+)`
-	nodeFilter := `(?:node|id|node_id) (?:=|is|like) (?P<node>[a-z0-9]+)`
-	ipFilter := `(?:ip|address|ip_address) (?:=|is|in) (?P<ip>[0-9a-f.:/]+)`
-	countryFilter := `(?:country|country_code) (?:=|is) (?P<country>..)`
-	versionFilter := `(?:version|bversion) (?:=|is) (?P<version>[0-9.\-]+)`
-	whereFilters := `(?:` + statusFilter + `|` + nodeFilter + `|` + ipFilter + `|` + countryFilter + `|` + versionFilter + `)`
-	wherePatterns := `where (?:` + whereFilters + `)(?: and ` + whereFilters + `)*`
-	orderPattern := `(?P<order>[a-z]+)(?: (?P<desc>desc|asc))?`
-	orderPatterns := `order by (?:` + orderPattern + `)(?:, *` + orderPattern + `)*`
-	limitPattern := `limit (?P<limit>\d+)`
-	argsPattern := `^(?:` + wherePatterns + `)? *(?:` + orderPatterns + `)? *(?:` + limitPattern + `)?$`
-	matcher := regexp.MustCompile(argsPattern)
-	matches := matcher.FindStringSubmatch(strings.ToLower(query))
-	return matches, matcher.SubexpNames()
+type token struct {
+	kind     tokenKind
+	text     string
+	position int
 }
 
-type DeviceQuery struct {
-	OrderBy       []datastore.Identifier
-	Order         []datastore.Order
-	Limit         int
-	NodeLike      string
-	IpWithin      string
-	CountryCode   string
-	VersionEquals string
-	StatusEquals  *datastore.DeviceStatus
+func (tok token) describe() string {
+	if tok.kind == endToken {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q at position %d", tok.text, tok.position+1)
 }
 
-func parseDeviceQuery(query string) (*DeviceQuery, error) {
-	var queryParameters DeviceQuery
+func (tok token) isKeyword(keywords ...string) bool {
+	if tok.kind != wordToken {
+		return false
+	}
+	for _, keyword := range keywords {
+		if strings.EqualFold(tok.text, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._:/-+", r)
+}
+
+func tokenizeQuery(query string) ([]token, error) {
+	var tokens []token
+	runes := []rune(query)
+	for idx := 0; idx < len(runes); {
+		r := runes[idx]
+		switch {
+		case unicode.IsSpace(r):
+			idx++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, token{punctuationToken, string(r), idx})
+			idx++
+		case strings.ContainsRune("=!<>", r):
+			start := idx
+			idx++
+			if idx < len(runes) && strings.ContainsRune("=>", runes[idx]) {
+				idx++
+			}
+			text := string(runes[start:idx])
+			switch text {
+			case "=", "==", "!=", "<>", "<", "<=", ">", ">=":
+				tokens = append(tokens, token{operatorToken, text, start})
+			default:
+				return nil, fmt.Errorf("Invalid query: unknown operator %q at position %d", text, start+1)
+			}
+		case r == '\'' || r == '"':
+			start := idx
+			idx++
+			for idx < len(runes) && runes[idx] != r {
+				idx++
+			}
+			if idx >= len(runes) {
+				return nil, fmt.Errorf("Invalid query: unterminated string at position %d", start+1)
+			}
+			tokens = append(tokens, token{stringToken, string(runes[start+1 : idx]), start})
+			idx++
+		case isWordRune(r):
+			start := idx
+			for idx < len(runes) && isWordRune(runes[idx]) {
+				idx++
+			}
+			tokens = append(tokens, token{wordToken, string(runes[start:idx]), start})
+		default:
+			return nil, fmt.Errorf("Invalid query: unexpected character %q at position %d", r, idx+1)
+		}
+	}
+	return append(tokens, token{endToken, "", len(runes)}), nil
+}
 
-	matches, names := matchDeviceQuery(query)
-	if matches == nil {
-		return nil, fmt.Errorf("Invalid query")
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != endToken {
+		p.pos++
 	}
+	return tok
+}
 
-	for idx, match := range matches {
-		if match == "" {
-			continue
+func (p *queryParser) errorf(tok token, format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid query: %s near %s", fmt.Sprintf(format, args...), tok.describe())
+}
+
+func (p *queryParser) expectKeyword(keyword string) error {
+	if tok := p.next(); !tok.isKeyword(keyword) {
+		return p.errorf(tok, "expected %q", keyword)
+	}
+	return nil
+}
+
+func (p *queryParser) expectPunctuation(text string) error {
+	if tok := p.next(); tok.kind != punctuationToken || tok.text != text {
+		return p.errorf(tok, "expected %q", text)
+	}
+	return nil
+}
+
+// parseOr parses <and> [or <and> ...]
+func (p *queryParser) parseOr() (datastore.Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
 		}
-		switch names[idx] {
-		case "status":
-			statusConstraint, err := parseDeviceStatus(match)
-			if err != nil {
-				return nil, err
-			}
-			queryParameters.StatusEquals = &statusConstraint
-		case "node":
-			queryParameters.NodeLike = match
-		case "ip":
-			queryParameters.IpWithin = match
-		case "country":
-			queryParameters.CountryCode = strings.ToUpper(match)
-		case "version":
-			queryParameters.VersionEquals = match
-		case "order":
-			orderBy, err := parseIdentifier(match)
+		left = &datastore.OrFilter{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// parseAnd parses <not> [and <not> ...]
+func (p *queryParser) parseAnd() (datastore.Filter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &datastore.AndFilter{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// parseNot parses [not] <comparison> or [not] (<or>)
+func (p *queryParser) parseNot() (datastore.Filter, error) {
+	if p.peek().isKeyword("not") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &datastore.NotFilter{Operand: operand}, nil
+	}
+	if tok := p.peek(); tok.kind == punctuationToken && tok.text == "(" {
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunctuation(")"); err != nil {
+			return nil, err
+		}
+		return filter, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (datastore.Filter, error) {
+	fieldToken := p.next()
+	if fieldToken.kind != wordToken {
+		return nil, p.errorf(fieldToken, "expected a field name")
+	}
+	field, err := parseFilterField(strings.ToLower(fieldToken.text))
+	if err != nil {
+		return nil, p.errorf(fieldToken, "%s", err)
+	}
+
+	var operator datastore.Operator
+	negate := false
+	operatorToken := p.next()
+	switch {
+	case operatorToken.text == "=" || operatorToken.text == "==":
+		operator = datastore.Equals
+	case operatorToken.text == "!=" || operatorToken.text == "<>":
+		operator = datastore.NotEquals
+	case operatorToken.text == "<":
+		operator = datastore.LessThan
+	case operatorToken.text == "<=":
+		operator = datastore.LessOrEqual
+	case operatorToken.text == ">":
+		operator = datastore.GreaterThan
+	case operatorToken.text == ">=":
+		operator = datastore.GreaterOrEqual
+	case operatorToken.isKeyword("is"):
+		operator = datastore.Equals
+		if p.peek().isKeyword("not") {
+			p.next()
+			operator = datastore.NotEquals
+		}
+	case operatorToken.isKeyword("like"):
+		if field != datastore.NodeIdField {
+			return nil, p.errorf(operatorToken, "only %s supports like", datastore.NodeIdField)
+		}
+		operator = datastore.Equals
+	case operatorToken.isKeyword("not"):
+		if err := p.expectKeyword("in"); err != nil {
+			return nil, err
+		}
+		negate = true
+		fallthrough
+	case operatorToken.isKeyword("in"):
+		operator = datastore.Equals
+		if tok := p.peek(); tok.kind == punctuationToken && tok.text == "(" {
+			operator = datastore.In
+		}
+	default:
+		return nil, p.errorf(operatorToken, "expected a comparison operator after %s", field)
+	}
+	if operator != datastore.Equals && operator != datastore.NotEquals && operator != datastore.In && !field.Ordered() {
+		return nil, p.errorf(operatorToken, "%s can't be compared with %s", field, operator)
+	}
+
+	var values []interface{}
+	if operator == datastore.In {
+		p.next()
+		for {
+			value, err := p.parseValue(field)
 			if err != nil {
 				return nil, err
 			}
-			queryParameters.OrderBy = append(queryParameters.OrderBy, orderBy)
-			queryParameters.Order = append(queryParameters.Order, datastore.Ascending)
-		case "desc":
-			order, err := parseOrder(match)
-			if err != nil {
-				return nil, err
+			values = append(values, value)
+			if tok := p.peek(); tok.kind != punctuationToken || tok.text != "," {
+				break
 			}
-			queryParameters.Order[len(queryParameters.Order)-1] = order
-		case "limit":
-			limit, err := strconv.Atoi(match)
-			if err != nil {
-				return nil, err
+			p.next()
+		}
+		if err := p.expectPunctuation(")"); err != nil {
+			return nil, err
+		}
+	} else {
+		value, err := p.parseValue(field)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	var filter datastore.Filter = &datastore.Comparison{Field: field, Operator: operator, Values: values}
+	if field == datastore.AttributeField {
+		attribute := strings.ToLower(fieldToken.text[strings.Index(fieldToken.text, ".")+1:])
+		filter = &datastore.AttributeComparison{Attribute: attribute, Operator: operator, Values: values}
+	}
+	if negate {
+		filter = &datastore.NotFilter{Operand: filter}
+	}
+	return filter, nil
+}
+
+func (p *queryParser) parseValue(field datastore.Field) (interface{}, error) {
+	tok := p.next()
+	if tok.kind != wordToken && tok.kind != stringToken {
+		return nil, p.errorf(tok, "expected a value for %s", field)
+	}
+	value, err := parseFilterValue(field, tok.text)
+	if err != nil {
+		return nil, p.errorf(tok, "%s", err)
+	}
+	return value, nil
+}
+
+func (p *queryParser) parseOrderBy(queryParameters *DeviceQuery) error {
+	for {
+		tok := p.next()
+		if tok.kind != wordToken {
+			return p.errorf(tok, "expected an identifier")
+		}
+		orderBy, err := parseIdentifier(strings.ToLower(tok.text))
+		if err != nil {
+			return p.errorf(tok, "%s", err)
+		}
+		queryParameters.OrderBy = append(queryParameters.OrderBy, orderBy)
+		queryParameters.Order = append(queryParameters.Order, datastore.Ascending)
+		if tok := p.peek(); tok.kind == wordToken {
+			if order, err := parseOrder(strings.ToLower(tok.text)); err == nil {
+				p.next()
+				queryParameters.Order[len(queryParameters.Order)-1] = order
 			}
-			queryParameters.Limit = limit
 		}
+		if tok := p.peek(); tok.kind != punctuationToken || tok.text != "," {
+			return nil
+		}
+		p.next()
+	}
+}
+
+type DeviceQuery struct {
+	OrderBy []datastore.Identifier
+	Order   []datastore.Order
+	Limit   int
+	// Filter is nil if the query has no where clause.
+	Filter datastore.Filter
+}
+
+func parseDeviceQuery(query string) (*DeviceQuery, error) {
+	var queryParameters DeviceQuery
+
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+
+	if p.peek().isKeyword("where") {
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		queryParameters.Filter = filter
+	}
+	if p.peek().isKeyword("order") {
+		p.next()
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if err := p.parseOrderBy(&queryParameters); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek().isKeyword("limit") {
+		p.next()
+		tok := p.next()
+		limit, err := strconv.Atoi(tok.text)
+		if tok.kind != wordToken || err != nil || limit < 0 {
+			return nil, p.errorf(tok, "expected a non-negative limit")
+		}
+		queryParameters.Limit = limit
+	}
+	if tok := p.peek(); tok.kind != endToken {
+		return nil, p.errorf(tok, "unexpected token")
+	}
+	return &queryParameters, nil
+}
+
+type SummaryQuery struct {
+	GroupBy []datastore.Field
+	// Filter is nil if the query has no where clause.
+	Filter datastore.Filter
+}
+
+// parseSummaryQuery parses by <field>[, <field> ...] [where <filter>]
+func parseSummaryQuery(query string) (*SummaryQuery, error) {
+	var queryParameters SummaryQuery
+
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+
+	if err := p.expectKeyword("by"); err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.next()
+		if tok.kind != wordToken {
+			return nil, p.errorf(tok, "expected a field name")
+		}
+		field, err := parseFilterField(strings.ToLower(tok.text))
+		if err != nil {
+			return nil, p.errorf(tok, "%s", err)
+		}
+		if !field.Groupable() {
+			return nil, p.errorf(tok, "can't group by %s", field)
+		}
+		queryParameters.GroupBy = append(queryParameters.GroupBy, field)
+		if tok := p.peek(); tok.kind != punctuationToken || tok.text != "," {
+			break
+		}
+		p.next()
+	}
+	if p.peek().isKeyword("where") {
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		queryParameters.Filter = filter
+	}
+	if tok := p.peek(); tok.kind != endToken {
+		return nil, p.errorf(tok, "unexpected token")
 	}
 	return &queryParameters, nil
 }
 
+// Keywords of the query language, for completion.
+var queryKeywords = []string{"where", "order", "by", "limit", "and", "or", "not", "in", "is", "like", "asc", "desc"}
+
+// filterFieldNames lists the names parseFilterField accepts, besides
+// attributes, for completion.
+var filterFieldNames = []string{"status", "state", "node", "id", "node_id", "ip", "address", "ip_address", "country", "country_code", "version", "bversion", "asn", "as", "isp", "city", "tag", "tags", "last", "last_probe", "outage", "duration", "outage_duration"}
+
+// parseFilterField parses the name of a field, or attr.<name> for a registry
+// attribute.
+func parseFilterField(text string) (datastore.Field, error) {
+	if idx := strings.Index(text, "."); idx > 0 && idx < len(text)-1 {
+		switch text[:idx] {
+		case "attr", "attribute":
+			return datastore.AttributeField, nil
+		}
+	}
+	switch text {
+	case "status", "state":
+		return datastore.StatusField, nil
+	case "node", "id", "node_id":
+		return datastore.NodeIdField, nil
+	case "ip", "address", "ip_address":
+		return datastore.IpAddressField, nil
+	case "country", "country_code":
+		return datastore.CountryField, nil
+	case "version", "bversion":
+		return datastore.VersionField, nil
+	case "asn", "as":
+		return datastore.AsnField, nil
+	case "isp":
+		return datastore.IspField, nil
+	case "city":
+		return datastore.CityField, nil
+	case "tag", "tags":
+		return datastore.TagField, nil
+	case "last", "last_probe":
+		return datastore.LastProbeField, nil
+	case "outage", "duration", "outage_duration":
+		return datastore.OutageDurationField, nil
+	default:
+		return datastore.NodeIdField, fmt.Errorf("Invalid field: %s", text)
+	}
+}
+
+func parseFilterValue(field datastore.Field, text string) (interface{}, error) {
+	switch field {
+	case datastore.StatusField:
+		return parseDeviceStatus(strings.ToLower(text))
+	case datastore.IpAddressField:
+		if _, _, err := datastore.ParsePrefix(text); err != nil {
+			return nil, err
+		}
+		return text, nil
+	case datastore.CountryField:
+		return strings.ToUpper(text), nil
+	case datastore.AsnField:
+		asn, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(text), "AS"))
+		if err != nil || asn < 0 {
+			return nil, fmt.Errorf("Invalid AS number: %s", text)
+		}
+		return asn, nil
+	case datastore.LastProbeField:
+		return parseTimestamp(text)
+	case datastore.OutageDurationField:
+		return datastore.ParseDuration(text)
+	default:
+		return text, nil
+	}
+}
+
+func parseTimestamp(text string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if timestamp, err := time.Parse(layout, text); err == nil {
+			return timestamp, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid timestamp: %s", text)
+}
+
+// deviceStatusNames lists the names parseDeviceStatus accepts, for
+// completion.
+var deviceStatusNames = []string{"up", "online", "on", "available", "stale", "late", "down", "offline", "off", "unavailable"}
+
 func parseDeviceStatus(text string) (datastore.DeviceStatus, error) {
 	switch text {
 	case "up", "online", "on", "available":
@@ -100,6 +523,9 @@ func parseDeviceStatus(text string) (datastore.DeviceStatus, error) {
 	}
 }
 
+// identifierNames lists the names parseIdentifier accepts, for completion.
+var identifierNames = []string{"id", "node", "ip", "address", "ip_address", "version", "bversion", "last", "last_probe", "next", "next_probe", "status", "outage", "duration", "outage_duration"}
+
 func parseIdentifier(text string) (datastore.Identifier, error) {
 	switch text {
 	case "id", "node":
@@ -0,0 +1,151 @@
+package commands
+
+import (
+	"fmt"
+)
+
+func printDeviceQuery(query string) {
+	params, err := parseDeviceQuery(query)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("filter:", params.Filter)
+	fmt.Println("order by:", params.OrderBy, params.Order)
+	fmt.Println("limit:", params.Limit)
+}
+
+func ExampleDeviceQuery_empty() {
+	printDeviceQuery("")
+
+	// Output:
+	//
+	// filter: <nil>
+	// order by: [] []
+	// limit: 0
+}
+
+func ExampleDeviceQuery_legacy() {
+	printDeviceQuery("where status is up and country = us order by status,id desc limit 10")
+
+	// Output:
+	//
+	// filter: status = up AND country = US
+	// order by: [last_probe id] [ASC DESC]
+	// limit: 10
+}
+
+func ExampleDeviceQuery_ipPrefix() {
+	printDeviceQuery("where ip in 143.215/16 order by ip,duration")
+
+	// Output:
+	//
+	// filter: ip = 143.215/16
+	// order by: [ip outage_duration] [ASC ASC]
+	// limit: 0
+}
+
+func ExampleDeviceQuery_boolean() {
+	printDeviceQuery("where (country = us or country = gb) and not version = 1.0")
+
+	// Output:
+	//
+	// filter: (country = US OR country = GB) AND (NOT version = 1.0)
+	// order by: [] []
+	// limit: 0
+}
+
+func ExampleDeviceQuery_precedence() {
+	printDeviceQuery("where id like abc or status = down and outage > 2d")
+
+	// Output:
+	//
+	// filter: id = abc OR (status = down AND outage_duration > 48h0m0s)
+	// order by: [] []
+	// limit: 0
+}
+
+func ExampleDeviceQuery_inList() {
+	printDeviceQuery("where version in (1.0, '1.1') and country not in (us, gb) and last_probe >= 2013-07-01")
+
+	// Output:
+	//
+	// filter: (version IN (1.0, 1.1) AND (NOT country IN (US, GB))) AND last_probe >= 2013-07-01T00:00:00Z
+	// order by: [] []
+	// limit: 0
+}
+
+func ExampleDeviceQuery_location() {
+	printDeviceQuery(`where asn in (AS7922, 2637) and isp != "Safaricom Limited" and city = Atlanta`)
+	printDeviceQuery("where asn = comcast")
+
+	// Output:
+	//
+	// filter: (asn IN (7922, 2637) AND isp != Safaricom Limited) AND city = Atlanta
+	// order by: [] []
+	// limit: 0
+	// Invalid query: Invalid AS number: comcast near "comcast" at position 13
+}
+
+func ExampleDeviceQuery_registry() {
+	printDeviceQuery("where tag = cohort2013 and attr.Partner in (gatech, 'Nairobi Uni')")
+	printDeviceQuery("where tag > cohort2013")
+
+	// Output:
+	//
+	// filter: tag = cohort2013 AND attr.partner IN (gatech, Nairobi Uni)
+	// order by: [] []
+	// limit: 0
+	// Invalid query: tag can't be compared with > near ">" at position 11
+}
+
+func ExampleDeviceQuery_errors() {
+	printDeviceQuery("where country = us and")
+	printDeviceQuery("where colour = red")
+	printDeviceQuery("where country > us")
+	printDeviceQuery("where (status = up")
+	printDeviceQuery("where outage > 2 days")
+	printDeviceQuery("where ip = bogus")
+	printDeviceQuery("order status")
+	printDeviceQuery("limit ten")
+	printDeviceQuery("where id = 'abc")
+
+	// Output:
+	//
+	// Invalid query: expected a field name near end of query
+	// Invalid query: Invalid field: colour near "colour" at position 7
+	// Invalid query: country can't be compared with > near ">" at position 15
+	// Invalid query: expected ")" near end of query
+	// Invalid query: Invalid duration: 2 near "2" at position 16
+	// Invalid query: Invalid IP address: bogus near "bogus" at position 12
+	// Invalid query: expected "by" near "status" at position 7
+	// Invalid query: expected a non-negative limit near "ten" at position 7
+	// Invalid query: unterminated string at position 12
+}
+
+func ExampleSummaryQuery() {
+	for _, query := range []string{
+		"by version",
+		"by country, status where version = 1.0",
+		"where version = 1.0",
+		"by last_probe",
+		"by version order by version",
+		"by tag",
+	} {
+		params, err := parseSummaryQuery(query)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println("group by:", params.GroupBy, "filter:", params.Filter)
+	}
+
+	// Output:
+	//
+	// group by: [version] filter: <nil>
+	// group by: [country status] filter: version = 1.0
+	// Invalid query: expected "by" near "where" at position 1
+	// Invalid query: can't group by last_probe near "last_probe" at position 4
+	// Invalid query: unexpected token near "order" at position 12
+	// Invalid query: can't group by tag near "tag" at position 4
+}
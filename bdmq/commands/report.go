@@ -0,0 +1,412 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+	"github.com/sburnett/bismark-tools/common/atomicfile"
+)
+
+type report struct{}
+
+func NewReport() BdmCommand {
+	return new(report)
+}
+
+func (report) Name() string {
+	return "report"
+}
+
+func (report) Description() string {
+	return "Write the fleet's status as an HTML site with JSON sidecars into a dated directory: report --out=<dir> [--history_days=<days>]"
+}
+
+// A reportTable is a table on a report page. Its records are rendered like
+// tables in HTML and like --format=json in the page's JSON sidecar.
+type reportTable struct {
+	Title   string
+	name    string
+	fields  []string
+	records [][]interface{}
+}
+
+// A reportPage is one page of the site. Root is the path from the page's
+// directory to the top of the site.
+type reportPage struct {
+	Title     string
+	Root      string
+	Generated time.Time
+	Tables    []*reportTable
+}
+
+type reportCell struct {
+	Text, Link string
+}
+
+// Headers returns the column titles of the table.
+func (t *reportTable) Headers() []string {
+	var headers []string
+	for _, field := range t.fields {
+		headers = append(headers, fieldTitle(field))
+	}
+	return headers
+}
+
+// Rows formats the table's records like tableWriter, linking node IDs to
+// their device pages.
+func (t *reportTable) Rows(root string) [][]reportCell {
+	var rows [][]reportCell
+	for _, record := range t.records {
+		var row []reportCell
+		for idx, value := range record {
+			cell := reportCell{Text: fmt.Sprint(tableValue(value))}
+			if t.fields[idx] == "node_id" {
+				cell.Link = root + "devices/" + cell.Text + ".html"
+			}
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (t *reportTable) writeJson(buffer *bytes.Buffer) error {
+	writer := &jsonWriter{writer: buffer, fields: t.fields}
+	for _, record := range t.records {
+		if err := writer.WriteRecord(record...); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// sidecar returns the page's JSON: the same array as --format=json for pages
+// with one table, or an object with an array for each table.
+func (page *reportPage) sidecar() ([]byte, error) {
+	var buffer bytes.Buffer
+	if len(page.Tables) == 1 {
+		err := page.Tables[0].writeJson(&buffer)
+		return buffer.Bytes(), err
+	}
+	buffer.WriteString("{\n")
+	for idx, table := range page.Tables {
+		if idx > 0 {
+			buffer.WriteString(",\n")
+		}
+		fmt.Fprintf(&buffer, "%q: ", table.name)
+		if err := table.writeJson(&buffer); err != nil {
+			return nil, err
+		}
+		buffer.Truncate(buffer.Len() - 1)
+	}
+	buffer.WriteString("\n}\n")
+	return buffer.Bytes(), nil
+}
+
+// A statusLabel names a row of the status summary by its label in HTML and
+// its key in JSON, like the status command does.
+type statusLabel struct {
+	label, key string
+}
+
+func (s statusLabel) String() string {
+	return s.label
+}
+
+func (s statusLabel) StructuredValue() interface{} {
+	return s.key
+}
+
+var reportTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <meta charset="utf-8">
+        <title>{{.Title}}</title>
+        <style>
+            body { font-family: sans-serif; margin: 2em; }
+            table { border-collapse: collapse; margin-bottom: 2em; }
+            th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; white-space: pre; }
+            th { background: #eee; }
+            nav a { margin-right: 1em; }
+        </style>
+    </head>
+    <body>
+        <nav>
+            <a href="{{.Root}}index.html">Summary</a>
+            <a href="{{.Root}}versions.html">Versions</a>
+            <a href="{{.Root}}countries.html">Countries</a>
+            <a href="{{.Root}}devices.html">All devices</a>
+            <a href="{{.Root}}devices-up.html">Up</a>
+            <a href="{{.Root}}devices-stale.html">Stale</a>
+            <a href="{{.Root}}devices-down.html">Down</a>
+            <a href="{{.Root}}../index.html">Archive</a>
+        </nav>
+        <h1>{{.Title}}</h1>
+        <p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}.</p>
+        {{range .Tables}}
+        {{if .Title}}<h2>{{.Title}}</h2>{{end}}
+        <table>
+            <tr>{{range .Headers}}<th>{{.}}</th>{{end}}</tr>
+            {{range .Rows $.Root}}<tr>{{range .}}<td>{{if .Link}}<a href="{{.Link}}">{{.Text}}</a>{{else}}{{.Text}}{{end}}</td>{{end}}</tr>
+            {{end}}
+        </table>
+        {{end}}
+    </body>
+</html>
+`))
+
+var archiveTemplate = template.Must(template.New("archive").Parse(`<!DOCTYPE html>
+<html lang="en">
+    <head>
+        <meta charset="utf-8">
+        <title>BISmark Status Archive</title>
+        <style>body { font-family: sans-serif; margin: 2em; }</style>
+    </head>
+    <body>
+        <h1>BISmark Status Archive</h1>
+        <ul>
+            <li><a href="latest/index.html">Latest</a></li>
+            {{range .}}<li><a href="{{.}}/index.html">{{.}}</a></li>
+            {{end}}
+        </ul>
+    </body>
+</html>
+`))
+
+// writeFile replaces filename with contents, so that readers never see a
+// partly written page.
+func writeFile(filename string, contents []byte) error {
+	if err := atomicfile.WriteFile(filename, contents, 0644); err != nil {
+		return fmt.Errorf("Error writing report: %s", err)
+	}
+	return nil
+}
+
+// writePage writes page to name.html and name.json in directory.
+func writePage(directory, name string, page *reportPage) error {
+	var html bytes.Buffer
+	if err := reportTemplate.Execute(&html, page); err != nil {
+		return fmt.Errorf("Error rendering %s: %s", name, err)
+	}
+	if err := writeFile(filepath.Join(directory, name+".html"), html.Bytes()); err != nil {
+		return err
+	}
+	sidecar, err := page.sidecar()
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(directory, name+".json"), sidecar)
+}
+
+// A reportGenerator writes the site for one moment in time.
+type reportGenerator struct {
+	db          datastore.Datastore
+	now         time.Time
+	historyDays int
+	threshold   time.Duration
+}
+
+func (g *reportGenerator) page(title, root string, tables ...*reportTable) *reportPage {
+	return &reportPage{Title: title, Root: root, Generated: g.now, Tables: tables}
+}
+
+func (g *reportGenerator) summaryTable(ctx context.Context) (*reportTable, error) {
+	rows, err := summarizeDevices(ctx, g.db)
+	if err != nil {
+		return nil, err
+	}
+	total := rows[len(rows)-1].count
+	table := &reportTable{name: "summary", fields: []string{"device_status", "count", "percentage"}}
+	for _, row := range rows {
+		table.records = append(table.records, []interface{}{statusLabel{row.label, row.key}, row.count, percentage{row.count, total}})
+	}
+	return table, nil
+}
+
+func (g *reportGenerator) groupsTable(ctx context.Context, name, groupBy string) (*reportTable, error) {
+	params, err := parseSummaryQuery("by " + groupBy)
+	if err != nil {
+		return nil, err
+	}
+	fields, records, err := summaryRecords(ctx, g.db, params)
+	if err != nil {
+		return nil, err
+	}
+	return &reportTable{name: name, fields: fields, records: records}, nil
+}
+
+func (g *reportGenerator) devicesTable(ctx context.Context, query string) (*reportTable, []*datastore.DevicesResult, error) {
+	params, err := parseDeviceQuery(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	table := &reportTable{name: "devices", fields: deviceFields}
+	var devices []*datastore.DevicesResult
+	results := selectDevices(ctx, g.db, params)
+	defer results.Close()
+	for results.Next() {
+		devices = append(devices, results.Result())
+		table.records = append(table.records, deviceRecord(results.Result()))
+	}
+	if err := results.Err(); err != nil {
+		return nil, nil, err
+	}
+	return table, devices, nil
+}
+
+func (g *reportGenerator) devicePage(ctx context.Context, device *datastore.DevicesResult) (*reportPage, error) {
+	until := g.now
+	since := until.AddDate(0, 0, -g.historyDays)
+	probes, err := selectProbes(ctx, g.db, device.NodeId, since, until)
+	if err != nil {
+		return nil, err
+	}
+	return g.page("Device "+device.NodeId, "../",
+		&reportTable{name: "device", fields: deviceFields, records: [][]interface{}{deviceRecord(device)}},
+		&reportTable{
+			Title:   fmt.Sprintf("History for the past %d days", g.historyDays),
+			name:    "history",
+			fields:  historyFields,
+			records: historyRecords(collapseProbes(probes, since, until, g.threshold), since, until),
+		}), nil
+}
+
+// generate writes every page into a directory of out named for the date,
+// and returns that directory.
+func (g *reportGenerator) generate(ctx context.Context, out string) (string, error) {
+	dated := g.now.UTC().Format("20060102")
+	directory := filepath.Join(out, dated)
+	if err := os.MkdirAll(filepath.Join(directory, "devices"), 0755); err != nil {
+		return "", fmt.Errorf("Error writing report: %s", err)
+	}
+
+	summary, err := g.summaryTable(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := writePage(directory, "index", g.page("BISmark Fleet Status", "", summary)); err != nil {
+		return "", err
+	}
+	for _, groups := range []struct{ name, groupBy, title string }{
+		{"versions", "version", "Firmware Versions"},
+		{"countries", "country", "Countries"},
+	} {
+		table, err := g.groupsTable(ctx, groups.name, groups.groupBy)
+		if err != nil {
+			return "", err
+		}
+		if err := writePage(directory, groups.name, g.page(groups.title, "", table)); err != nil {
+			return "", err
+		}
+	}
+
+	table, devices, err := g.devicesTable(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	if err := writePage(directory, "devices", g.page("All Devices", "", table)); err != nil {
+		return "", err
+	}
+	for _, status := range []string{"up", "stale", "down"} {
+		table, _, err := g.devicesTable(ctx, "where status is "+status)
+		if err != nil {
+			return "", err
+		}
+		if err := writePage(directory, "devices-"+status, g.page("Devices that are "+status, "", table)); err != nil {
+			return "", err
+		}
+	}
+	for _, device := range devices {
+		page, err := g.devicePage(ctx, device)
+		if err != nil {
+			return "", err
+		}
+		if err := writePage(filepath.Join(directory, "devices"), device.NodeId, page); err != nil {
+			return "", err
+		}
+	}
+
+	if err := linkLatest(out, dated); err != nil {
+		return "", err
+	}
+	return directory, writeArchive(out)
+}
+
+// linkLatest points out/latest at the dated directory, replacing the old link
+// in one step.
+func linkLatest(out, dated string) error {
+	temporary := filepath.Join(out, ".latest."+dated)
+	os.Remove(temporary)
+	if err := os.Symlink(dated, temporary); err != nil {
+		return fmt.Errorf("Error linking latest report: %s", err)
+	}
+	if err := os.Rename(temporary, filepath.Join(out, "latest")); err != nil {
+		os.Remove(temporary)
+		return fmt.Errorf("Error linking latest report: %s", err)
+	}
+	return nil
+}
+
+var datedDirectory = regexp.MustCompile(`^[0-9]{8}$`)
+
+// writeArchive lists every dated directory in out/index.html, newest first.
+func writeArchive(out string) error {
+	entries, err := ioutil.ReadDir(out)
+	if err != nil {
+		return fmt.Errorf("Error listing reports: %s", err)
+	}
+	var dates []string
+	for _, entry := range entries {
+		if entry.IsDir() && datedDirectory.MatchString(entry.Name()) {
+			dates = append(dates, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	var html bytes.Buffer
+	if err := archiveTemplate.Execute(&html, dates); err != nil {
+		return fmt.Errorf("Error rendering archive: %s", err)
+	}
+	return writeFile(filepath.Join(out, "index.html"), html.Bytes())
+}
+
+func (report) Run(args []string) error {
+	flagset := flag.NewFlagSet("report", flag.ContinueOnError)
+	out := flagset.String("out", "", "Write the site into a dated directory here, and link it from here as latest")
+	historyDays := flagset.Int("history_days", 7, "Show this many days of history on each device's page")
+	threshold := flagset.Duration("outage_threshold", 10*time.Minute, "Consider a device offline when the time between two of its probes is longer than this threshold")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" || flagset.NArg() > 0 {
+		return fmt.Errorf("Usage: report --out=<dir> [--history_days=<days>] [--outage_threshold=<duration>]")
+	}
+	if *historyDays <= 0 {
+		return fmt.Errorf("--history_days must be positive")
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	generator := &reportGenerator{db: db, now: time.Now(), historyDays: *historyDays, threshold: *threshold}
+	directory, err := generator.generate(ctx, *out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(output, "Wrote", directory)
+	return nil
+}
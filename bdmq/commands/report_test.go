@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/fleet.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+	db, err := openDatastore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	out, err := ioutil.TempDir("", "bdmq-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+
+	generator := &reportGenerator{
+		db:          db,
+		now:         time.Date(2013, 7, 2, 12, 0, 0, 0, time.UTC),
+		historyDays: 1,
+		threshold:   10 * time.Minute,
+	}
+	// Generate twice to check that we replace the latest link.
+	for idx := 0; idx < 2; idx++ {
+		directory, err := generator.generate(context.Background(), out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if directory != filepath.Join(out, "20130702") {
+			t.Errorf("Wrote the report to %s", directory)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(out, "latest")); err != nil || target != "20130702" {
+		t.Errorf("latest links to %q (%v)", target, err)
+	}
+
+	read := func(name string) string {
+		contents, err := ioutil.ReadFile(filepath.Join(out, "latest", name))
+		if err != nil {
+			t.Error(err)
+		}
+		return string(contents)
+	}
+	for name, want := range map[string]string{
+		"index.json": `[
+  {"device_status":"online","count":2,"percentage":33.33333333333333},
+  {"device_status":"stale","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline","count":3,"percentage":50},
+  {"device_status":"offline_past_hour","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline_past_day","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline_past_week","count":2,"percentage":33.33333333333333},
+  {"device_status":"offline_past_month","count":2,"percentage":33.33333333333333},
+  {"device_status":"total","count":6,"percentage":100}
+]
+`,
+		"versions.json": `[
+  {"version":"1.0","total":3,"percentage":50,"online":1,"stale":1,"offline":1,"online_percentage":33.33333333333333},
+  {"version":"1.1","total":3,"percentage":50,"online":1,"stale":0,"offline":2,"online_percentage":33.33333333333333}
+]
+`,
+		"devices-stale.json": `[
+  {"node_id":"OW0000000002","ip_address":"2.2.2.2","country":"US","version":"1.0","last_probe":"2013-07-02T11:55:00Z","status":"stale","outage_duration":300,"asn":7922,"isp":"Comcast Cable Communications, Inc.","city":"Boston"}
+]
+`,
+		"devices/OW0000000002.json": `{
+"device": [
+  {"node_id":"OW0000000002","ip_address":"2.2.2.2","country":"US","version":"1.0","last_probe":"2013-07-02T11:55:00Z","status":"stale","outage_duration":300,"asn":7922,"isp":"Comcast Cable Communications, Inc.","city":"Boston"}
+],
+"history": [
+  {"state":"offline","start":"2013-07-01T12:00:00Z","end":"2013-07-02T11:55:00Z","duration":86100,"ip_address":"","percentage":99.65277777777779},
+  {"state":"online","start":"2013-07-02T11:55:00Z","end":"2013-07-02T12:00:00Z","duration":300,"ip_address":"2.2.2.2","percentage":0.3472222222222222},
+  {"state":"availability","start":"2013-07-01T12:00:00Z","end":"2013-07-02T12:00:00Z","duration":300,"ip_address":"","percentage":0.3472222222222222}
+]
+}
+`,
+	} {
+		if got := read(name); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", name, got, want)
+		}
+	}
+
+	index := read("index.html")
+	for _, want := range []string{
+		"<td>  past hour</td><td>1</td><td>16%</td>",
+		`<a href="devices-down.html">Down</a>`,
+	} {
+		if !strings.Contains(index, want) {
+			t.Errorf("index.html doesn't contain %s:\n%s", want, index)
+		}
+	}
+	devices := read("devices.html")
+	if want := `<td><a href="devices/OW00000000AB.html">OW00000000AB</a></td>`; !strings.Contains(devices, want) {
+		t.Errorf("devices.html doesn't contain %s:\n%s", want, devices)
+	}
+	if device := read("devices/OW00000000CD.html"); !strings.Contains(device, `<a href="../../index.html">Archive</a>`) {
+		t.Errorf("Device page doesn't link to the archive:\n%s", device)
+	}
+	archive, err := ioutil.ReadFile(filepath.Join(out, "index.html"))
+	if err != nil || !strings.Contains(string(archive), `<a href="20130702/index.html">20130702</a>`) {
+		t.Errorf("Archive doesn't link to the report (%v):\n%s", err, archive)
+	}
+}
@@ -0,0 +1,325 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type serve struct{}
+
+func NewServe() BdmCommand {
+	return new(serve)
+}
+
+func (serve) Name() string {
+	return "serve"
+}
+
+func (serve) Description() string {
+	return "Serve device information as JSON over HTTP: serve [--listen=<address>] [--timeout=<duration>] [--cache_ttl=<duration>]"
+}
+
+// An httpError is returned by API handlers to choose the response's status
+// code. Other errors are internal server errors.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+// A cachedResponse is the body of a successful API response.
+type cachedResponse struct {
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// apiServer answers API requests from a datastore, remembering each response
+// for ttl so that dashboards polling the same URL don't each hit the
+// database.
+type apiServer struct {
+	db  datastore.Datastore
+	ttl time.Duration
+	now func() time.Time
+
+	mutex sync.Mutex
+	cache map[string]*cachedResponse
+}
+
+func newApiHandler(db datastore.Datastore, ttl time.Duration) http.Handler {
+	server := &apiServer{
+		db:    db,
+		ttl:   ttl,
+		now:   time.Now,
+		cache: make(map[string]*cachedResponse),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/devices", server.handler(server.devices))
+	mux.Handle("/devices/", server.handler(server.device))
+	mux.Handle("/versions", server.handler(server.versions))
+	mux.Handle("/countries", server.handler(server.countries))
+	mux.Handle("/isps", server.handler(server.isps))
+	mux.Handle("/status", server.handler(server.status))
+	mux.Handle("/summarize", server.handler(server.summarize))
+	return mux
+}
+
+func (s *apiServer) lookup(key string) *cachedResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response, ok := s.cache[key]
+	if !ok || !s.now().Before(response.expires) {
+		return nil
+	}
+	return response
+}
+
+func (s *apiServer) store(key string, body []byte) *cachedResponse {
+	hash := sha1.Sum(body)
+	response := &cachedResponse{
+		body:    body,
+		etag:    fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:8])),
+		expires: s.now().Add(s.ttl),
+	}
+	if s.ttl <= 0 {
+		return response
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, cached := range s.cache {
+		if !s.now().Before(cached.expires) {
+			delete(s.cache, k)
+		}
+	}
+	s.cache[key] = response
+	return response
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoded, _ := json.Marshal(map[string]string{"error": message})
+	fmt.Fprintf(w, "%s\n", encoded)
+}
+
+// handler adapts an API endpoint that renders JSON into a buffer into an
+// http.Handler with caching and conditional GETs.
+func (s *apiServer) handler(endpoint func(*bytes.Buffer, *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+			return
+		}
+
+		key := r.URL.Path + "?" + r.URL.Query().Encode()
+		response := s.lookup(key)
+		if response == nil {
+			var buffer bytes.Buffer
+			if err := endpoint(&buffer, r); err != nil {
+				if e, ok := err.(*httpError); ok {
+					writeJsonError(w, e.status, e.message)
+				} else {
+					log.Printf("Error serving %s: %s", r.URL, err)
+					writeJsonError(w, http.StatusInternalServerError, err.Error())
+				}
+				return
+			}
+			response = s.store(key, buffer.Bytes())
+		}
+
+		w.Header().Set("ETag", response.etag)
+		if s.ttl > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(s.ttl.Seconds())))
+		}
+		if r.Header.Get("If-None-Match") == response.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response.body)
+	})
+}
+
+// GET /devices?q=<query> returns an array of devices, where query is the
+// same as the arguments to the devices command, e.g., "where country = us
+// order by id limit 10".
+func (s *apiServer) devices(buffer *bytes.Buffer, r *http.Request) error {
+	params, err := parseDeviceQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		return &httpError{http.StatusBadRequest, err.Error()}
+	}
+	writer := &jsonWriter{writer: buffer, fields: deviceFields}
+	results := selectDevices(r.Context(), s.db, params)
+	defer results.Close()
+	for results.Next() {
+		if err := writer.WriteRecord(deviceRecord(results.Result())...); err != nil {
+			return err
+		}
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// GET /devices/<node> returns a single device object.
+func (s *apiServer) device(buffer *bytes.Buffer, r *http.Request) error {
+	nodeId := strings.TrimPrefix(r.URL.Path, "/devices/")
+	if nodeId == "" || strings.Contains(nodeId, "/") {
+		return &httpError{http.StatusNotFound, "Not found"}
+	}
+	filter := &datastore.Comparison{Field: datastore.NodeIdField, Operator: datastore.Equals, Values: []interface{}{nodeId}}
+	var device *datastore.DevicesResult
+	results := s.db.SelectDevices(r.Context(), nil, nil, 0, filter)
+	defer results.Close()
+	for results.Next() {
+		// The filter matches suffixes, but here we want the whole ID.
+		if strings.EqualFold(results.Result().NodeId, nodeId) {
+			device = results.Result()
+		}
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	if device == nil {
+		return &httpError{http.StatusNotFound, fmt.Sprintf("No such device: %s", nodeId)}
+	}
+	encoded, err := marshalRecord(deviceFields, deviceRecord(device))
+	if err != nil {
+		return err
+	}
+	buffer.Write(encoded)
+	buffer.WriteByte('\n')
+	return nil
+}
+
+// GET /versions returns an array of firmware versions.
+func (s *apiServer) versions(buffer *bytes.Buffer, r *http.Request) error {
+	writer := &jsonWriter{writer: buffer, fields: []string{"version", "total", "online", "stale", "offline"}}
+	results := s.db.SelectVersions(r.Context())
+	defer results.Close()
+	for results.Next() {
+		result := results.Result()
+		if err := writer.WriteRecord(result.Version, result.Count, result.OnlineCount, result.StaleCount, result.OfflineCount); err != nil {
+			return err
+		}
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// GET /countries returns an array of countries.
+func (s *apiServer) countries(buffer *bytes.Buffer, r *http.Request) error {
+	writer := &jsonWriter{writer: buffer, fields: []string{"country", "total", "online", "stale", "offline"}}
+	results := s.db.SelectCountries(r.Context())
+	defer results.Close()
+	for results.Next() {
+		result := results.Result()
+		if err := writer.WriteRecord(result.Country, result.Count, result.OnlineCount, result.StaleCount, result.OfflineCount); err != nil {
+			return err
+		}
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// GET /isps returns an array of ISPs.
+func (s *apiServer) isps(buffer *bytes.Buffer, r *http.Request) error {
+	writer := &jsonWriter{writer: buffer, fields: []string{"asn", "isp", "total", "online", "stale", "offline"}}
+	results := s.db.SelectIsps(r.Context())
+	defer results.Close()
+	for results.Next() {
+		result := results.Result()
+		if err := writer.WriteRecord(asnValue(result.Asn), result.Isp, result.Count, result.OnlineCount, result.StaleCount, result.OfflineCount); err != nil {
+			return err
+		}
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// GET /summarize?by=<fields>&q=<query> returns the same groups as the
+// summarize command, e.g., by=country,status&q=where version = 1.0.
+func (s *apiServer) summarize(buffer *bytes.Buffer, r *http.Request) error {
+	params, err := parseSummaryQuery("by " + r.URL.Query().Get("by") + " " + r.URL.Query().Get("q"))
+	if err != nil {
+		return &httpError{http.StatusBadRequest, err.Error()}
+	}
+	fields, records, err := summaryRecords(r.Context(), s.db, params)
+	if err != nil {
+		return err
+	}
+	writer := &jsonWriter{writer: buffer, fields: fields}
+	for _, values := range records {
+		if err := writer.WriteRecord(values...); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// GET /status returns the same summary as the status command.
+func (s *apiServer) status(buffer *bytes.Buffer, r *http.Request) error {
+	rows, err := summarizeDevices(r.Context(), s.db)
+	if err != nil {
+		return err
+	}
+	total := rows[len(rows)-1].count
+	writer := &jsonWriter{writer: buffer, fields: []string{"device_status", "count", "percentage"}}
+	for _, row := range rows {
+		if err := writer.WriteRecord(row.key, row.count, percentage{row.count, total}); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func (serve) Run(args []string) error {
+	flagset := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := flagset.String("listen", ":8080", "Listen for HTTP requests on this address")
+	timeout := flagset.Duration("timeout", 30*time.Second, "Give up on requests that take longer than this")
+	cacheTtl := flagset.Duration("cache_ttl", time.Minute, "Reuse responses for this long; 0 disables caching")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if flagset.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments: %v", flagset.Args())
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Endpoints query the datastore with the request's context, which
+	// TimeoutHandler cancels after --timeout.
+	server := &http.Server{
+		Addr:    *listen,
+		Handler: http.TimeoutHandler(newApiHandler(db, *cacheTtl), *timeout, `{"error":"Request timed out"}`),
+	}
+
+	log.Printf("Listening on %s", *listen)
+	return listenAndServe(server, *timeout)
+}
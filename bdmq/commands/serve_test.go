@@ -0,0 +1,245 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type serveTest struct {
+	path       string
+	wantStatus int
+	want       string
+}
+
+var serveTests = []serveTest{
+	{"/devices?q=" + url.QueryEscape("where country = gb"), http.StatusOK, `[
+  {"node_id":"OW00000000AB","ip_address":"81.2.3.4","country":"GB","version":"1.0","last_probe":"2013-05-01T00:00:00Z","status":"down","outage_duration":5400000,"asn":2856,"isp":"British Telecommunications PLC","city":"London"},
+  {"node_id":"OW00000000CD","ip_address":"2001:db8::1","country":"GB","version":"1.1","last_probe":"2013-07-02T11:59:50Z","status":"up","outage_duration":10,"asn":null,"isp":"??","city":"??"}
+]
+`},
+	{"/devices?q=" + url.QueryEscape("where status = up order by id desc limit 1"), http.StatusOK, `[
+  {"node_id":"OW00000000CD","ip_address":"2001:db8::1","country":"GB","version":"1.1","last_probe":"2013-07-02T11:59:50Z","status":"up","outage_duration":10,"asn":null,"isp":"??","city":"??"}
+]
+`},
+	{"/devices?q=" + url.QueryEscape("where colour = red"), http.StatusBadRequest, `{"error":"Invalid query: Invalid field: colour near \"colour\" at position 7"}
+`},
+	{"/devices/ow0000000004", http.StatusOK, `{"node_id":"OW0000000004","ip_address":"41.1.1.1","country":"KE","version":"1.1","last_probe":"2013-06-30T12:00:00Z","status":"down","outage_duration":172800,"asn":33771,"isp":"Safaricom Limited","city":"Nairobi"}
+`},
+	{"/devices/0004", http.StatusNotFound, `{"error":"No such device: 0004"}
+`},
+	{"/versions", http.StatusOK, `[
+  {"version":"1.0","total":3,"online":1,"stale":1,"offline":1},
+  {"version":"1.1","total":3,"online":1,"stale":0,"offline":2}
+]
+`},
+	{"/countries", http.StatusOK, `[
+  {"country":"US","total":3,"online":1,"stale":1,"offline":1},
+  {"country":"GB","total":2,"online":1,"stale":0,"offline":1},
+  {"country":"KE","total":1,"online":0,"stale":0,"offline":1}
+]
+`},
+	{"/isps", http.StatusOK, `[
+  {"asn":7922,"isp":"Comcast Cable Communications, Inc.","total":2,"online":1,"stale":1,"offline":0},
+  {"asn":null,"isp":"??","total":1,"online":1,"stale":0,"offline":0},
+  {"asn":2637,"isp":"Georgia Institute of Technology","total":1,"online":0,"stale":0,"offline":1},
+  {"asn":2856,"isp":"British Telecommunications PLC","total":1,"online":0,"stale":0,"offline":1},
+  {"asn":33771,"isp":"Safaricom Limited","total":1,"online":0,"stale":0,"offline":1}
+]
+`},
+	{"/summarize?by=version&q=" + url.QueryEscape("where country = us"), http.StatusOK, `[
+  {"version":"1.0","total":2,"percentage":66.66666666666666,"online":1,"stale":1,"offline":0,"online_percentage":50},
+  {"version":"1.1","total":1,"percentage":33.33333333333333,"online":0,"stale":0,"offline":1,"online_percentage":0}
+]
+`},
+	{"/summarize?by=outage", http.StatusBadRequest, `{"error":"Invalid query: can't group by outage_duration near \"outage\" at position 4"}
+`},
+	{"/status", http.StatusOK, `[
+  {"device_status":"online","count":2,"percentage":33.33333333333333},
+  {"device_status":"stale","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline","count":3,"percentage":50},
+  {"device_status":"offline_past_hour","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline_past_day","count":1,"percentage":16.666666666666664},
+  {"device_status":"offline_past_week","count":2,"percentage":33.33333333333333},
+  {"device_status":"offline_past_month","count":2,"percentage":33.33333333333333},
+  {"device_status":"total","count":6,"percentage":100}
+]
+`},
+}
+
+func newTestApiServer(t *testing.T, ttl time.Duration) *httptest.Server {
+	db, err := datastore.NewFixtureDatastore("testdata/fleet.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(newApiHandler(db, ttl))
+}
+
+func get(t *testing.T, url string, header http.Header) (*http.Response, string) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, string(body)
+}
+
+func TestServe(t *testing.T) {
+	server := newTestApiServer(t, time.Minute)
+	defer server.Close()
+
+	for _, test := range serveTests {
+		response, body := get(t, server.URL+test.path, nil)
+		if response.StatusCode != test.wantStatus {
+			t.Errorf("%s: got status %d, want %d", test.path, response.StatusCode, test.wantStatus)
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: got Content-Type %s", test.path, contentType)
+		}
+		if body != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.path, body, test.want)
+		}
+	}
+}
+
+// TestServeAgreesWithCommands checks that the API and the summary commands
+// count the same devices as online, stale and offline.
+func TestServeAgreesWithCommands(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/fleet.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+	server := newTestApiServer(t, time.Minute)
+	defer server.Close()
+
+	counts := func(records []map[string]interface{}, key string) map[string][4]interface{} {
+		byKey := make(map[string][4]interface{})
+		for _, record := range records {
+			byKey[fmt.Sprint(record[key])] = [4]interface{}{record["total"], record["online"], record["stale"], record["offline"]}
+		}
+		return byKey
+	}
+	for _, test := range []struct {
+		command BdmCommand
+		path    string
+		key     string
+	}{
+		{NewVersions(), "/versions", "version"},
+		{NewCountries(), "/countries", "country"},
+		{NewIsps(), "/isps", "asn"},
+	} {
+		_, body := get(t, server.URL+test.path, nil)
+		var apiRecords []map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &apiRecords); err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+
+		got, err := runCommandTest(commandTest{command: test.command, format: "jsonl"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var commandRecords []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(got), "\n") {
+			var record map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("%s: %s", test.command.Name(), err)
+			}
+			commandRecords = append(commandRecords, record)
+		}
+
+		if apiCounts, commandCounts := counts(apiRecords, test.key), counts(commandRecords, test.key); !reflect.DeepEqual(apiCounts, commandCounts) {
+			t.Errorf("%s returned %v but %s returned %v", test.path, apiCounts, test.command.Name(), commandCounts)
+		}
+	}
+}
+
+func TestServeETag(t *testing.T) {
+	server := newTestApiServer(t, time.Minute)
+	defer server.Close()
+
+	response, _ := get(t, server.URL+"/versions", nil)
+	etag := response.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("Missing ETag")
+	}
+	if cacheControl := response.Header.Get("Cache-Control"); cacheControl != "max-age=60" {
+		t.Errorf("Got Cache-Control %q", cacheControl)
+	}
+
+	response, body := get(t, server.URL+"/versions", http.Header{"If-None-Match": {etag}})
+	if response.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("Got status %d and body %q, want 304", response.StatusCode, body)
+	}
+	response, _ = get(t, server.URL+"/versions", http.Header{"If-None-Match": {`"stale"`}})
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Got status %d, want 200", response.StatusCode)
+	}
+}
+
+// countingDatastore counts calls to SelectVersions.
+type countingDatastore struct {
+	datastore.Datastore
+	versionQueries int
+}
+
+func (store *countingDatastore) SelectVersions(ctx context.Context) *datastore.VersionsIterator {
+	store.versionQueries++
+	return store.Datastore.SelectVersions(ctx)
+}
+
+func TestServeCache(t *testing.T) {
+	db, err := datastore.NewFixtureDatastore("testdata/fleet.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &countingDatastore{Datastore: db}
+	now := time.Date(2013, 7, 2, 12, 0, 0, 0, time.UTC)
+	server := &apiServer{
+		db:    counter,
+		ttl:   time.Minute,
+		now:   func() time.Time { return now },
+		cache: make(map[string]*cachedResponse),
+	}
+	handler := server.handler(server.versions)
+
+	request := func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/versions", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Got status %d", recorder.Code)
+		}
+	}
+	request()
+	now = now.Add(59 * time.Second)
+	request()
+	if counter.versionQueries != 1 {
+		t.Errorf("Queried %d times within the TTL, want 1", counter.versionQueries)
+	}
+	now = now.Add(time.Second)
+	request()
+	if counter.versionQueries != 2 {
+		t.Errorf("Queried %d times after the TTL expired, want 2", counter.versionQueries)
+	}
+}
@@ -0,0 +1,328 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/peterh/liner"
+)
+
+type shell struct {
+	commands []BdmCommand
+}
+
+// NewShell creates a command that reads and runs the other commands
+// interactively, keeping one datastore open between them.
+func NewShell(commands []BdmCommand) BdmCommand {
+	return &shell{commands}
+}
+
+func (shell) Name() string {
+	return "shell"
+}
+
+func (shell) Description() string {
+	return "Run commands interactively, with history and completion: shell [--history_file=<filename>]"
+}
+
+// errExit tells the shell to stop reading commands.
+var errExit = errors.New("exit")
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".bdmq_history")
+}
+
+func (sh *shell) Run(args []string) error {
+	flagset := flag.NewFlagSet("shell", flag.ContinueOnError)
+	historyFile := flagset.String("history_file", defaultHistoryFile(), "Keep command history in this file; leave empty to forget history when the shell exits")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	sharedDatastore = db
+	defer func() { sharedDatastore = nil }()
+
+	completer, err := newShellCompleter(sh.commandNames())
+	if err != nil {
+		return err
+	}
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetWordCompleter(completer.complete)
+	if *historyFile != "" {
+		if handle, err := os.Open(*historyFile); err == nil {
+			line.ReadHistory(handle)
+			handle.Close()
+		}
+	}
+
+	for {
+		text, err := line.Prompt("bdmq> ")
+		if err == liner.ErrPromptAborted {
+			continue
+		} else if err == io.EOF {
+			fmt.Fprintln(output)
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error reading command: %s", err)
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		line.AppendHistory(text)
+		if err := sh.runLine(text); err == errExit {
+			break
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	if *historyFile == "" {
+		return nil
+	}
+	handle, err := os.Create(*historyFile)
+	if err != nil {
+		return fmt.Errorf("Error writing history: %s", err)
+	}
+	defer handle.Close()
+	if _, err := line.WriteHistory(handle); err != nil {
+		return fmt.Errorf("Error writing history: %s", err)
+	}
+	return nil
+}
+
+func (sh *shell) commandNames() []string {
+	names := []string{"help", "exit", "quit"}
+	for _, command := range sh.commands {
+		names = append(names, command.Name())
+	}
+	return names
+}
+
+// runLine runs one line of input, which looks like the arguments to bdmq:
+// global options, a command and its arguments. Global options only last for
+// the one line, and those that choose the datastore have no effect because
+// the shell's datastore is already open.
+func (sh *shell) runLine(text string) error {
+	args, err := splitCommandLine(text)
+	if err != nil {
+		return err
+	}
+	args, restore, err := setGlobalFlags(args)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch args[0] {
+	case "exit", "quit":
+		return errExit
+	case "help":
+		for _, command := range sh.commands {
+			fmt.Fprintf(output, "%s: %s\n", command.Name(), command.Description())
+		}
+		fmt.Fprintln(output, "exit: Leave the shell")
+		return nil
+	}
+	for _, command := range sh.commands {
+		if command.Name() == args[0] {
+			return command.Run(args[1:])
+		}
+	}
+	return fmt.Errorf("Unknown command: %s", args[0])
+}
+
+// setGlobalFlags parses global options from the start of args and returns the
+// remaining arguments, along with a function that puts the options back how
+// they were.
+func setGlobalFlags(args []string) ([]string, func(), error) {
+	flagset := flag.NewFlagSet("bdmq", flag.ContinueOnError)
+	flagset.SetOutput(ioutil.Discard)
+	previous := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flagset.Var(f.Value, f.Name, f.Usage)
+		previous[f.Name] = f.Value.String()
+	})
+	restore := func() {
+		flagset.Visit(func(f *flag.Flag) {
+			f.Value.Set(previous[f.Name])
+		})
+	}
+	if err := flagset.Parse(args); err != nil {
+		restore()
+		return nil, nil, err
+	}
+	return flagset.Args(), restore, nil
+}
+
+// splitCommandLine splits text into arguments at whitespace, like a Unix
+// shell would. Single quotes keep everything between them; double quotes
+// and backslashes escape the next character.
+func splitCommandLine(text string) ([]string, error) {
+	var (
+		args    []string
+		current []rune
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range text {
+		switch {
+		case escaped:
+			current = append(current, r)
+			escaped = false
+		case quote == '\'' && r == '\'':
+			quote = 0
+		case quote == '\'':
+			current = append(current, r)
+		case r == '\\':
+			escaped, inArg = true, true
+		case quote == '"' && r == '"':
+			quote = 0
+		case quote == '"':
+			current = append(current, r)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, string(current))
+				current, inArg = nil, false
+			}
+		default:
+			current = append(current, r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("Unterminated quote or escape: %s", text)
+	}
+	if inArg {
+		args = append(args, string(current))
+	}
+	return args, nil
+}
+
+// A shellCompleter completes command names, query keywords and field names,
+// and the node IDs, countries and versions in the datastore.
+type shellCompleter struct {
+	commands                     []string
+	nodeIds, countries, versions []string
+}
+
+func newShellCompleter(commands []string) (*shellCompleter, error) {
+	db, err := openDatastore("")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	ctx, cancel := queryContext()
+	defer cancel()
+	devices, err := selectSnapshot(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	completer := &shellCompleter{commands: commands}
+	for _, device := range devices {
+		completer.nodeIds = append(completer.nodeIds, device.NodeId)
+		completer.countries = append(completer.countries, device.CountryCode)
+		completer.versions = append(completer.versions, device.Version)
+	}
+	return completer, nil
+}
+
+// comparisonOperators are the words after which completion offers values of
+// the preceding field.
+var comparisonOperators = map[string]bool{
+	"=": true, "==": true, "!=": true, "<>": true, "is": true, "not": true, "like": true, "in": true,
+}
+
+// candidates returns the words that may follow words, the words of the line
+// before the one being completed.
+func (c *shellCompleter) candidates(words []string) []string {
+	for len(words) > 0 && strings.HasPrefix(words[0], "-") {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return c.commands
+	}
+	last := strings.ToLower(words[len(words)-1])
+	switch {
+	case last == "by" && len(words) >= 2 && strings.ToLower(words[len(words)-2]) == "order":
+		return identifierNames
+	case last == "by":
+		return filterFieldNames
+	case comparisonOperators[last]:
+		for idx := len(words) - 2; idx >= 0; idx-- {
+			if comparisonOperators[strings.ToLower(words[idx])] {
+				continue
+			}
+			return c.values(strings.ToLower(words[idx]))
+		}
+	case len(words) == 1 && (words[0] == "status" || words[0] == "history"):
+		return c.nodeIds
+	}
+	var all []string
+	all = append(all, queryKeywords...)
+	all = append(all, filterFieldNames...)
+	return all
+}
+
+// values returns the values to complete for comparisons with field.
+func (c *shellCompleter) values(field string) []string {
+	switch field {
+	case "status", "state":
+		return deviceStatusNames
+	case "country", "country_code":
+		return c.countries
+	case "version", "bversion":
+		return c.versions
+	case "node", "id", "node_id":
+		return c.nodeIds
+	default:
+		return nil
+	}
+}
+
+// complete implements liner.WordCompleter.
+func (c *shellCompleter) complete(line string, pos int) (head string, completions []string, tail string) {
+	head, tail = line[:pos], line[pos:]
+	start := strings.LastIndexAny(head, " \t(,") + 1
+	prefix := strings.ToLower(head[start:])
+	words := strings.FieldsFunc(head[:start], func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '(' || r == ','
+	})
+
+	seen := make(map[string]bool)
+	for _, candidate := range c.candidates(words) {
+		if seen[candidate] || !strings.HasPrefix(strings.ToLower(candidate), prefix) {
+			continue
+		}
+		seen[candidate] = true
+		completions = append(completions, candidate)
+	}
+	sort.Strings(completions)
+	return head[:start], completions, tail
+}
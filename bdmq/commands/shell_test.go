@@ -0,0 +1,135 @@
+package commands
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Example_splitCommandLine() {
+	for _, line := range []string{
+		`devices where country = us`,
+		`  --format=csv   status  down `,
+		`devices 'where isp = "Safaricom Limited"'`,
+		`devices where isp = "Comcast Cable Communications, Inc."`,
+		`history OW000000000\1`,
+		`devices 'where`,
+	} {
+		args, err := splitCommandLine(line)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("%q\n", args)
+	}
+
+	// Output:
+	// ["devices" "where" "country" "=" "us"]
+	// ["--format=csv" "status" "down"]
+	// ["devices" "where isp = \"Safaricom Limited\""]
+	// ["devices" "where" "isp" "=" "Comcast Cable Communications, Inc."]
+	// ["history" "OW0000000001"]
+	// Unterminated quote or escape: devices 'where
+	//
+}
+
+// The completion lists must only have names the parser accepts.
+func TestCompletionNames(t *testing.T) {
+	for _, name := range filterFieldNames {
+		if _, err := parseFilterField(name); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, name := range deviceStatusNames {
+		if _, err := parseDeviceStatus(name); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, name := range identifierNames {
+		if _, err := parseIdentifier(name); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	completer := &shellCompleter{
+		commands:  []string{"devices", "diff", "exit", "status"},
+		nodeIds:   []string{"OW0000000001", "OW0000000002", "OW00000000AB"},
+		countries: []string{"US", "GB", "US"},
+		versions:  []string{"1.0", "1.1"},
+	}
+	tests := []struct {
+		line, want string
+	}{
+		{"d", "[devices diff]"},
+		{"--format=csv st", "[status]"},
+		{"devices where co", "[country country_code]"},
+		{"devices where country = ", "[GB US]"},
+		{"devices where (status is not o", "[off offline on online]"},
+		{"devices where id = ow00000000", "[OW0000000001 OW0000000002 OW00000000AB]"},
+		{"devices where version != 1.", "[1.0 1.1]"},
+		{"devices order by out", "[outage outage_duration]"},
+		{"summarize by cou", "[country country_code]"},
+		{"status ow00000000a", "[OW00000000AB]"},
+		{"devices where isp = ", "[]"},
+	}
+	for _, test := range tests {
+		head, completions, tail := completer.complete(test.line+"x", len(test.line))
+		if got := fmt.Sprint(completions); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.line, got, test.want)
+		}
+		if tail != "x" || !strings.HasPrefix(test.line, head) {
+			t.Errorf("%q: got head %q and tail %q", test.line, head, tail)
+		}
+	}
+}
+
+func TestShellRunLine(t *testing.T) {
+	if err := flag.Set("datastore", "fixture:testdata/fleet.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("datastore", "postgres")
+	db, err := openDatastore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedDatastore = db
+	defer func() { sharedDatastore = nil }()
+
+	var buffer bytes.Buffer
+	output = &buffer
+	defer func() { output = os.Stdout }()
+
+	sh := NewShell([]BdmCommand{NewDevices(), NewVersions()}).(*shell)
+	for _, line := range []string{
+		"--format=csv devices where 'isp = \"Safaricom Limited\"'",
+		"versions",
+	} {
+		if err := sh.runLine(line); err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+	}
+	want := `node_id,ip_address,country,version,last_probe,status,outage_duration,asn,isp,city
+OW0000000004,41.1.1.1,KE,1.1,2013-06-30T12:00:00Z,down,172800,33771,Safaricom Limited,Nairobi
+VERSION  TOTAL  PERCENTAGE  ONLINE  STALE  OFFLINE  ONLINE PERCENTAGE
+1.0      3      50%         1       1      1        33%
+1.1      3      50%         1       0      2        33%
+`
+	if got := buffer.String(); got != want {
+		t.Errorf("Got\n%s\nwant\n%s", got, want)
+	}
+
+	if err := sh.runLine("colours"); err == nil || err.Error() != "Unknown command: colours" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := sh.runLine("--no_such_option devices"); err == nil {
+		t.Errorf("Accepted an unknown option")
+	}
+	if err := sh.runLine("quit"); err != errExit {
+		t.Errorf("Got %v from quit", err)
+	}
+}
@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type snapshot struct{}
+
+func NewSnapshot() BdmCommand {
+	return new(snapshot)
+}
+
+func (snapshot) Name() string {
+	return "snapshot"
+}
+
+func (snapshot) Description() string {
+	return "Save every device into --snapshot_dir for later --as_of queries and diffs: snapshot [--list]"
+}
+
+func addAsOfFlag(flagset *flag.FlagSet) *string {
+	return flagset.String("as_of", "", "Answer from the snapshot taken nearest to this time instead of the live datastore")
+}
+
+// sharedDatastore, if set, is the live datastore for every command, so that
+// the shell can keep one open between commands.
+var sharedDatastore datastore.Datastore
+
+// A sharedHandle is a command's handle on sharedDatastore, which the command
+// mustn't close.
+type sharedHandle struct {
+	datastore.Datastore
+}
+
+func (sharedHandle) Close() {}
+
+// openDatastore opens the live datastore, or if asOf is set, the snapshot
+// taken nearest to that time.
+func openDatastore(asOf string) (datastore.Datastore, error) {
+	if asOf == "" && sharedDatastore != nil {
+		return sharedHandle{sharedDatastore}, nil
+	}
+	if asOf == "" {
+		return datastore.NewDatastore()
+	}
+	timestamp, err := parseTimestamp(asOf)
+	if err != nil {
+		return nil, err
+	}
+	db, taken, err := datastore.NewSnapshotDatastore(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if !taken.Equal(timestamp) {
+		log.Printf("Using the snapshot taken at %s", taken.Format(time.RFC3339))
+	}
+	return db, nil
+}
+
+func (snapshot) Run(args []string) error {
+	flagset := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	list := flagset.Bool("list", false, "List existing snapshots instead of taking a new one")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if flagset.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments: %v", flagset.Args())
+	}
+
+	if *list {
+		timestamps, err := datastore.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		writer, err := newRecordWriter(output, "taken")
+		if err != nil {
+			return err
+		}
+		for _, timestamp := range timestamps {
+			if err := writer.WriteRecord(timestamp); err != nil {
+				return err
+			}
+		}
+		return writer.Flush()
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	filename, err := datastore.WriteSnapshot(ctx, db, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote %s", filename)
+	return nil
+}
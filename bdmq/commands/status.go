@@ -1,12 +1,12 @@
 package commands
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	_ "github.com/bmizerany/pq"
 	"github.com/sburnett/bismark-tools/bdmq/datastore"
-	"os"
 	"strings"
-	"text/tabwriter"
 	"time"
 )
 
@@ -24,19 +24,19 @@ func (status) Description() string {
 	return "Show information about a single device"
 }
 
-func (status) printSummaryTable() error {
-	db, err := datastore.NewPostgresDatastore()
-	if err != nil {
-		return err
-	}
-	defer db.Close()
+// A statusRow is one line of the summary table. The label is for tables and
+// the key is for machine-readable formats.
+type statusRow struct {
+	label, key string
+	count      int
+}
 
+func summarizeDevices(ctx context.Context, db datastore.Datastore) ([]statusRow, error) {
 	var total, online, stale, offline, offlineHour, offlineDay, offlineWeek, offlineMonth int
-	for r := range db.SelectDevices([]datastore.Identifier{datastore.NodeId}, []datastore.Order{datastore.Ascending}, 0, "", "", "", "", nil) {
-		if r.Error != nil {
-			return r.Error
-		}
-
+	devices := db.SelectDevices(ctx, []datastore.Identifier{datastore.NodeId}, []datastore.Order{datastore.Ascending}, 0, nil)
+	defer devices.Close()
+	for devices.Next() {
+		r := devices.Result()
 		total++
 		switch r.DeviceStatus {
 		case datastore.Online:
@@ -62,48 +62,118 @@ func (status) printSummaryTable() error {
 			offlineMonth++
 		}
 	}
+	if err := devices.Err(); err != nil {
+		return nil, err
+	}
 
-	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
-	defer writer.Flush()
-	fprintWithTabs(writer, "DEVICE STATUS", "COUNT", "PERCENTAGE")
-	fprintWithTabs(writer, "Online", online, percentage(online, total))
-	fprintWithTabs(writer, "Stale", stale, percentage(stale, total))
-	fprintWithTabs(writer, "Offline", offline, percentage(offline, total))
-	fprintWithTabs(writer, "  past hour", offlineHour, percentage(offlineHour, total))
-	fprintWithTabs(writer, "  past day", offlineDay, percentage(offlineDay, total))
-	fprintWithTabs(writer, "  past week", offlineWeek, percentage(offlineWeek, total))
-	fprintWithTabs(writer, "  past month", offlineMonth, percentage(offlineMonth, total))
-	fprintWithTabs(writer, "Total", total, "100%")
+	return []statusRow{
+		{"Online", "online", online},
+		{"Stale", "stale", stale},
+		{"Offline", "offline", offline},
+		{"  past hour", "offline_past_hour", offlineHour},
+		{"  past day", "offline_past_day", offlineDay},
+		{"  past week", "offline_past_week", offlineWeek},
+		{"  past month", "offline_past_month", offlineMonth},
+		{"Total", "total", total},
+	}, nil
+}
 
-	return nil
+func (status) printSummaryTable(asOf string) error {
+	db, err := openDatastore(asOf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	rows, err := summarizeDevices(ctx, db)
+	if err != nil {
+		return err
+	}
+	total := rows[len(rows)-1].count
+	writer, err := newRecordWriter(output, "device_status", "count", "percentage")
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		label := row.label
+		if !isTableFormat() {
+			label = row.key
+		}
+		if err := writer.WriteRecord(label, row.count, percentage{row.count, total}); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
 }
 
 func (cmd status) Run(args []string) error {
+	flagset := flag.NewFlagSet("status", flag.ContinueOnError)
+	asOf := addAsOfFlag(flagset)
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	args = flagset.Args()
 	if len(args) == 0 {
-		return cmd.printSummaryTable()
+		return cmd.printSummaryTable(*asOf)
 	}
 
-	realCommand := NewDevices()
+	db, err := openDatastore(*asOf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+
+	// Tables show each query separately, but machine-readable formats
+	// gather the devices of all queries into one document.
+	var writer recordWriter
 	for idx, arg := range args {
-		if idx > 0 {
-			fmt.Println()
+		query := statusQuery(arg)
+		params, err := parseDeviceQuery(query)
+		if err != nil {
+			return err
 		}
-
-		var query []string
-		if _, err := parseDeviceStatus(arg); err == nil {
-			query = []string{"where", "status", "is", arg, "order", "by", "status,id"}
-		} else if strings.ContainsAny(arg, "./:") {
-			query = []string{"where", "ip", "in", arg, "order", "by", "ip,duration"}
-		} else if len(arg) == 2 {
-			query = []string{"where", "country", "=", arg}
-		} else {
-			query = []string{"where", "id", "like", arg}
+		if isTableFormat() {
+			if idx > 0 {
+				fmt.Fprintln(output)
+			}
+			fmt.Fprintln(output, "Query:", "devices", query)
+			writer = nil
 		}
-
-		fmt.Println("Query:", "devices", strings.Join(query, " "))
-		if err := realCommand.Run(query); err != nil {
+		if writer == nil {
+			if writer, err = newRecordWriter(output, deviceFields...); err != nil {
+				return err
+			}
+		}
+		if err := writeDevices(ctx, db, params, writer); err != nil {
 			return err
 		}
+		if isTableFormat() {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if isTableFormat() {
+		return nil
+	}
+	return writer.Flush()
+}
+
+// statusQuery returns the devices query for one argument of status, which
+// may be a device status, an IP address or prefix, a country code or part of
+// a node ID.
+func statusQuery(arg string) string {
+	if _, err := parseDeviceStatus(arg); err == nil {
+		return "where status is " + arg + " order by status,id"
+	} else if strings.ContainsAny(arg, "./:") {
+		return "where ip in " + arg + " order by ip,duration"
+	} else if len(arg) == 2 {
+		return "where country = " + arg
 	}
-	return nil
+	return "where id like " + arg
 }
@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type summarize struct{}
+
+func NewSummarize() BdmCommand {
+	return new(summarize)
+}
+
+func (summarize) Name() string {
+	return "summarize"
+}
+
+func (summarize) Description() string {
+	return "Count devices by status in groups: summarize [--as_of=<time>] by <field>[,<field>...] [where ...]"
+}
+
+// summaryFieldName names the column of a field like the devices command does.
+func summaryFieldName(field datastore.Field) string {
+	switch field {
+	case datastore.NodeIdField:
+		return "node_id"
+	case datastore.IpAddressField:
+		return "ip_address"
+	default:
+		return field.String()
+	}
+}
+
+func summaryKey(field datastore.Field, key string) interface{} {
+	if field == datastore.AsnField {
+		asn, _ := strconv.Atoi(key)
+		return asnValue(asn)
+	}
+	return key
+}
+
+// summaryRecords runs a summary query and returns the fields and values of
+// each group.
+func summaryRecords(ctx context.Context, db datastore.Datastore, params *SummaryQuery) ([]string, [][]interface{}, error) {
+	var results []*datastore.SummaryResult
+	total := 0
+	summaries := datastore.Summarize(ctx, db, params.GroupBy, params.Filter)
+	defer summaries.Close()
+	for summaries.Next() {
+		r := summaries.Result()
+		results = append(results, r)
+		total += r.Count
+	}
+	if err := summaries.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var fields []string
+	for _, field := range params.GroupBy {
+		fields = append(fields, summaryFieldName(field))
+	}
+	fields = append(fields, "total", "percentage", "online", "stale", "offline", "online_percentage")
+	var records [][]interface{}
+	for _, r := range results {
+		var values []interface{}
+		for idx, field := range params.GroupBy {
+			values = append(values, summaryKey(field, r.Keys[idx]))
+		}
+		values = append(values, r.Count, percentage{r.Count, total}, r.OnlineCount, r.StaleCount, r.OfflineCount, percentage{r.OnlineCount, r.Count})
+		records = append(records, values)
+	}
+	return fields, records, nil
+}
+
+func (summarize) Run(args []string) error {
+	return runSummarize("summarize", "", args)
+}
+
+// runSummarize parses the flags at the start of args and then summarizes by
+// groupBy, if it's set, using the rest of args as the query. This lets
+// aliases like versions accept the same flags as summarize.
+func runSummarize(name, groupBy string, args []string) error {
+	flagset := flag.NewFlagSet(name, flag.ContinueOnError)
+	asOf := addAsOfFlag(flagset)
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	query := strings.Join(flagset.Args(), " ")
+	if groupBy != "" {
+		query = "by " + groupBy + " " + query
+	}
+	params, err := parseSummaryQuery(query)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatastore(*asOf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryContext()
+	defer cancel()
+	fields, records, err := summaryRecords(ctx, db, params)
+	if err != nil {
+		return err
+	}
+	writer, err := newRecordWriter(output, fields...)
+	if err != nil {
+		return err
+	}
+	for _, values := range records {
+		if err := writer.WriteRecord(values...); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
@@ -1,12 +1,60 @@
 package commands
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// Commands write their results here.
+var output io.Writer = os.Stdout
+
+var queryTimeout time.Duration
+
+func init() {
+	flag.DurationVar(&queryTimeout, "query_timeout", 0, "Give up on commands whose datastore queries take longer than this; 0 means never")
+}
+
+// queryContext returns the context for a command's datastore queries, which
+// ends after --query_timeout. Callers must call cancel when they're done.
+func queryContext() (ctx context.Context, cancel context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), queryTimeout)
+}
+
 func fprintWithTabs(writer io.Writer, values ...interface{}) (int, error) {
 	formatString := strings.Repeat("%v\t", len(values))
 	return fmt.Fprintf(writer, strings.TrimRight(formatString, "\t")+"\n", values...)
 }
+
+// listenAndServe runs server until SIGINT or SIGTERM, then stops accepting
+// connections and gives requests in flight up to timeout to finish, so that
+// callers can close the datastore afterward.
+func listenAndServe(server *http.Server, timeout time.Duration) error {
+	stopped := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		signal.Stop(signals)
+		log.Printf("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		stopped <- server.Shutdown(ctx)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-stopped
+}
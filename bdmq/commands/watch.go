@@ -0,0 +1,158 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+type watch struct{}
+
+func NewWatch() BdmCommand {
+	return new(watch)
+}
+
+func (watch) Name() string {
+	return "watch"
+}
+
+func (watch) Description() string {
+	return "Poll devices and print changes: watch [--interval=<duration>] [where ...]"
+}
+
+type watchEvent struct {
+	NodeId, Event, From, To string
+}
+
+// A slice of watchEvents that implements sort.Interface to sort by NodeId.
+type watchEventList []watchEvent
+
+func (l watchEventList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l watchEventList) Len() int           { return len(l) }
+func (l watchEventList) Less(i, j int) bool { return l[i].NodeId < l[j].NodeId }
+
+// diffSnapshots compares two snapshots of every device, keyed by node ID,
+// and returns changes to devices that match filter in either snapshot.
+func diffSnapshots(previous, current map[string]*datastore.DevicesResult, filter datastore.Filter) []watchEvent {
+	matches := func(device *datastore.DevicesResult) bool {
+		return device != nil && (filter == nil || filter.Matches(device))
+	}
+
+	var events watchEventList
+	for nodeId, after := range current {
+		before := previous[nodeId]
+		if !matches(before) && !matches(after) {
+			continue
+		}
+		if before == nil {
+			events = append(events, watchEvent{nodeId, "first_seen", "", after.DeviceStatus.String()})
+			continue
+		}
+		if before.DeviceStatus != after.DeviceStatus {
+			events = append(events, watchEvent{nodeId, "status", before.DeviceStatus.String(), after.DeviceStatus.String()})
+		}
+		if before.IpAddress != after.IpAddress {
+			events = append(events, watchEvent{nodeId, "ip_address", before.IpAddress, after.IpAddress})
+		}
+		if before.Version != after.Version {
+			events = append(events, watchEvent{nodeId, "version", before.Version, after.Version})
+		}
+	}
+	for nodeId, before := range previous {
+		if _, ok := current[nodeId]; !ok && matches(before) {
+			events = append(events, watchEvent{nodeId, "removed", before.DeviceStatus.String(), ""})
+		}
+	}
+	sort.Stable(events)
+	return events
+}
+
+// selectSnapshot returns every device by node ID.
+func selectSnapshot(ctx context.Context, db datastore.Datastore) (map[string]*datastore.DevicesResult, error) {
+	snapshot := make(map[string]*datastore.DevicesResult)
+	devices := db.SelectDevices(ctx, nil, nil, 0, nil)
+	defer devices.Close()
+	for devices.Next() {
+		snapshot[devices.Result().NodeId] = devices.Result()
+	}
+	if err := devices.Err(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (watch) Run(args []string) error {
+	flagset := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := flagset.Duration("interval", time.Minute, "Poll the datastore this often")
+	if err := flagset.Parse(args); err != nil {
+		return err
+	}
+	if outputFormat == "json" {
+		return fmt.Errorf("watch streams its output; use --format=jsonl instead of json")
+	}
+
+	// Only the where clause is meaningful, since every poll compares all
+	// matching devices.
+	params, err := parseDeviceQuery(strings.Join(flagset.Args(), " "))
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatastore("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	writer, err := newRecordWriter(output, "timestamp", "node_id", "event", "from", "to")
+	if err != nil {
+		return err
+	}
+	defer writer.Flush()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	// Each poll gets --query_timeout to finish.
+	poll := func() (map[string]*datastore.DevicesResult, error) {
+		ctx, cancel := queryContext()
+		defer cancel()
+		return selectSnapshot(ctx, db)
+	}
+	previous, err := poll()
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-interrupts:
+			return nil
+		case <-ticker.C:
+		}
+
+		current, err := poll()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, event := range diffSnapshots(previous, current, params.Filter) {
+			if err := writer.WriteRecord(now, event.NodeId, event.Event, event.From, event.To); err != nil {
+				return err
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		previous = current
+	}
+}
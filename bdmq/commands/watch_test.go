@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/sburnett/bismark-tools/bdmq/datastore"
+)
+
+func printSnapshotDiff(filter datastore.Filter) {
+	previous := map[string]*datastore.DevicesResult{
+		"OW0000000001": {NodeId: "OW0000000001", IpAddress: "1.1.1.1", Version: "1.0", DeviceStatus: datastore.Online},
+		"OW0000000002": {NodeId: "OW0000000002", IpAddress: "2.2.2.2", Version: "1.0", DeviceStatus: datastore.Stale},
+		"OW0000000003": {NodeId: "OW0000000003", IpAddress: "3.3.3.3", Version: "1.0", DeviceStatus: datastore.Offline},
+		"OW0000000004": {NodeId: "OW0000000004", IpAddress: "4.4.4.4", Version: "1.0", DeviceStatus: datastore.Online},
+	}
+	current := map[string]*datastore.DevicesResult{
+		"OW0000000001": {NodeId: "OW0000000001", IpAddress: "1.1.1.1", Version: "1.0", DeviceStatus: datastore.Stale},
+		"OW0000000002": {NodeId: "OW0000000002", IpAddress: "2.2.2.2", Version: "1.0", DeviceStatus: datastore.Offline},
+		"OW0000000003": {NodeId: "OW0000000003", IpAddress: "3.3.3.9", Version: "1.1", DeviceStatus: datastore.Online},
+		"OW0000000005": {NodeId: "OW0000000005", IpAddress: "5.5.5.5", Version: "1.1", DeviceStatus: datastore.Online},
+	}
+	for _, event := range diffSnapshots(previous, current, filter) {
+		fmt.Printf("%s %s %q -> %q\n", event.NodeId, event.Event, event.From, event.To)
+	}
+}
+
+func ExampleNewWatch_allDevices() {
+	printSnapshotDiff(nil)
+
+	// Output:
+	//
+	// OW0000000001 status "up" -> "stale"
+	// OW0000000002 status "stale" -> "down"
+	// OW0000000003 status "down" -> "up"
+	// OW0000000003 ip_address "3.3.3.3" -> "3.3.3.9"
+	// OW0000000003 version "1.0" -> "1.1"
+	// OW0000000004 removed "up" -> ""
+	// OW0000000005 first_seen "" -> "up"
+}
+
+func ExampleNewWatch_filtered() {
+	printSnapshotDiff(&datastore.Comparison{
+		Field:    datastore.StatusField,
+		Operator: datastore.Equals,
+		Values:   []interface{}{datastore.Offline},
+	})
+
+	// Output:
+	//
+	// OW0000000002 status "stale" -> "down"
+	// OW0000000003 status "down" -> "up"
+	// OW0000000003 ip_address "3.3.3.3" -> "3.3.3.9"
+	// OW0000000003 version "1.0" -> "1.1"
+}
@@ -1,36 +1,109 @@
 package datastore
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
 	"time"
 )
 
+var datastoreSpec string
+
+func init() {
+	flag.StringVar(&datastoreSpec, "datastore", "postgres", "Where to read devices from: postgres, sqlite:PATH or fixture:PATH")
+}
+
+// Asn, Isp and City are only known if the datastore has the corresponding
+// GeoIP databases; otherwise Asn is 0 and Isp and City are "??".
 type DevicesResult struct {
 	NodeId, IpAddress, CountryCode, Version string
+	Asn                                     int
+	Isp, City                               string
 	LastSeen                                time.Time
 	DeviceStatus                            DeviceStatus
 	OutageDuration                          time.Duration
 	OutageDurationText                      string
-
-	Error error
+	// Tags and Attributes come from the node registry (see --registry).
+	Tags       []string
+	Attributes map[string]string
 }
 
+// For VersionsResult, CountriesResult and IspsResult, OnlineCount,
+// StaleCount and OfflineCount count the devices in the group with each
+// DeviceStatus, so they add up to Count.
 type VersionsResult struct {
-	Version            string
-	Count, OnlineCount int
-
-	Error error
+	Version                                      string
+	Count, OnlineCount, StaleCount, OfflineCount int
 }
 
 type CountriesResult struct {
-	Country            string
-	Count, OnlineCount int
+	Country                                      string
+	Count, OnlineCount, StaleCount, OfflineCount int
+}
 
-	Error error
+type IspsResult struct {
+	Asn                                          int
+	Isp                                          string
+	Count, OnlineCount, StaleCount, OfflineCount int
 }
 
+// CountryCode and Asn locate the probe's IpAddress like DevicesResult.
+type ProbesResult struct {
+	NodeId, IpAddress string
+	CountryCode       string
+	Asn               int
+	Timestamp         time.Time
+}
+
+// LifetimesResult is the first and last time a node appears in the probe log.
+type LifetimesResult struct {
+	NodeId                string
+	FirstProbe, LastProbe time.Time
+}
+
+// A Datastore answers queries about the fleet. Queries return iterators that
+// work like sql.Rows and stop early once ctx is done. Callers must Close each
+// iterator unless they read until Next returns false.
 type Datastore interface {
-	SelectDevices(orderBy []Identifier, order []Order, limit int, nodeIdConstraint, ipAddressConstraint, countryCodeConstraint, versionConstraint string, deviceStatusConstraint *DeviceStatus) chan *DevicesResult
-	SelectVersions() chan *VersionsResult
-	SelectCountries() chan *CountriesResult
+	// SelectDevices returns devices matching filter, or all devices if filter
+	// is nil.
+	SelectDevices(ctx context.Context, orderBy []Identifier, order []Order, limit int, filter Filter) *DevicesIterator
+	SelectVersions(ctx context.Context) *VersionsIterator
+	SelectCountries(ctx context.Context) *CountriesIterator
+	// SelectIsps groups devices by their AS number.
+	SelectIsps(ctx context.Context) *IspsIterator
+	// SelectProbes returns every probe a node sent between since (inclusive)
+	// and until (exclusive), ordered by time.
+	SelectProbes(ctx context.Context, nodeId string, since, until time.Time) *ProbesIterator
+	// SelectAllProbes returns every probe any node sent between since
+	// (inclusive) and until (exclusive), ordered by node ID and time.
+	SelectAllProbes(ctx context.Context, since, until time.Time) *ProbesIterator
+	// SelectLifetimes returns the first and last probe of every node in the
+	// probe log, ordered by node ID.
+	SelectLifetimes(ctx context.Context) *LifetimesIterator
 	Close()
 }
+
+// NewDatastore opens the datastore chosen with the --datastore flag, using
+// the thresholds from LoadThresholds.
+func NewDatastore() (Datastore, error) {
+	thresholds, err := LoadThresholds()
+	if err != nil {
+		return nil, err
+	}
+	kind, path := datastoreSpec, ""
+	if idx := strings.Index(datastoreSpec, ":"); idx >= 0 {
+		kind, path = datastoreSpec[:idx], datastoreSpec[idx+1:]
+	}
+	switch {
+	case kind == "postgres" && path == "":
+		return NewPostgresDatastore(thresholds)
+	case kind == "sqlite" && path != "":
+		return NewSqliteDatastore(path, thresholds)
+	case kind == "fixture" && path != "":
+		return NewFixtureDatastore(path, thresholds)
+	default:
+		return nil, fmt.Errorf("Invalid datastore: %s", datastoreSpec)
+	}
+}
@@ -0,0 +1,410 @@
+package datastore
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A Filter is a boolean expression over the fields of a device. Filters are
+// built by the bdmq query parser and are either evaluated against
+// DevicesResults directly or translated into SQL by a Datastore.
+type Filter interface {
+	Matches(device *DevicesResult) bool
+	String() string
+}
+
+type Field int
+
+const (
+	NodeIdField Field = iota
+	IpAddressField
+	CountryField
+	VersionField
+	StatusField
+	LastProbeField
+	OutageDurationField
+	AsnField
+	IspField
+	CityField
+	TagField
+	// AttributeField stands for every registry attribute when parsing
+	// queries. Filters compare attributes with AttributeComparison.
+	AttributeField
+)
+
+func (field Field) String() string {
+	switch field {
+	case NodeIdField:
+		return "id"
+	case IpAddressField:
+		return "ip"
+	case CountryField:
+		return "country"
+	case VersionField:
+		return "version"
+	case StatusField:
+		return "status"
+	case LastProbeField:
+		return "last_probe"
+	case OutageDurationField:
+		return "outage_duration"
+	case AsnField:
+		return "asn"
+	case IspField:
+		return "isp"
+	case CityField:
+		return "city"
+	case TagField:
+		return "tag"
+	case AttributeField:
+		return "attr"
+	default:
+		panic(fmt.Errorf("Missing Field.String() case"))
+	}
+}
+
+// Ordered fields can be compared with <, <=, > and >=.
+func (field Field) Ordered() bool {
+	return field == LastProbeField || field == OutageDurationField
+}
+
+// Groupable fields can be used to group devices with Summarize. A device can
+// have many tags, so tags aren't groupable.
+func (field Field) Groupable() bool {
+	return !field.Ordered() && field != TagField && field != AttributeField
+}
+
+// GroupKey returns a device's value of a groupable field as a string.
+func GroupKey(field Field, device *DevicesResult) string {
+	switch field {
+	case NodeIdField:
+		return device.NodeId
+	case IpAddressField:
+		return device.IpAddress
+	case CountryField:
+		return device.CountryCode
+	case VersionField:
+		return device.Version
+	case StatusField:
+		return device.DeviceStatus.String()
+	case AsnField:
+		return strconv.Itoa(device.Asn)
+	case IspField:
+		return device.Isp
+	case CityField:
+		return device.City
+	default:
+		panic(fmt.Errorf("Can't group by %s", field))
+	}
+}
+
+type Operator int
+
+const (
+	Equals Operator = iota
+	NotEquals
+	In
+	LessThan
+	LessOrEqual
+	GreaterThan
+	GreaterOrEqual
+)
+
+func (operator Operator) String() string {
+	switch operator {
+	case Equals:
+		return "="
+	case NotEquals:
+		return "!="
+	case In:
+		return "IN"
+	case LessThan:
+		return "<"
+	case LessOrEqual:
+		return "<="
+	case GreaterThan:
+		return ">"
+	case GreaterOrEqual:
+		return ">="
+	default:
+		panic(fmt.Errorf("Missing Operator.String() case"))
+	}
+}
+
+// A Comparison compares a field against one or more values. Values are
+// strings, except for StatusField (DeviceStatus), LastProbeField (time.Time),
+// OutageDurationField (time.Duration) and AsnField (int). Only In takes more
+// than one value.
+//
+// Equality depends on the field: node IDs match case insensitively on their
+// suffix, IP addresses match if they are within the given prefix and country
+// codes, ISPs and cities match case insensitively. Tags match if the device
+// has any tag equal to the value, ignoring case. Use AttributeComparison
+// rather than AttributeField to compare registry attributes.
+type Comparison struct {
+	Field    Field
+	Operator Operator
+	Values   []interface{}
+}
+
+func (c *Comparison) Matches(device *DevicesResult) bool {
+	switch c.Operator {
+	case Equals:
+		return fieldEquals(c.Field, device, c.Values[0])
+	case NotEquals:
+		return !fieldEquals(c.Field, device, c.Values[0])
+	case In:
+		for _, value := range c.Values {
+			if fieldEquals(c.Field, device, value) {
+				return true
+			}
+		}
+		return false
+	default:
+		cmp := compareField(c.Field, device, c.Values[0])
+		switch c.Operator {
+		case LessThan:
+			return cmp < 0
+		case LessOrEqual:
+			return cmp <= 0
+		case GreaterThan:
+			return cmp > 0
+		case GreaterOrEqual:
+			return cmp >= 0
+		}
+	}
+	panic(fmt.Errorf("Missing Comparison.Matches() case"))
+}
+
+func (c *Comparison) String() string {
+	return formatComparison(c.Field.String(), c.Operator, c.Values)
+}
+
+func formatComparison(name string, operator Operator, values []interface{}) string {
+	if operator != In {
+		return fmt.Sprintf("%s %s %s", name, operator, formatFilterValue(values[0]))
+	}
+	var formatted []string
+	for _, value := range values {
+		formatted = append(formatted, formatFilterValue(value))
+	}
+	return fmt.Sprintf("%s IN (%s)", name, strings.Join(formatted, ", "))
+}
+
+func formatFilterValue(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// An AttributeComparison compares a registry attribute against one or more
+// strings with Equals, NotEquals or In, ignoring case. Devices without the
+// attribute have the empty string.
+type AttributeComparison struct {
+	Attribute string
+	Operator  Operator
+	Values    []interface{}
+}
+
+func (c *AttributeComparison) Matches(device *DevicesResult) bool {
+	actual := device.Attributes[strings.ToLower(c.Attribute)]
+	switch c.Operator {
+	case Equals:
+		return strings.EqualFold(actual, c.Values[0].(string))
+	case NotEquals:
+		return !strings.EqualFold(actual, c.Values[0].(string))
+	case In:
+		for _, value := range c.Values {
+			if strings.EqualFold(actual, value.(string)) {
+				return true
+			}
+		}
+		return false
+	default:
+		panic(fmt.Errorf("Attributes can't be compared with %s", c.Operator))
+	}
+}
+
+func (c *AttributeComparison) String() string {
+	return formatComparison(fmt.Sprintf("%s.%s", AttributeField, strings.ToLower(c.Attribute)), c.Operator, c.Values)
+}
+
+func fieldEquals(field Field, device *DevicesResult, value interface{}) bool {
+	switch field {
+	case NodeIdField:
+		return strings.HasSuffix(strings.ToLower(device.NodeId), strings.ToLower(value.(string)))
+	case IpAddressField:
+		_, prefix, err := ParsePrefix(value.(string))
+		if err != nil {
+			return false
+		}
+		return prefix.Contains(net.ParseIP(device.IpAddress))
+	case CountryField:
+		return strings.EqualFold(device.CountryCode, value.(string))
+	case VersionField:
+		return device.Version == value.(string)
+	case StatusField:
+		return device.DeviceStatus == value.(DeviceStatus)
+	case LastProbeField:
+		return device.LastSeen.Equal(value.(time.Time))
+	case OutageDurationField:
+		return device.OutageDuration == value.(time.Duration)
+	case AsnField:
+		return device.Asn == value.(int)
+	case IspField:
+		return strings.EqualFold(device.Isp, value.(string))
+	case CityField:
+		return strings.EqualFold(device.City, value.(string))
+	case TagField:
+		for _, tag := range device.Tags {
+			if strings.EqualFold(tag, value.(string)) {
+				return true
+			}
+		}
+		return false
+	default:
+		panic(fmt.Errorf("Missing fieldEquals() case"))
+	}
+}
+
+func compareField(field Field, device *DevicesResult, value interface{}) int {
+	switch field {
+	case LastProbeField:
+		switch t := value.(time.Time); {
+		case device.LastSeen.Before(t):
+			return -1
+		case device.LastSeen.After(t):
+			return 1
+		default:
+			return 0
+		}
+	case OutageDurationField:
+		switch d := value.(time.Duration); {
+		case device.OutageDuration < d:
+			return -1
+		case device.OutageDuration > d:
+			return 1
+		default:
+			return 0
+		}
+	default:
+		panic(fmt.Errorf("Field %s is not ordered", field))
+	}
+}
+
+// ParsePrefix parses an IP address or CIDR prefix. Like Postgres's inet type,
+// it accepts abbreviated IPv4 prefixes such as 143.215/16.
+func ParsePrefix(text string) (net.IP, *net.IPNet, error) {
+	if !strings.Contains(text, "/") {
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("Invalid IP address: %s", text)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	address := text[:strings.Index(text, "/")]
+	if !strings.Contains(address, ":") {
+		if octets := strings.Count(address, ".") + 1; octets < 4 {
+			address += strings.Repeat(".0", 4-octets)
+		}
+	}
+	ip, prefix, err := net.ParseCIDR(address + text[strings.Index(text, "/"):])
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid IP prefix: %s", text)
+	}
+	return ip, prefix, nil
+}
+
+// ParseDuration is like time.ParseDuration, but also accepts days (d) and
+// weeks (w), e.g., "2d" or "1w3d12h".
+func ParseDuration(text string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"w": 7 * 24 * time.Hour,
+		"d": 24 * time.Hour,
+		"h": time.Hour,
+		"m": time.Minute,
+		"s": time.Second,
+	}
+	if text == "" {
+		return 0, fmt.Errorf("Empty duration")
+	}
+	var duration time.Duration
+	rest := strings.ToLower(text)
+	for rest != "" {
+		numberLength := strings.IndexFunc(rest, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+		if numberLength <= 0 {
+			return 0, fmt.Errorf("Invalid duration: %s", text)
+		}
+		number, err := strconv.ParseFloat(rest[:numberLength], 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid duration: %s", text)
+		}
+		rest = rest[numberLength:]
+		unitLength := strings.IndexFunc(rest, func(r rune) bool { return !unicode.IsLetter(r) })
+		if unitLength < 0 {
+			unitLength = len(rest)
+		}
+		unit, ok := units[rest[:unitLength]]
+		if !ok {
+			return 0, fmt.Errorf("Invalid duration: %s", text)
+		}
+		rest = rest[unitLength:]
+		duration += time.Duration(number * float64(unit))
+	}
+	return duration, nil
+}
+
+type AndFilter struct {
+	Left, Right Filter
+}
+
+func (f *AndFilter) Matches(device *DevicesResult) bool {
+	return f.Left.Matches(device) && f.Right.Matches(device)
+}
+
+func (f *AndFilter) String() string {
+	return fmt.Sprintf("%s AND %s", parenthesize(f.Left), parenthesize(f.Right))
+}
+
+type OrFilter struct {
+	Left, Right Filter
+}
+
+func (f *OrFilter) Matches(device *DevicesResult) bool {
+	return f.Left.Matches(device) || f.Right.Matches(device)
+}
+
+func (f *OrFilter) String() string {
+	return fmt.Sprintf("%s OR %s", parenthesize(f.Left), parenthesize(f.Right))
+}
+
+type NotFilter struct {
+	Operand Filter
+}
+
+func (f *NotFilter) Matches(device *DevicesResult) bool {
+	return !f.Operand.Matches(device)
+}
+
+func (f *NotFilter) String() string {
+	return fmt.Sprintf("NOT %s", parenthesize(f.Operand))
+}
+
+func parenthesize(filter Filter) string {
+	switch filter.(type) {
+	case *Comparison, *AttributeComparison:
+		return filter.String()
+	}
+	return fmt.Sprintf("(%s)", filter)
+}
@@ -0,0 +1,21 @@
+package datastore
+
+import (
+	"fmt"
+)
+
+func ExampleParseDuration() {
+	for _, text := range []string{"2d", "1w3d12h", "90s", "1.5h", "", "3", "2y"} {
+		fmt.Println(ParseDuration(text))
+	}
+
+	// Output:
+	//
+	// 48h0m0s <nil>
+	// 252h0m0s <nil>
+	// 1m30s <nil>
+	// 1h30m0s <nil>
+	// 0s Empty duration
+	// 0s Invalid duration: 3
+	// 0s Invalid duration: 2y
+}
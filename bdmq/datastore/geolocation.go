@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/abh/geoip"
+)
+
+var geoipDatabase, geoipAsnDatabase, geoipCityDatabase string
+
+func init() {
+	flag.StringVar(&geoipDatabase, "geoip_database", "/usr/share/GeoIP/GeoIP.dat", "Path of GeoIP database")
+	flag.StringVar(&geoipAsnDatabase, "geoip_asn_database", "", "Path of GeoIP ASN database (e.g., GeoIPASNum.dat); if unset, ASNs and ISPs are unknown")
+	flag.StringVar(&geoipCityDatabase, "geoip_city_database", "", "Path of GeoIP city database (e.g., GeoLiteCity.dat); if unset, cities are unknown")
+}
+
+// A geolocator fills in the location of devices from their IP addresses. The
+// ASN and city databases are optional, and a geolocator without any
+// databases knows nothing.
+type geolocator struct {
+	country, asn, city *geoip.GeoIP
+}
+
+func newGeolocator() (*geolocator, error) {
+	var g geolocator
+	var err error
+	if g.country, err = geoip.Open(geoipDatabase); err != nil {
+		return nil, err
+	}
+	if geoipAsnDatabase != "" {
+		if g.asn, err = geoip.Open(geoipAsnDatabase); err != nil {
+			return nil, err
+		}
+	}
+	if geoipCityDatabase != "" {
+		if g.city, err = geoip.Open(geoipCityDatabase); err != nil {
+			return nil, err
+		}
+	}
+	return &g, nil
+}
+
+// parseAsName splits names from the ASN database, like "AS7922 Comcast Cable
+// Communications, Inc.", into the AS number and the name of the ISP.
+func parseAsName(name string) (int, string) {
+	if !strings.HasPrefix(name, "AS") {
+		return 0, ""
+	}
+	number, isp := name[2:], ""
+	if idx := strings.Index(number, " "); idx >= 0 {
+		number, isp = number[:idx], strings.TrimSpace(number[idx+1:])
+	}
+	asn, err := strconv.Atoi(number)
+	if err != nil {
+		return 0, ""
+	}
+	return asn, isp
+}
+
+// A location is what the GeoIP databases know about an IP address. Unknown
+// countries, ISPs and cities are "??" and unknown ASNs are 0.
+type location struct {
+	CountryCode string
+	Asn         int
+	Isp, City   string
+}
+
+func (g *geolocator) lookup(ipAddress string) location {
+	var l location
+	if g.country != nil {
+		l.CountryCode, _ = g.country.GetCountry(ipAddress)
+	}
+	if l.CountryCode == "" {
+		l.CountryCode = "??"
+	}
+	if g.asn != nil {
+		name, _ := g.asn.GetName(ipAddress)
+		l.Asn, l.Isp = parseAsName(name)
+	}
+	if l.Isp == "" {
+		l.Isp = "??"
+	}
+	if g.city != nil {
+		if record := g.city.GetRecord(ipAddress); record != nil {
+			l.City = record.City
+		}
+	}
+	if l.City == "" {
+		l.City = "??"
+	}
+	return l
+}
+
+// locate sets the CountryCode, Asn, Isp and City of device from its
+// IpAddress.
+func (g *geolocator) locate(device *DevicesResult) {
+	l := g.lookup(device.IpAddress)
+	device.CountryCode, device.Asn, device.Isp, device.City = l.CountryCode, l.Asn, l.Isp, l.City
+}
+
+// locateProbe sets the CountryCode and Asn of probe from its IpAddress.
+func (g *geolocator) locateProbe(probe *ProbesResult) {
+	l := g.lookup(probe.IpAddress)
+	probe.CountryCode, probe.Asn = l.CountryCode, l.Asn
+}
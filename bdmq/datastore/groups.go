@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A data structure to hold the size of a group of devices.
+type groupCount struct {
+	Keys  []string
+	Count int
+	// StatusCounts counts the devices in the group with each DeviceStatus.
+	StatusCounts [Offline + 1]int
+}
+
+// A slice of groupCounts that implements sort.Interface to sort by decreasing
+// Count, then by Keys.
+type groupCountList []*groupCount
+
+func (p groupCountList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p groupCountList) Len() int      { return len(p) }
+func (p groupCountList) Less(i, j int) bool {
+	if p[i].Count != p[j].Count {
+		return p[i].Count > p[j].Count
+	}
+	for idx := range p[i].Keys {
+		if p[i].Keys[idx] != p[j].Keys[idx] {
+			return p[i].Keys[idx] < p[j].Keys[idx]
+		}
+	}
+	return false
+}
+
+// countDevices groups the devices matching filter by keys and counts how
+// many in each group have each status. SelectVersions, SelectCountries and
+// Summarize count devices this way so they always agree with the statuses
+// from SelectDevices.
+func countDevices(ctx context.Context, store Datastore, filter Filter, keys func(*DevicesResult) []string) (groupCountList, error) {
+	groups := make(map[string]*groupCount)
+	var counts groupCountList
+	devices := store.SelectDevices(ctx, nil, nil, 0, filter)
+	defer devices.Close()
+	for devices.Next() {
+		device := devices.Result()
+		k := keys(device)
+		joined := strings.Join(k, "\x00")
+		group, ok := groups[joined]
+		if !ok {
+			group = &groupCount{Keys: k}
+			groups[joined] = group
+			counts = append(counts, group)
+		}
+		group.Count++
+		group.StatusCounts[device.DeviceStatus]++
+	}
+	if err := devices.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(counts)
+	return counts, nil
+}
+
+// SummaryResult is the size of one group of devices from Summarize. Keys has
+// the group's value of each field, formatted by GroupKey.
+type SummaryResult struct {
+	Keys                                         []string
+	Count, OnlineCount, StaleCount, OfflineCount int
+}
+
+// Summarize groups the devices matching filter (or all devices if filter is
+// nil) by the values of fields and counts the devices in each group with
+// each status. Groups are ordered by decreasing size.
+func Summarize(ctx context.Context, store Datastore, fields []Field, filter Filter) *SummaryIterator {
+	for _, field := range fields {
+		if !field.Groupable() {
+			return &SummaryIterator{newErrorIterator(ctx, fmt.Errorf("Can't group devices by %s", field))}
+		}
+	}
+	counts, err := countDevices(ctx, store, filter, func(device *DevicesResult) []string {
+		keys := make([]string, len(fields))
+		for idx, field := range fields {
+			keys[idx] = GroupKey(field, device)
+		}
+		return keys
+	})
+	if err != nil {
+		return &SummaryIterator{newErrorIterator(ctx, err)}
+	}
+	return &SummaryIterator{newSliceIterator(ctx, len(counts), func(idx int) interface{} {
+		return &SummaryResult{
+			Keys:         counts[idx].Keys,
+			Count:        counts[idx].Count,
+			OnlineCount:  counts[idx].StatusCounts[Online],
+			StaleCount:   counts[idx].StatusCounts[Stale],
+			OfflineCount: counts[idx].StatusCounts[Offline],
+		}
+	})}
+}
+
+func selectVersions(ctx context.Context, store Datastore) *VersionsIterator {
+	counts, err := countDevices(ctx, store, nil, func(device *DevicesResult) []string { return []string{device.Version} })
+	if err != nil {
+		return &VersionsIterator{newErrorIterator(ctx, err)}
+	}
+	return &VersionsIterator{newSliceIterator(ctx, len(counts), func(idx int) interface{} {
+		return &VersionsResult{
+			Version:      counts[idx].Keys[0],
+			Count:        counts[idx].Count,
+			OnlineCount:  counts[idx].StatusCounts[Online],
+			StaleCount:   counts[idx].StatusCounts[Stale],
+			OfflineCount: counts[idx].StatusCounts[Offline],
+		}
+	})}
+}
+
+func selectCountries(ctx context.Context, store Datastore) *CountriesIterator {
+	counts, err := countDevices(ctx, store, nil, func(device *DevicesResult) []string { return []string{device.CountryCode} })
+	if err != nil {
+		return &CountriesIterator{newErrorIterator(ctx, err)}
+	}
+	return &CountriesIterator{newSliceIterator(ctx, len(counts), func(idx int) interface{} {
+		return &CountriesResult{
+			Country:      counts[idx].Keys[0],
+			Count:        counts[idx].Count,
+			OnlineCount:  counts[idx].StatusCounts[Online],
+			StaleCount:   counts[idx].StatusCounts[Stale],
+			OfflineCount: counts[idx].StatusCounts[Offline],
+		}
+	})}
+}
+
+func selectIsps(ctx context.Context, store Datastore) *IspsIterator {
+	// Name each AS after the first ISP name we see for it. The names only
+	// differ if the database changes while we're running.
+	names := make(map[int]string)
+	counts, err := countDevices(ctx, store, nil, func(device *DevicesResult) []string {
+		if _, ok := names[device.Asn]; !ok {
+			names[device.Asn] = device.Isp
+		}
+		return []string{strconv.Itoa(device.Asn)}
+	})
+	if err != nil {
+		return &IspsIterator{newErrorIterator(ctx, err)}
+	}
+	return &IspsIterator{newSliceIterator(ctx, len(counts), func(idx int) interface{} {
+		asn, _ := strconv.Atoi(counts[idx].Keys[0])
+		return &IspsResult{
+			Asn:          asn,
+			Isp:          names[asn],
+			Count:        counts[idx].Count,
+			OnlineCount:  counts[idx].StatusCounts[Online],
+			StaleCount:   counts[idx].StatusCounts[Stale],
+			OfflineCount: counts[idx].StatusCounts[Offline],
+		}
+	})}
+}
@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"context"
+)
+
+// Iterators step through the results of a query like sql.Rows:
+//
+//	devices := store.SelectDevices(ctx, nil, nil, 0, nil)
+//	defer devices.Close()
+//	for devices.Next() {
+//		device := devices.Result()
+//		...
+//	}
+//	if err := devices.Err(); err != nil {
+//		...
+//	}
+//
+// Next returns false at the end of the results, on an error or once ctx is
+// done, after which Err says why. Close releases the query's database
+// connection, so callers that stop before Next returns false must call it.
+// It's safe to call Close more than once.
+type iterator struct {
+	ctx context.Context
+	// next returns the next result, or false at the end of the results.
+	next func() (interface{}, bool, error)
+	// close, if set, releases whatever next reads from.
+	close func() error
+
+	result interface{}
+	err    error
+	closed bool
+}
+
+func newIterator(ctx context.Context, next func() (interface{}, bool, error), close func() error) iterator {
+	return iterator{ctx: ctx, next: next, close: close}
+}
+
+// newSliceIterator iterates over length results already in memory, using get
+// to fetch each one.
+func newSliceIterator(ctx context.Context, length int, get func(int) interface{}) iterator {
+	idx := 0
+	return newIterator(ctx, func() (interface{}, bool, error) {
+		if idx >= length {
+			return nil, false, nil
+		}
+		idx++
+		return get(idx - 1), true, nil
+	}, nil)
+}
+
+// newErrorIterator returns no results and then err.
+func newErrorIterator(ctx context.Context, err error) iterator {
+	return newIterator(ctx, func() (interface{}, bool, error) {
+		return nil, false, err
+	}, nil)
+}
+
+func (it *iterator) Next() bool {
+	if it.closed {
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.finish(err)
+		return false
+	}
+	result, ok, err := it.next()
+	if !ok || err != nil {
+		it.finish(err)
+		return false
+	}
+	it.result = result
+	return true
+}
+
+func (it *iterator) finish(err error) {
+	it.result = nil
+	if closeErr := it.Close(); err == nil {
+		err = closeErr
+	}
+	it.err = err
+}
+
+// Err returns the error, if any, that ended the iteration.
+func (it *iterator) Err() error {
+	return it.err
+}
+
+func (it *iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.result = nil
+	if it.close == nil {
+		return nil
+	}
+	return it.close()
+}
+
+type DevicesIterator struct{ iterator }
+
+// Result returns the device from the last call to Next.
+func (it *DevicesIterator) Result() *DevicesResult {
+	result, _ := it.result.(*DevicesResult)
+	return result
+}
+
+type VersionsIterator struct{ iterator }
+
+func (it *VersionsIterator) Result() *VersionsResult {
+	result, _ := it.result.(*VersionsResult)
+	return result
+}
+
+type CountriesIterator struct{ iterator }
+
+func (it *CountriesIterator) Result() *CountriesResult {
+	result, _ := it.result.(*CountriesResult)
+	return result
+}
+
+type IspsIterator struct{ iterator }
+
+func (it *IspsIterator) Result() *IspsResult {
+	result, _ := it.result.(*IspsResult)
+	return result
+}
+
+type ProbesIterator struct{ iterator }
+
+func (it *ProbesIterator) Result() *ProbesResult {
+	result, _ := it.result.(*ProbesResult)
+	return result
+}
+
+type LifetimesIterator struct{ iterator }
+
+func (it *LifetimesIterator) Result() *LifetimesResult {
+	result, _ := it.result.(*LifetimesResult)
+	return result
+}
+
+type SummaryIterator struct{ iterator }
+
+func (it *SummaryIterator) Result() *SummaryResult {
+	result, _ := it.result.(*SummaryResult)
+	return result
+}
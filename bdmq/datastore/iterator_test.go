@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDriver is a database/sql driver whose queries all return the same
+// lifetimes, so we can check that PostgresDatastore releases its rows and
+// connections without a Postgres server.
+type testDriver struct {
+	mutex                sync.Mutex
+	openRows, closedRows int
+}
+
+var lifetimesDriver = &testDriver{}
+
+func init() {
+	sql.Register("bdmq-test", lifetimesDriver)
+}
+
+func (d *testDriver) Open(name string) (driver.Conn, error) {
+	return testConn{d}, nil
+}
+
+func (d *testDriver) counts() (int, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.openRows, d.closedRows
+}
+
+type testConn struct {
+	driver *testDriver
+}
+
+func (c testConn) Prepare(query string) (driver.Stmt, error) {
+	return testStmt{c.driver}, nil
+}
+
+func (c testConn) Close() error {
+	return nil
+}
+
+func (c testConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("Transactions aren't supported")
+}
+
+type testStmt struct {
+	driver *testDriver
+}
+
+func (s testStmt) Close() error {
+	return nil
+}
+
+func (s testStmt) NumInput() int {
+	return -1
+}
+
+func (s testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("Exec isn't supported")
+}
+
+func (s testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.driver.mutex.Lock()
+	defer s.driver.mutex.Unlock()
+	s.driver.openRows++
+	return &testRows{driver: s.driver}, nil
+}
+
+// testRows has the lifetimes of three nodes.
+type testRows struct {
+	driver *testDriver
+	row    int
+}
+
+func (r *testRows) Columns() []string {
+	return []string{"id", "min", "max"}
+}
+
+func (r *testRows) Close() error {
+	r.driver.mutex.Lock()
+	defer r.driver.mutex.Unlock()
+	r.driver.closedRows++
+	return nil
+}
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.row >= 3 {
+		return io.EOF
+	}
+	r.row++
+	first := time.Date(2013, 7, r.row, 0, 0, 0, 0, time.UTC)
+	dest[0], dest[1], dest[2] = fmt.Sprintf("OW000000000%d", r.row), first, first.Add(time.Hour)
+	return nil
+}
+
+func newTestPostgresDatastore(t *testing.T) (PostgresDatastore, *sql.DB) {
+	db, err := sql.Open("bdmq-test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PostgresDatastore{db: db, thresholds: DefaultThresholds()}, db
+}
+
+// checkReleased fails unless every query on db has closed its rows and
+// returned its connection.
+func checkReleased(t *testing.T, db *sql.DB) {
+	// database/sql closes rows of canceled queries in the background.
+	deadline := time.Now().Add(time.Second)
+	for db.Stats().InUse > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Errorf("%d connections still in use", inUse)
+	}
+	if opened, closed := lifetimesDriver.counts(); opened != closed {
+		t.Errorf("Opened %d rows but closed %d", opened, closed)
+	}
+}
+
+func TestIteratorReadEverything(t *testing.T) {
+	store, db := newTestPostgresDatastore(t)
+	defer db.Close()
+
+	var nodeIds []string
+	lifetimes := store.SelectLifetimes(context.Background())
+	for lifetimes.Next() {
+		nodeIds = append(nodeIds, lifetimes.Result().NodeId)
+	}
+	if err := lifetimes.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(nodeIds) != "[OW0000000001 OW0000000002 OW0000000003]" {
+		t.Errorf("Got lifetimes for %v", nodeIds)
+	}
+	if lifetimes.Result() != nil {
+		t.Errorf("Got a result after the last one")
+	}
+	checkReleased(t, db)
+}
+
+func TestIteratorCloseEarly(t *testing.T) {
+	store, db := newTestPostgresDatastore(t)
+	defer db.Close()
+
+	lifetimes := store.SelectLifetimes(context.Background())
+	if !lifetimes.Next() {
+		t.Fatalf("No lifetimes: %v", lifetimes.Err())
+	}
+	if err := lifetimes.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if lifetimes.Next() {
+		t.Errorf("Got a lifetime after Close")
+	}
+	if err := lifetimes.Close(); err != nil {
+		t.Errorf("Second Close failed: %s", err)
+	}
+	checkReleased(t, db)
+}
+
+func TestIteratorCancel(t *testing.T) {
+	store, db := newTestPostgresDatastore(t)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lifetimes := store.SelectLifetimes(ctx)
+	if !lifetimes.Next() {
+		t.Fatalf("No lifetimes: %v", lifetimes.Err())
+	}
+	cancel()
+	if lifetimes.Next() {
+		t.Errorf("Got a lifetime after canceling")
+	}
+	if err := lifetimes.Err(); err != context.Canceled {
+		t.Errorf("Got error %v, want %v", err, context.Canceled)
+	}
+	// Next releases the query without a call to Close.
+	checkReleased(t, db)
+}
+
+func TestIteratorDeadline(t *testing.T) {
+	store, db := newTestPostgresDatastore(t)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	lifetimes := store.SelectLifetimes(ctx)
+	defer lifetimes.Close()
+	if lifetimes.Next() {
+		t.Errorf("Got a lifetime after the deadline")
+	}
+	if err := lifetimes.Err(); err != context.DeadlineExceeded {
+		t.Errorf("Got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	checkReleased(t, db)
+}
+
+// TestIteratorNoGoroutines checks that queries don't leave goroutines behind
+// when callers only read some of the results, which they did when queries
+// returned channels.
+func TestIteratorNoGoroutines(t *testing.T) {
+	now := time.Date(2013, 7, 2, 12, 0, 0, 0, time.UTC)
+	var devices []DevicesResult
+	for idx := 0; idx < 10; idx++ {
+		devices = append(devices, DevicesResult{NodeId: fmt.Sprintf("OW%010d", idx), Version: "1.0", LastSeen: now})
+	}
+	store := NewMemoryDatastore(devices, nil, now, nil)
+
+	before := runtime.NumGoroutine()
+	for idx := 0; idx < 100; idx++ {
+		results := store.SelectDevices(context.Background(), nil, nil, 0, nil)
+		results.Next()
+		results.Close()
+		summaries := Summarize(context.Background(), store, []Field{VersionField}, nil)
+		summaries.Next()
+		summaries.Close()
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before the queries and %d after", before, after)
+	}
+}
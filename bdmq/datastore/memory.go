@@ -0,0 +1,330 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MemoryDatastore answers queries from a list of devices held in memory.
+// Only the NodeId, IpAddress, CountryCode, Asn, Isp, City, Version,
+// LastSeen, Tags and Attributes fields of each device are used; the others
+// are computed relative to the datastore's current time.
+type MemoryDatastore struct {
+	devices    []DevicesResult
+	probes     []ProbesResult
+	now        time.Time
+	thresholds *Thresholds
+}
+
+// NewMemoryDatastore creates a datastore for devices and their probe
+// history. If now is the zero time then outages are computed relative to the
+// wall clock. If thresholds is nil then it uses DefaultThresholds.
+func NewMemoryDatastore(devices []DevicesResult, probes []ProbesResult, now time.Time, thresholds *Thresholds) Datastore {
+	if thresholds == nil {
+		thresholds = DefaultThresholds()
+	}
+	return MemoryDatastore{devices, probes, now, thresholds}
+}
+
+type fixtureDevice struct {
+	NodeId     string            `json:"node_id"`
+	IpAddress  string            `json:"ip_address"`
+	Country    string            `json:"country"`
+	Asn        int               `json:"asn"`
+	Isp        string            `json:"isp"`
+	City       string            `json:"city"`
+	Version    string            `json:"version"`
+	LastProbe  time.Time         `json:"last_probe"`
+	Tags       []string          `json:"tags,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type fixtureProbe struct {
+	NodeId    string    `json:"node_id"`
+	IpAddress string    `json:"ip_address"`
+	Country   string    `json:"country"`
+	Asn       int       `json:"asn"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type fixture struct {
+	Now     time.Time       `json:"now"`
+	Devices []fixtureDevice `json:"devices"`
+	Probes  []fixtureProbe  `json:"probes,omitempty"`
+}
+
+// NewFixtureDatastore creates a MemoryDatastore from a JSON file containing
+// either an object like
+//
+//	{"now": "2013-07-02T12:00:00Z", "devices": [...], "probes": [...]}
+//
+// or just the list of devices, in which case outages are relative to the wall
+// clock. Devices use the same field names as "bdmq --format=json devices",
+// plus optional tags and attributes, which the registry (see --registry)
+// overrides; probes have node_id, ip_address, timestamp and optionally
+// country and asn fields.
+func NewFixtureDatastore(filename string, thresholds *Thresholds) (Datastore, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var parsed fixture
+	if bytes.HasPrefix(bytes.TrimSpace(contents), []byte("[")) {
+		err = json.Unmarshal(contents, &parsed.Devices)
+	} else {
+		err = json.Unmarshal(contents, &parsed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing fixture %s: %s", filename, err)
+	}
+	nodeRegistry, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	var devices []DevicesResult
+	for _, device := range parsed.Devices {
+		country := strings.ToUpper(device.Country)
+		if country == "" {
+			country = "??"
+		}
+		isp, city := device.Isp, device.City
+		if isp == "" {
+			isp = "??"
+		}
+		if city == "" {
+			city = "??"
+		}
+		devices = append(devices, DevicesResult{
+			NodeId:      device.NodeId,
+			IpAddress:   device.IpAddress,
+			CountryCode: country,
+			Asn:         device.Asn,
+			Isp:         isp,
+			City:        city,
+			Version:     device.Version,
+			LastSeen:    device.LastProbe,
+			Tags:        device.Tags,
+			Attributes:  device.Attributes,
+		})
+		annotate(nodeRegistry, &devices[len(devices)-1])
+	}
+	var probes []ProbesResult
+	for _, probe := range parsed.Probes {
+		country := strings.ToUpper(probe.Country)
+		if country == "" {
+			country = "??"
+		}
+		probes = append(probes, ProbesResult{
+			NodeId:      probe.NodeId,
+			IpAddress:   probe.IpAddress,
+			CountryCode: country,
+			Asn:         probe.Asn,
+			Timestamp:   probe.Timestamp,
+		})
+	}
+	return NewMemoryDatastore(devices, probes, parsed.Now, thresholds), nil
+}
+
+func (store MemoryDatastore) Close() {}
+
+func (store MemoryDatastore) currentTime() time.Time {
+	if store.now.IsZero() {
+		return time.Now()
+	}
+	return store.now
+}
+
+// formatOutageDuration approximates Postgres's textual representation of
+// date_trunc('second', age(...)), except that it never uses months or years.
+func formatOutageDuration(duration time.Duration) string {
+	days := int(duration / (24 * time.Hour))
+	duration -= time.Duration(days) * 24 * time.Hour
+	clock := fmt.Sprintf("%02d:%02d:%02d", int(duration/time.Hour), int(duration/time.Minute)%60, int(duration/time.Second)%60)
+	switch days {
+	case 0:
+		return clock
+	case 1:
+		return "1 day " + clock
+	default:
+		return fmt.Sprintf("%d days %s", days, clock)
+	}
+}
+
+// allDevices returns every device with its status and outage computed.
+func (store MemoryDatastore) allDevices() []*DevicesResult {
+	now := store.currentTime()
+	var results []*DevicesResult
+	for _, device := range store.devices {
+		outage := now.Sub(device.LastSeen)
+		result := device
+		result.DeviceStatus = store.thresholds.DeviceStatus(device.Version, outage)
+		result.OutageDuration = outage / time.Second * time.Second
+		result.OutageDurationText = formatOutageDuration(result.OutageDuration)
+		results = append(results, &result)
+	}
+	return results
+}
+
+func compareIpAddresses(first, second string) int {
+	firstIp, secondIp := net.ParseIP(first), net.ParseIP(second)
+	if firstIp == nil || secondIp == nil {
+		return strings.Compare(first, second)
+	}
+	return bytes.Compare(firstIp.To16(), secondIp.To16())
+}
+
+func compareDevices(first, second *DevicesResult, ident Identifier) int {
+	switch ident {
+	case NodeId:
+		return strings.Compare(first.NodeId, second.NodeId)
+	case IpAddress:
+		return compareIpAddresses(first.IpAddress, second.IpAddress)
+	case Version:
+		return strings.Compare(first.Version, second.Version)
+	case LastProbe:
+		switch {
+		case first.LastSeen.Before(second.LastSeen):
+			return -1
+		case first.LastSeen.After(second.LastSeen):
+			return 1
+		}
+		return 0
+	case OutageDuration:
+		switch {
+		case first.OutageDuration < second.OutageDuration:
+			return -1
+		case first.OutageDuration > second.OutageDuration:
+			return 1
+		}
+		return 0
+	default:
+		panic(fmt.Errorf("Missing compareDevices() case"))
+	}
+}
+
+// A slice of devices that implements sort.Interface to sort by a list of
+// identifiers.
+type deviceList struct {
+	devices []*DevicesResult
+	orderBy []Identifier
+	order   []Order
+}
+
+func (l deviceList) Swap(i, j int) { l.devices[i], l.devices[j] = l.devices[j], l.devices[i] }
+func (l deviceList) Len() int      { return len(l.devices) }
+func (l deviceList) Less(i, j int) bool {
+	for idx, ident := range l.orderBy {
+		cmp := compareDevices(l.devices[i], l.devices[j], ident)
+		if l.order[idx] == Descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return false
+}
+
+func (store MemoryDatastore) SelectDevices(ctx context.Context, orderBy []Identifier, order []Order, limit int, filter Filter) *DevicesIterator {
+	var matching []*DevicesResult
+	for _, device := range store.allDevices() {
+		if filter == nil || filter.Matches(device) {
+			matching = append(matching, device)
+		}
+	}
+	sort.Stable(deviceList{matching, orderBy, order})
+	if limit > 0 && len(matching) > limit {
+		matching = matching[:limit]
+	}
+	return &DevicesIterator{newSliceIterator(ctx, len(matching), func(idx int) interface{} { return matching[idx] })}
+}
+
+func (store MemoryDatastore) SelectVersions(ctx context.Context) *VersionsIterator {
+	return selectVersions(ctx, store)
+}
+
+func (store MemoryDatastore) SelectCountries(ctx context.Context) *CountriesIterator {
+	return selectCountries(ctx, store)
+}
+
+func (store MemoryDatastore) SelectIsps(ctx context.Context) *IspsIterator {
+	return selectIsps(ctx, store)
+}
+
+// A slice of probes that implements sort.Interface to sort by Timestamp.
+type probeList []*ProbesResult
+
+func (p probeList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p probeList) Len() int           { return len(p) }
+func (p probeList) Less(i, j int) bool { return p[i].Timestamp.Before(p[j].Timestamp) }
+
+// sortByNode orders probes by node ID, then by time.
+func sortByNode(probes probeList) {
+	sort.Stable(probes)
+	sort.SliceStable(probes, func(i, j int) bool { return probes[i].NodeId < probes[j].NodeId })
+}
+
+func (store MemoryDatastore) SelectProbes(ctx context.Context, nodeId string, since, until time.Time) *ProbesIterator {
+	var matching probeList
+	for idx := range store.probes {
+		probe := store.probes[idx]
+		if probe.NodeId == nodeId && !probe.Timestamp.Before(since) && probe.Timestamp.Before(until) {
+			matching = append(matching, &probe)
+		}
+	}
+	sort.Stable(matching)
+	return &ProbesIterator{newSliceIterator(ctx, len(matching), func(idx int) interface{} { return matching[idx] })}
+}
+
+func (store MemoryDatastore) SelectAllProbes(ctx context.Context, since, until time.Time) *ProbesIterator {
+	var matching probeList
+	for idx := range store.probes {
+		probe := store.probes[idx]
+		if !probe.Timestamp.Before(since) && probe.Timestamp.Before(until) {
+			matching = append(matching, &probe)
+		}
+	}
+	sortByNode(matching)
+	return &ProbesIterator{newSliceIterator(ctx, len(matching), func(idx int) interface{} { return matching[idx] })}
+}
+
+// A slice of lifetimes that implements sort.Interface to sort by NodeId.
+type lifetimeList []*LifetimesResult
+
+func (l lifetimeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l lifetimeList) Len() int           { return len(l) }
+func (l lifetimeList) Less(i, j int) bool { return l[i].NodeId < l[j].NodeId }
+
+// collectLifetimes finds the first and last probe of each node.
+func collectLifetimes(probes []ProbesResult) lifetimeList {
+	byNode := make(map[string]*LifetimesResult)
+	var lifetimes lifetimeList
+	for _, probe := range probes {
+		lifetime, ok := byNode[probe.NodeId]
+		if !ok {
+			lifetime = &LifetimesResult{NodeId: probe.NodeId, FirstProbe: probe.Timestamp, LastProbe: probe.Timestamp}
+			byNode[probe.NodeId] = lifetime
+			lifetimes = append(lifetimes, lifetime)
+		}
+		if probe.Timestamp.Before(lifetime.FirstProbe) {
+			lifetime.FirstProbe = probe.Timestamp
+		}
+		if probe.Timestamp.After(lifetime.LastProbe) {
+			lifetime.LastProbe = probe.Timestamp
+		}
+	}
+	sort.Sort(lifetimes)
+	return lifetimes
+}
+
+func (store MemoryDatastore) SelectLifetimes(ctx context.Context) *LifetimesIterator {
+	lifetimes := collectLifetimes(store.probes)
+	return &LifetimesIterator{newSliceIterator(ctx, len(lifetimes), func(idx int) interface{} { return lifetimes[idx] })}
+}
@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"flag"
+
+	"github.com/sburnett/bismark-tools/common/registry"
+)
+
+var registryFilename string
+
+func init() {
+	flag.StringVar(&registryFilename, "registry", "", "Read node tags and attributes from this registry file (CSV or .json)")
+}
+
+// loadRegistry reads the registry named by --registry, or returns nil if it
+// isn't set.
+func loadRegistry() (*registry.Registry, error) {
+	if registryFilename == "" {
+		return nil, nil
+	}
+	return registry.Load(registryFilename)
+}
+
+// annotate sets the Tags and Attributes of device from its entry in
+// nodeRegistry. Devices that aren't in the registry keep what they have.
+func annotate(nodeRegistry *registry.Registry, device *DevicesResult) {
+	node := nodeRegistry.Lookup(device.NodeId)
+	if node == nil {
+		return
+	}
+	device.Tags, device.Attributes = node.Tags, node.Attributes
+}
@@ -1,40 +1,52 @@
 package datastore
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
-	"sort"
-	"strings"
 	"time"
 
-	"github.com/abh/geoip"
 	_ "github.com/bmizerany/pq"
+	"github.com/sburnett/bismark-tools/common/registry"
 )
 
-var geoipDatabase string
+var postgresConnection string
 
 func init() {
-	flag.StringVar(&geoipDatabase, "geoip_database", "/usr/share/GeoIP/GeoIP.dat", "Path of GeoIP database")
+	flag.StringVar(&postgresConnection, "postgres", "", "Postgres connection string, like \"host=localhost dbname=bismark_mgmt\"; PG* environment variables fill in the rest")
 }
 
 type PostgresDatastore struct {
 	db         *sql.DB
-	geolocator *geoip.GeoIP
+	geolocator *geolocator
+	registry   *registry.Registry
+	thresholds *Thresholds
 }
 
-func NewPostgresDatastore() (Datastore, error) {
-	db, err := sql.Open("postgres", "")
+// NewPostgresDatastore connects to the database named by --postgres and the
+// usual PG* environment variables. If thresholds is nil then it uses
+// DefaultThresholds.
+func NewPostgresDatastore(thresholds *Thresholds) (Datastore, error) {
+	if thresholds == nil {
+		thresholds = DefaultThresholds()
+	}
+
+	db, err := sql.Open("postgres", postgresConnection)
 	if err != nil {
 		return nil, fmt.Errorf("Error connecting to Postgres database: %s", err)
 	}
 
-	geolocator, err := geoip.Open(geoipDatabase)
+	geolocator, err := newGeolocator()
+	if err != nil {
+		return nil, err
+	}
+	nodeRegistry, err := loadRegistry()
 	if err != nil {
 		return nil, err
 	}
 
-	return PostgresDatastore{db, geolocator}, nil
+	return PostgresDatastore{db, geolocator, nodeRegistry, thresholds}, nil
 }
 
 func (store PostgresDatastore) Close() {
@@ -43,54 +55,22 @@ func (store PostgresDatastore) Close() {
 	}
 }
 
-func (store PostgresDatastore) SelectDevices(orderBy []Identifier, order []Order, limit int, nodeIdConstraint, ipAddressConstraint, countryCodeConstraint, versionConstraint string, deviceStatusConstraint *DeviceStatus) chan *DevicesResult {
-	runQuery := func(results chan *DevicesResult) {
-		defer close(results)
-
-		var whereConstraints []string
-		if nodeIdConstraint != "" {
-			whereConstraints = append(whereConstraints, fmt.Sprintf("id ILIKE '%%%s'", nodeIdConstraint))
-		}
-		if ipAddressConstraint != "" {
-			whereConstraints = append(whereConstraints, fmt.Sprintf("ip <<= '%s'", ipAddressConstraint))
-		}
-		if versionConstraint != "" {
-			whereConstraints = append(whereConstraints, fmt.Sprintf("bversion = '%s'", versionConstraint))
-		}
-		var whereClause string
-		if len(whereConstraints) > 0 {
-			whereClause = fmt.Sprint("WHERE ", strings.Join(whereConstraints, " AND "))
-		}
-		var orderByClause string
-		if len(orderBy) > 0 {
-			var orderConstraints []string
-			for idx, ident := range orderBy {
-				orderConstraints = append(orderConstraints, fmt.Sprint(ident, " ", order[idx]))
-			}
-			orderByClause = fmt.Sprint("ORDER BY ", strings.Join(orderConstraints, ", "))
-		}
-		queryString := `
-            SELECT
-                id AS node,
-                ip,
-                bversion AS version,
-                date_last_seen AS last_probe,
-                extract(epoch from current_timestamp - date_last_seen) AS outage_seconds,
-                date_trunc('second', age(current_timestamp, date_last_seen)) AS outage_duration
-            FROM devices
-            %s
-            %s`
-		preparedQueryString := fmt.Sprintf(queryString, whereClause, orderByClause)
-		rows, err := store.db.Query(preparedQueryString)
-		if err != nil {
-			results <- &DevicesResult{Error: fmt.Errorf("Error querying devices table: %s", err)}
-			return
-		}
+func (store PostgresDatastore) SelectDevices(ctx context.Context, orderBy []Identifier, order []Order, limit int, filter Filter) *DevicesIterator {
+	query, args, exact := buildDevicesQuery(orderBy, order, limit, filter, store.thresholds)
+	var remainingFilter Filter
+	if !exact {
+		remainingFilter = filter
+	}
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &DevicesIterator{newErrorIterator(ctx, fmt.Errorf("Error querying devices table: %s", err))}
+	}
 
-		rowCount := 0
+	rowCount := 0
+	next := func() (interface{}, bool, error) {
 		for rows.Next() {
 			if limit > 0 && rowCount >= limit {
-				break
+				return nil, false, nil
 			}
 
 			var (
@@ -100,156 +80,129 @@ func (store PostgresDatastore) SelectDevices(orderBy []Identifier, order []Order
 				outageDurationText         string
 			)
 			if err := rows.Scan(&nodeId, &ipAddress, &version, &lastSeen, &outageSeconds, &outageDurationText); err != nil {
-				results <- &DevicesResult{Error: fmt.Errorf("Error querying devices table: %s", err)}
-				return
-			}
-
-			deviceStatus := OutageDurationToDeviceStatus(outageSeconds)
-			if deviceStatusConstraint != nil && *deviceStatusConstraint != deviceStatus {
-				continue
-			}
-
-			country, _ := store.geolocator.GetCountry(ipAddress)
-			if country == "" {
-				country = "??"
-			}
-			if countryCodeConstraint != "" && countryCodeConstraint != country {
-				continue
+				return nil, false, fmt.Errorf("Error querying devices table: %s", err)
 			}
 
 			outageDuration, err := time.ParseDuration(fmt.Sprintf("%ds", int(outageSeconds)))
 			if err != nil {
-				results <- &DevicesResult{Error: err}
+				return nil, false, err
 			}
-			results <- &DevicesResult{
+			result := &DevicesResult{
 				NodeId:             nodeId,
 				IpAddress:          ipAddress,
-				CountryCode:        country,
 				Version:            version,
 				LastSeen:           lastSeen,
-				DeviceStatus:       deviceStatus,
+				DeviceStatus:       store.thresholds.DeviceStatus(version, time.Duration(outageSeconds*float64(time.Second))),
 				OutageDuration:     outageDuration,
 				OutageDurationText: outageDurationText,
 			}
+			store.geolocator.locate(result)
+			annotate(store.registry, result)
+			if remainingFilter != nil && !remainingFilter.Matches(result) {
+				continue
+			}
 			rowCount++
+			return result, true, nil
 		}
 		if err := rows.Err(); err != nil {
-			results <- &DevicesResult{Error: fmt.Errorf("Error iterating through devices table: %s", err)}
+			return nil, false, fmt.Errorf("Error iterating through devices table: %s", err)
 		}
+		return nil, false, nil
 	}
+	return &DevicesIterator{newIterator(ctx, next, rows.Close)}
+}
 
-	resultsChan := make(chan *DevicesResult)
-	go runQuery(resultsChan)
-	return resultsChan
+func (store PostgresDatastore) SelectVersions(ctx context.Context) *VersionsIterator {
+	return selectVersions(ctx, store)
 }
 
-func (store PostgresDatastore) SelectVersions() chan *VersionsResult {
-	runQuery := func(results chan *VersionsResult) {
-		defer close(results)
-
-		versionQuery := `
-        SELECT bversion,
-               count(case when extract(epoch from date_trunc('second', current_timestamp - date_last_seen)) < 600 then 1 else null end) AS online,
-               count(1) total
-        FROM devices
-        GROUP BY bversion
-        ORDER BY total DESC`
-		rows, err := store.db.Query(versionQuery)
-		if err != nil {
-			results <- &VersionsResult{Error: fmt.Errorf("Error querying devices table: %s", err)}
-			return
-		}
+func (store PostgresDatastore) SelectCountries(ctx context.Context) *CountriesIterator {
+	return selectCountries(ctx, store)
+}
 
-		for rows.Next() {
-			var result VersionsResult
-			if err := rows.Scan(&result.Version, &result.OnlineCount, &result.Count); err != nil {
-				results <- &VersionsResult{Error: fmt.Errorf("Error iterating through devices table: %s", err)}
-				return
+func (store PostgresDatastore) SelectIsps(ctx context.Context) *IspsIterator {
+	return selectIsps(ctx, store)
+}
+
+func (store PostgresDatastore) SelectProbes(ctx context.Context, nodeId string, since, until time.Time) *ProbesIterator {
+	probesQuery := `
+        SELECT date_seen, ip
+        FROM devices_log
+        WHERE id = $1 AND date_seen >= $2 AND date_seen < $3
+        ORDER BY date_seen`
+	rows, err := store.db.QueryContext(ctx, probesQuery, nodeId, since, until)
+	if err != nil {
+		return &ProbesIterator{newErrorIterator(ctx, fmt.Errorf("Error querying devices_log table: %s", err))}
+	}
+
+	next := func() (interface{}, bool, error) {
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return nil, false, fmt.Errorf("Error iterating through devices_log table: %s", err)
 			}
-			results <- &result
+			return nil, false, nil
 		}
-		if err := rows.Err(); err != nil {
-			results <- &VersionsResult{Error: fmt.Errorf("Error iterating through devices table: %s", err)}
+		result := ProbesResult{NodeId: nodeId}
+		if err := rows.Scan(&result.Timestamp, &result.IpAddress); err != nil {
+			return nil, false, fmt.Errorf("Error iterating through devices_log table: %s", err)
 		}
+		store.geolocator.locateProbe(&result)
+		return &result, true, nil
 	}
-
-	resultsChan := make(chan *VersionsResult)
-	go runQuery(resultsChan)
-	return resultsChan
-}
-
-// A data structure to hold a key/value pair.
-type pair struct {
-	Key   string
-	Value int
+	return &ProbesIterator{newIterator(ctx, next, rows.Close)}
 }
 
-// A slice of Pairs that implements sort.Interface to sort by Value.
-type pairList []pair
-
-func (p pairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-func (p pairList) Len() int           { return len(p) }
-func (p pairList) Less(i, j int) bool { return p[i].Value > p[j].Value }
-
-// A function to turn a map into a pairList, then sort and return it.
-func sortMapByValue(m map[string]int) pairList {
-	p := make(pairList, len(m))
-	i := 0
-	for k, v := range m {
-		p[i] = pair{k, v}
-		i++
+func (store PostgresDatastore) SelectAllProbes(ctx context.Context, since, until time.Time) *ProbesIterator {
+	probesQuery := `
+        SELECT id, ip, date_seen
+        FROM devices_log
+        WHERE date_seen >= $1 AND date_seen < $2
+        ORDER BY id, date_seen`
+	rows, err := store.db.QueryContext(ctx, probesQuery, since, until)
+	if err != nil {
+		return &ProbesIterator{newErrorIterator(ctx, fmt.Errorf("Error querying devices_log table: %s", err))}
 	}
-	sort.Sort(p)
-	return p
-}
 
-func (store PostgresDatastore) SelectCountries() chan *CountriesResult {
-	runQuery := func(results chan *CountriesResult) {
-		defer close(results)
-
-		deviceQuery := `
-        SELECT ip,
-               extract(epoch from date_trunc('second', current_timestamp - date_last_seen)) AS online
-        FROM devices`
-		rows, err := store.db.Query(deviceQuery)
-		if err != nil {
-			results <- &CountriesResult{Error: fmt.Errorf("Error querying devices table: %s", err)}
-			return
+	next := func() (interface{}, bool, error) {
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return nil, false, fmt.Errorf("Error iterating through devices_log table: %s", err)
+			}
+			return nil, false, nil
+		}
+		var result ProbesResult
+		if err := rows.Scan(&result.NodeId, &result.IpAddress, &result.Timestamp); err != nil {
+			return nil, false, fmt.Errorf("Error iterating through devices_log table: %s", err)
 		}
+		store.geolocator.locateProbe(&result)
+		return &result, true, nil
+	}
+	return &ProbesIterator{newIterator(ctx, next, rows.Close)}
+}
 
-		countriesCount := make(map[string]int)
-		onlineCount := make(map[string]int)
-		for rows.Next() {
-			var ipAddress string
-			var online float64
-			if err := rows.Scan(&ipAddress, &online); err != nil {
-				results <- &CountriesResult{Error: fmt.Errorf("Error iterating through devices table: %s", err)}
-				return
-			}
+func (store PostgresDatastore) SelectLifetimes(ctx context.Context) *LifetimesIterator {
+	lifetimesQuery := `
+        SELECT id, min(date_seen), max(date_seen)
+        FROM devices_log
+        GROUP BY id
+        ORDER BY id`
+	rows, err := store.db.QueryContext(ctx, lifetimesQuery)
+	if err != nil {
+		return &LifetimesIterator{newErrorIterator(ctx, fmt.Errorf("Error querying devices_log table: %s", err))}
+	}
 
-			country, _ := store.geolocator.GetCountry(ipAddress)
-			if country == "" {
-				country = "??"
-			}
-			countriesCount[country]++
-			if online <= 600 {
-				onlineCount[country]++
-			}
-		}
-		sortedCountriesCount := sortMapByValue(countriesCount)
-		for _, entry := range sortedCountriesCount {
-			results <- &CountriesResult{
-				Country:     entry.Key,
-				Count:       entry.Value,
-				OnlineCount: onlineCount[entry.Key],
+	next := func() (interface{}, bool, error) {
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return nil, false, fmt.Errorf("Error iterating through devices_log table: %s", err)
 			}
+			return nil, false, nil
 		}
-		if err := rows.Err(); err != nil {
-			results <- &CountriesResult{Error: fmt.Errorf("Error iterating through devices table: %s", err)}
+		var result LifetimesResult
+		if err := rows.Scan(&result.NodeId, &result.FirstProbe, &result.LastProbe); err != nil {
+			return nil, false, fmt.Errorf("Error iterating through devices_log table: %s", err)
 		}
+		return &result, true, nil
 	}
-
-	resultsChan := make(chan *CountriesResult)
-	go runQuery(resultsChan)
-	return resultsChan
+	return &LifetimesIterator{newIterator(ctx, next, rows.Close)}
 }
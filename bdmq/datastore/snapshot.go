@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sburnett/bismark-tools/common/atomicfile"
+)
+
+var snapshotDirectory string
+
+func init() {
+	flag.StringVar(&snapshotDirectory, "snapshot_dir", "/tmp/bdmq-snapshots", "Store snapshots of the fleet in this directory")
+}
+
+// Snapshots are named after the time they were taken, in UTC, so that
+// sorting their names sorts them by time.
+const snapshotLayout = "20060102T150405Z"
+
+// A snapshot file uses the same format as NewFixtureDatastore, so every
+// snapshot can be queried like a live datastore.
+func snapshotFilename(directory string, timestamp time.Time) string {
+	return filepath.Join(directory, timestamp.UTC().Format(snapshotLayout)+".json")
+}
+
+// WriteSnapshot saves every device in store, with its geolocation as of now,
+// into --snapshot_dir and returns the name of the new snapshot.
+func WriteSnapshot(ctx context.Context, store Datastore, now time.Time) (string, error) {
+	snapshot := fixture{Now: now.UTC().Truncate(time.Second)}
+	devices := store.SelectDevices(ctx, []Identifier{NodeId}, []Order{Ascending}, 0, nil)
+	defer devices.Close()
+	for devices.Next() {
+		device := devices.Result()
+		snapshot.Devices = append(snapshot.Devices, fixtureDevice{
+			NodeId:     device.NodeId,
+			IpAddress:  device.IpAddress,
+			Country:    device.CountryCode,
+			Asn:        device.Asn,
+			Isp:        device.Isp,
+			City:       device.City,
+			Version:    device.Version,
+			LastProbe:  device.LastSeen.UTC(),
+			Tags:       device.Tags,
+			Attributes: device.Attributes,
+		})
+	}
+	if err := devices.Err(); err != nil {
+		return "", err
+	}
+	contents, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(snapshotDirectory, 0755); err != nil {
+		return "", fmt.Errorf("Error writing snapshot: %s", err)
+	}
+	filename := snapshotFilename(snapshotDirectory, snapshot.Now)
+	if err := atomicfile.WriteFile(filename, contents, 0644); err != nil {
+		return "", fmt.Errorf("Error writing snapshot: %s", err)
+	}
+	return filename, nil
+}
+
+// ListSnapshots returns the times of the snapshots in --snapshot_dir in
+// chronological order.
+func ListSnapshots() ([]time.Time, error) {
+	entries, err := ioutil.ReadDir(snapshotDirectory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error listing snapshots: %s", err)
+	}
+	var timestamps []time.Time
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		timestamp, err := time.Parse(snapshotLayout, strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Sort(timeList(timestamps))
+	return timestamps, nil
+}
+
+// A slice of times that implements sort.Interface to sort chronologically.
+type timeList []time.Time
+
+func (l timeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l timeList) Len() int           { return len(l) }
+func (l timeList) Less(i, j int) bool { return l[i].Before(l[j]) }
+
+// nearestSnapshot picks the snapshot taken closest to asOf, preferring the
+// later one of two that are equally close, so that a date picks that day's
+// snapshot when they're taken at noon.
+func nearestSnapshot(timestamps []time.Time, asOf time.Time) time.Time {
+	var nearest time.Time
+	var best time.Duration
+	for idx, timestamp := range timestamps {
+		distance := timestamp.Sub(asOf)
+		if distance < 0 {
+			distance = -distance
+		}
+		if idx == 0 || distance <= best {
+			nearest, best = timestamp, distance
+		}
+	}
+	return nearest
+}
+
+// NewSnapshotDatastore answers queries from the snapshot taken nearest to
+// asOf, using the thresholds from LoadThresholds. Statuses and outages are
+// relative to when the snapshot was taken, which it also returns.
+func NewSnapshotDatastore(asOf time.Time) (Datastore, time.Time, error) {
+	timestamps, err := ListSnapshots()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(timestamps) == 0 {
+		return nil, time.Time{}, fmt.Errorf("No snapshots in %s", snapshotDirectory)
+	}
+	taken := nearestSnapshot(timestamps, asOf)
+	thresholds, err := LoadThresholds()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	store, err := NewFixtureDatastore(snapshotFilename(snapshotDirectory, taken), thresholds)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return store, taken, nil
+}
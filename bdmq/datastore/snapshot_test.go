@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ExampleNewSnapshotDatastore() {
+	directory, err := ioutil.TempDir("", "bdmq-snapshots")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(directory)
+	flag.Set("snapshot_dir", directory)
+	defer flag.Set("snapshot_dir", "/tmp/bdmq-snapshots")
+
+	noon := time.Date(2013, 7, 1, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 3; day++ {
+		devices := []DevicesResult{{NodeId: "OW0000000001", Version: fmt.Sprintf("1.%d", day), LastSeen: noon.AddDate(0, 0, day)}}
+		if _, err := WriteSnapshot(context.Background(), NewMemoryDatastore(devices, nil, noon.AddDate(0, 0, day), nil), noon.AddDate(0, 0, day)); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, asOf := range []string{"2013-06-01T00:00:00Z", "2013-07-02T00:00:00Z", "2013-07-02T18:00:00Z", "2013-09-01T00:00:00Z"} {
+		timestamp, _ := time.Parse(time.RFC3339, asOf)
+		store, taken, err := NewSnapshotDatastore(timestamp)
+		if err != nil {
+			panic(err)
+		}
+		devices := store.SelectDevices(context.Background(), nil, nil, 0, nil)
+		for devices.Next() {
+			device := devices.Result()
+			fmt.Println(asOf, taken.Format(time.RFC3339), device.NodeId, device.Version, device.DeviceStatus)
+		}
+	}
+
+	// Output:
+	//
+	// 2013-06-01T00:00:00Z 2013-07-01T12:00:00Z OW0000000001 1.0 up
+	// 2013-07-02T00:00:00Z 2013-07-02T12:00:00Z OW0000000001 1.1 up
+	// 2013-07-02T18:00:00Z 2013-07-02T12:00:00Z OW0000000001 1.1 up
+	// 2013-09-01T00:00:00Z 2013-07-03T12:00:00Z OW0000000001 1.2 up
+}
+
+// TestSnapshotRoundTrip checks that a snapshot answers queries exactly like
+// the datastore it was taken from did at the time.
+func TestSnapshotRoundTrip(t *testing.T) {
+	directory, err := ioutil.TempDir("", "bdmq-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	if err := flag.Set("snapshot_dir", directory); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("snapshot_dir", "/tmp/bdmq-snapshots")
+
+	now := time.Date(2013, 7, 2, 12, 0, 0, 0, time.UTC)
+	live := NewMemoryDatastore([]DevicesResult{
+		{NodeId: "OW0000000001", IpAddress: "1.1.1.1", CountryCode: "US", Asn: 7922, Isp: "Comcast", City: "Atlanta", Version: "1.0", LastSeen: now.Add(-time.Minute)},
+		{NodeId: "OW0000000002", IpAddress: "2.2.2.2", CountryCode: "??", Isp: "??", City: "??", Version: "1.1", LastSeen: now.Add(-time.Hour)},
+	}, nil, now, nil)
+	if _, err := WriteSnapshot(context.Background(), live, now); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, taken, err := NewSnapshotDatastore(now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !taken.Equal(now) {
+		t.Errorf("Snapshot taken at %s, want %s", taken, now)
+	}
+
+	var want, got []DevicesResult
+	for devices := live.SelectDevices(context.Background(), nil, nil, 0, nil); devices.Next(); {
+		want = append(want, *devices.Result())
+	}
+	for devices := snapshot.SelectDevices(context.Background(), nil, nil, 0, nil); devices.Next(); {
+		got = append(got, *devices.Result())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got devices\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,187 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const outageSecondsSql = "extract(epoch from current_timestamp - date_last_seen)"
+
+const selectDevicesSql = "SELECT id AS node, ip, bversion AS version, date_last_seen AS last_probe, " +
+	outageSecondsSql + " AS outage_seconds, " +
+	"date_trunc('second', age(current_timestamp, date_last_seen)) AS outage_duration " +
+	"FROM devices"
+
+// A sqlBuilder accumulates the bound parameters of a query. All values that
+// come from the user go through bind so they never appear in the SQL text.
+type sqlBuilder struct {
+	args       []interface{}
+	thresholds *Thresholds
+}
+
+// bind adds a parameter and returns its placeholder.
+func (b *sqlBuilder) bind(value interface{}) string {
+	b.args = append(b.args, value)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+// buildDevicesQuery returns a query against the devices table and its
+// parameters. If exact is false then the query selects a superset of the
+// devices matching filter and ignores limit, so the caller must evaluate the
+// filter and apply the limit itself.
+func buildDevicesQuery(orderBy []Identifier, order []Order, limit int, filter Filter, thresholds *Thresholds) (query string, args []interface{}, exact bool) {
+	builder := sqlBuilder{thresholds: thresholds}
+	clauses := []string{selectDevicesSql}
+	exact = true
+	if filter != nil {
+		var constraint string
+		constraint, exact = builder.filter(filter)
+		clauses = append(clauses, "WHERE "+constraint)
+	}
+	if len(orderBy) > 0 {
+		var orderConstraints []string
+		for idx, ident := range orderBy {
+			orderConstraints = append(orderConstraints, fmt.Sprint(ident, " ", order[idx]))
+		}
+		clauses = append(clauses, "ORDER BY "+strings.Join(orderConstraints, ", "))
+	}
+	if limit > 0 && exact {
+		clauses = append(clauses, "LIMIT "+builder.bind(limit))
+	}
+	return strings.Join(clauses, " "), builder.args, exact
+}
+
+// filter translates a filter into a SQL boolean expression over the devices
+// table. Some filters (e.g., on country) can't be evaluated by Postgres; for
+// those filter returns a weaker expression that selects a superset of the
+// matching devices and sets exact to false.
+func (b *sqlBuilder) filter(filter Filter) (clause string, exact bool) {
+	switch f := filter.(type) {
+	case *AndFilter:
+		left, leftExact := b.filter(f.Left)
+		right, rightExact := b.filter(f.Right)
+		return fmt.Sprintf("(%s AND %s)", left, right), leftExact && rightExact
+	case *OrFilter:
+		left, leftExact := b.filter(f.Left)
+		right, rightExact := b.filter(f.Right)
+		return fmt.Sprintf("(%s OR %s)", left, right), leftExact && rightExact
+	case *NotFilter:
+		mark := len(b.args)
+		operand, operandExact := b.filter(f.Operand)
+		if !operandExact {
+			b.args = b.args[:mark]
+			return "TRUE", false
+		}
+		return fmt.Sprintf("NOT %s", operand), true
+	case *Comparison:
+		return b.comparison(f)
+	case *AttributeComparison:
+		// Attributes are in the registry, not the database.
+		return "TRUE", false
+	default:
+		panic(fmt.Errorf("Missing sqlBuilder.filter() case"))
+	}
+}
+
+func (b *sqlBuilder) comparison(c *Comparison) (string, bool) {
+	switch c.Operator {
+	case Equals:
+		return b.fieldEquals(c.Field, c.Values[0])
+	case NotEquals:
+		mark := len(b.args)
+		clause, exact := b.fieldEquals(c.Field, c.Values[0])
+		if !exact {
+			b.args = b.args[:mark]
+			return "TRUE", false
+		}
+		return fmt.Sprintf("NOT %s", clause), true
+	case In:
+		mark := len(b.args)
+		var clauses []string
+		for _, value := range c.Values {
+			clause, exact := b.fieldEquals(c.Field, value)
+			if !exact {
+				b.args = b.args[:mark]
+				return "TRUE", false
+			}
+			clauses = append(clauses, clause)
+		}
+		return fmt.Sprintf("(%s)", strings.Join(clauses, " OR ")), true
+	default:
+		column, value, ok := orderedColumnSql(c.Field, c.Values[0])
+		if !ok {
+			return "TRUE", false
+		}
+		return fmt.Sprintf("%s %s %s", column, c.Operator, b.bind(value)), true
+	}
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, so that node IDs match
+// as plain suffixes like they do in MemoryDatastore.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (b *sqlBuilder) fieldEquals(field Field, value interface{}) (string, bool) {
+	switch field {
+	case NodeIdField:
+		return "id ILIKE " + b.bind("%"+likeEscaper.Replace(value.(string))), true
+	case IpAddressField:
+		return "ip <<= " + b.bind(value.(string)), true
+	case VersionField:
+		return "bversion = " + b.bind(value.(string)), true
+	case StatusField:
+		return b.deviceStatus(value.(DeviceStatus)), true
+	case CountryField, AsnField, IspField, CityField:
+		// Postgres doesn't know where devices are.
+		return "TRUE", false
+	case TagField:
+		// Tags are in the registry, not the database.
+		return "TRUE", false
+	default:
+		column, sqlValue, _ := orderedColumnSql(field, value)
+		return fmt.Sprintf("%s = %s", column, b.bind(sqlValue)), true
+	}
+}
+
+// deviceStatus is the SQL equivalent of Thresholds.DeviceStatus.
+func (b *sqlBuilder) deviceStatus(status DeviceStatus) string {
+	online := func(t StatusThresholds) time.Duration { return t.Online }
+	stale := func(t StatusThresholds) time.Duration { return t.Stale }
+	switch status {
+	case Online:
+		return fmt.Sprintf("%s <= %s", outageSecondsSql, b.threshold(online))
+	case Stale:
+		return fmt.Sprintf("(%s > %s AND %s <= %s)", outageSecondsSql, b.threshold(online), outageSecondsSql, b.threshold(stale))
+	case Offline:
+		return fmt.Sprintf("%s > %s", outageSecondsSql, b.threshold(stale))
+	default:
+		panic(fmt.Errorf("Missing sqlBuilder.deviceStatus() case"))
+	}
+}
+
+// threshold returns the number of seconds of one of the thresholds for each
+// device, which depends on its version if there are per-version thresholds.
+// Postgres would type a CASE whose results are all parameters as text, so we
+// cast them.
+func (b *sqlBuilder) threshold(which func(StatusThresholds) time.Duration) string {
+	if len(b.thresholds.Versions) == 0 {
+		return b.bind(which(b.thresholds.Default).Seconds())
+	}
+	cases := []string{"CASE bversion"}
+	for _, version := range b.thresholds.overriddenVersions() {
+		cases = append(cases, fmt.Sprintf("WHEN %s THEN %s::float8", b.bind(version), b.bind(which(b.thresholds.Versions[version]).Seconds())))
+	}
+	cases = append(cases, fmt.Sprintf("ELSE %s::float8 END", b.bind(which(b.thresholds.Default).Seconds())))
+	return "(" + strings.Join(cases, " ") + ")"
+}
+
+func orderedColumnSql(field Field, value interface{}) (string, interface{}, bool) {
+	switch field {
+	case LastProbeField:
+		return "date_last_seen", value.(time.Time), true
+	case OutageDurationField:
+		return outageSecondsSql, value.(time.Duration).Seconds(), true
+	default:
+		return "", nil, false
+	}
+}
@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var exampleThresholds = &Thresholds{Default: StatusThresholds{90 * time.Second, 10 * time.Minute}}
+
+func printDevicesQuery(orderBy []Identifier, order []Order, limit int, filter Filter) {
+	printDevicesQueryWithThresholds(orderBy, order, limit, filter, exampleThresholds)
+}
+
+func printDevicesQueryWithThresholds(orderBy []Identifier, order []Order, limit int, filter Filter, thresholds *Thresholds) {
+	query, args, exact := buildDevicesQuery(orderBy, order, limit, filter, thresholds)
+	if !strings.HasPrefix(query, selectDevicesSql) {
+		panic(fmt.Errorf("Query doesn't select from devices: %s", query))
+	}
+	fmt.Printf("%q %v %v\n", strings.TrimPrefix(query, selectDevicesSql), args, exact)
+}
+
+func ExamplePostgresDatastore_SelectDevices_orderBy() {
+	for _, ident := range []Identifier{NodeId, IpAddress, Version, LastProbe, OutageDuration} {
+		for _, order := range []Order{Ascending, Descending} {
+			printDevicesQuery([]Identifier{ident}, []Order{order}, 0, nil)
+		}
+	}
+	printDevicesQuery([]Identifier{Version, NodeId}, []Order{Descending, Ascending}, 0, nil)
+	printDevicesQuery(nil, nil, 0, nil)
+
+	// Output:
+	//
+	// " ORDER BY id ASC" [] true
+	// " ORDER BY id DESC" [] true
+	// " ORDER BY ip ASC" [] true
+	// " ORDER BY ip DESC" [] true
+	// " ORDER BY bversion ASC" [] true
+	// " ORDER BY bversion DESC" [] true
+	// " ORDER BY last_probe ASC" [] true
+	// " ORDER BY last_probe DESC" [] true
+	// " ORDER BY outage_duration ASC" [] true
+	// " ORDER BY outage_duration DESC" [] true
+	// " ORDER BY bversion DESC, id ASC" [] true
+	// "" [] true
+}
+
+func ExamplePostgresDatastore_SelectDevices_limit() {
+	printDevicesQuery([]Identifier{NodeId}, []Order{Ascending}, 10, nil)
+	printDevicesQuery(nil, nil, 10, &Comparison{VersionField, Equals, []interface{}{"1.0"}})
+	printDevicesQuery(nil, nil, 10, &Comparison{CountryField, Equals, []interface{}{"US"}})
+
+	// Output:
+	//
+	// " ORDER BY id ASC LIMIT $1" [10] true
+	// " WHERE bversion = $1 LIMIT $2" [1.0 10] true
+	// " WHERE TRUE" [] false
+}
+
+func ExamplePostgresDatastore_SelectDevices_fields() {
+	lastProbe := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	printDevicesQuery(nil, nil, 0, &Comparison{NodeIdField, Equals, []interface{}{"abc' OR 1=1 --"}})
+	printDevicesQuery(nil, nil, 0, &Comparison{NodeIdField, Equals, []interface{}{`0_%\`}})
+	printDevicesQuery(nil, nil, 0, &Comparison{IpAddressField, Equals, []interface{}{"143.215/16"}})
+	printDevicesQuery(nil, nil, 0, &Comparison{VersionField, NotEquals, []interface{}{"1.0"}})
+	printDevicesQuery(nil, nil, 0, &Comparison{LastProbeField, GreaterOrEqual, []interface{}{lastProbe}})
+	printDevicesQuery(nil, nil, 0, &Comparison{OutageDurationField, GreaterThan, []interface{}{48 * time.Hour}})
+
+	// Output:
+	//
+	// " WHERE id ILIKE $1" [%abc' OR 1=1 --] true
+	// " WHERE id ILIKE $1" [%0\_\%\\] true
+	// " WHERE ip <<= $1" [143.215/16] true
+	// " WHERE NOT bversion = $1" [1.0] true
+	// " WHERE date_last_seen >= $1" [2013-07-01 00:00:00 +0000 UTC] true
+	// " WHERE extract(epoch from current_timestamp - date_last_seen) > $1" [172800] true
+}
+
+func ExamplePostgresDatastore_SelectDevices_status() {
+	printDevicesQuery(nil, nil, 5, &Comparison{StatusField, Equals, []interface{}{Online}})
+	printDevicesQuery(nil, nil, 0, &Comparison{StatusField, Equals, []interface{}{Stale}})
+	printDevicesQuery(nil, nil, 0, &Comparison{StatusField, In, []interface{}{Stale, Offline}})
+
+	// Output:
+	//
+	// " WHERE extract(epoch from current_timestamp - date_last_seen) <= $1 LIMIT $2" [90 5] true
+	// " WHERE (extract(epoch from current_timestamp - date_last_seen) > $1 AND extract(epoch from current_timestamp - date_last_seen) <= $2)" [90 600] true
+	// " WHERE ((extract(epoch from current_timestamp - date_last_seen) > $1 AND extract(epoch from current_timestamp - date_last_seen) <= $2) OR extract(epoch from current_timestamp - date_last_seen) > $3)" [90 600 600] true
+}
+
+func ExamplePostgresDatastore_SelectDevices_thresholds() {
+	thresholds := &Thresholds{
+		Default: StatusThresholds{2 * time.Minute, 15 * time.Minute},
+		Versions: map[string]StatusThresholds{
+			"1.0": {5 * time.Minute, time.Hour},
+			"0.9": {10 * time.Minute, 2 * time.Hour},
+		},
+	}
+	printDevicesQueryWithThresholds(nil, nil, 0, &Comparison{StatusField, Equals, []interface{}{Offline}}, &Thresholds{Default: thresholds.Default})
+	printDevicesQueryWithThresholds(nil, nil, 0, &Comparison{StatusField, Equals, []interface{}{Online}}, thresholds)
+	printDevicesQueryWithThresholds(nil, nil, 0, &Comparison{StatusField, Equals, []interface{}{Stale}}, thresholds)
+
+	// Output:
+	//
+	// " WHERE extract(epoch from current_timestamp - date_last_seen) > $1" [900] true
+	// " WHERE extract(epoch from current_timestamp - date_last_seen) <= (CASE bversion WHEN $1 THEN $2::float8 WHEN $3 THEN $4::float8 ELSE $5::float8 END)" [0.9 600 1.0 300 120] true
+	// " WHERE (extract(epoch from current_timestamp - date_last_seen) > (CASE bversion WHEN $1 THEN $2::float8 WHEN $3 THEN $4::float8 ELSE $5::float8 END) AND extract(epoch from current_timestamp - date_last_seen) <= (CASE bversion WHEN $6 THEN $7::float8 WHEN $8 THEN $9::float8 ELSE $10::float8 END))" [0.9 600 1.0 300 120 0.9 7200 1.0 3600 900] true
+}
+
+func ExamplePostgresDatastore_SelectDevices_boolean() {
+	version := &Comparison{VersionField, Equals, []interface{}{"1.0"}}
+	country := &Comparison{CountryField, In, []interface{}{"US", "GB"}}
+	node := &Comparison{NodeIdField, Equals, []interface{}{"abc"}}
+	printDevicesQuery(nil, nil, 0, &AndFilter{version, &NotFilter{node}})
+	printDevicesQuery(nil, nil, 0, &OrFilter{version, node})
+	printDevicesQuery(nil, nil, 0, &AndFilter{country, version})
+	printDevicesQuery(nil, nil, 0, &OrFilter{country, version})
+	printDevicesQuery(nil, nil, 0, &AndFilter{&NotFilter{&AndFilter{country, node}}, version})
+
+	// Output:
+	//
+	// " WHERE (bversion = $1 AND NOT id ILIKE $2)" [1.0 %abc] true
+	// " WHERE (bversion = $1 OR id ILIKE $2)" [1.0 %abc] true
+	// " WHERE (TRUE AND bversion = $1)" [1.0] false
+	// " WHERE (TRUE OR bversion = $1)" [1.0] false
+	// " WHERE (TRUE AND bversion = $1)" [1.0] false
+}
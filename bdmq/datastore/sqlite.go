@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sburnett/bismark-tools/common/postgres"
+	"github.com/sburnett/bismark-tools/common/registry"
+)
+
+// SqliteDatastore answers queries from a SQLite dump of the devices table
+// (with at least the id, ip, bversion and date_last_seen columns) and,
+// optionally, the devices_log table (with the id, ip and date_seen columns).
+// The devices table is read into memory when the datastore is opened.
+// Outages are relative to the wall clock.
+type SqliteDatastore struct {
+	MemoryDatastore
+	db         *sql.DB
+	geolocator *geolocator
+}
+
+func NewSqliteDatastore(filename string, thresholds *Thresholds) (Datastore, error) {
+	geolocator, err := newGeolocator()
+	if err != nil {
+		return nil, err
+	}
+	nodeRegistry, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return openSqliteDatastore(filename, geolocator, nodeRegistry, thresholds)
+}
+
+func openSqliteDatastore(filename string, geolocator *geolocator, nodeRegistry *registry.Registry, thresholds *Thresholds) (Datastore, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening SQLite database: %s", err)
+	}
+	devices, err := readSqliteDevices(db, geolocator)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for idx := range devices {
+		annotate(nodeRegistry, &devices[idx])
+	}
+	if thresholds == nil {
+		thresholds = DefaultThresholds()
+	}
+	return SqliteDatastore{MemoryDatastore{devices: devices, thresholds: thresholds}, db, geolocator}, nil
+}
+
+func readSqliteDevices(db *sql.DB, geolocator *geolocator) ([]DevicesResult, error) {
+	rows, err := db.Query("SELECT id, ip, bversion, CAST(date_last_seen AS TEXT) FROM devices")
+	if err != nil {
+		return nil, fmt.Errorf("Error querying devices table: %s", err)
+	}
+	defer rows.Close()
+
+	var devices []DevicesResult
+	for rows.Next() {
+		var device DevicesResult
+		var lastSeen string
+		if err := rows.Scan(&device.NodeId, &device.IpAddress, &device.Version, &lastSeen); err != nil {
+			return nil, fmt.Errorf("Error iterating through devices table: %s", err)
+		}
+		if device.LastSeen, err = postgres.ParseTimestamp(lastSeen); err != nil {
+			return nil, err
+		}
+		geolocator.locate(&device)
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through devices table: %s", err)
+	}
+	return devices, nil
+}
+
+func (store SqliteDatastore) Close() {
+	if err := store.db.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// readProbes reads the probes of nodeId, or of every node if nodeId is
+// empty, in [since, until), or all of them if until is zero. Timestamps in
+// SQLite are text in no particular format, so we compare them after parsing.
+func (store SqliteDatastore) readProbes(ctx context.Context, nodeId string, since, until time.Time) (probeList, error) {
+	query, args := "SELECT id, CAST(date_seen AS TEXT), ip FROM devices_log", []interface{}{}
+	if nodeId != "" {
+		query, args = query+" WHERE id = ?", append(args, nodeId)
+	}
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying devices_log table: %s", err)
+	}
+	defer rows.Close()
+
+	var probes probeList
+	for rows.Next() {
+		var probe ProbesResult
+		var dateSeen string
+		if err := rows.Scan(&probe.NodeId, &dateSeen, &probe.IpAddress); err != nil {
+			return nil, fmt.Errorf("Error iterating through devices_log table: %s", err)
+		}
+		if probe.Timestamp, err = postgres.ParseTimestamp(dateSeen); err != nil {
+			return nil, err
+		}
+		if until.IsZero() || !probe.Timestamp.Before(since) && probe.Timestamp.Before(until) {
+			probes = append(probes, &probe)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through devices_log table: %s", err)
+	}
+	return probes, nil
+}
+
+func (store SqliteDatastore) SelectProbes(ctx context.Context, nodeId string, since, until time.Time) *ProbesIterator {
+	probes, err := store.readProbes(ctx, nodeId, since, until)
+	if err != nil {
+		return &ProbesIterator{newErrorIterator(ctx, err)}
+	}
+	for _, probe := range probes {
+		store.geolocator.locateProbe(probe)
+	}
+	sort.Stable(probes)
+	return &ProbesIterator{newSliceIterator(ctx, len(probes), func(idx int) interface{} { return probes[idx] })}
+}
+
+func (store SqliteDatastore) SelectAllProbes(ctx context.Context, since, until time.Time) *ProbesIterator {
+	probes, err := store.readProbes(ctx, "", since, until)
+	if err != nil {
+		return &ProbesIterator{newErrorIterator(ctx, err)}
+	}
+	for _, probe := range probes {
+		store.geolocator.locateProbe(probe)
+	}
+	sortByNode(probes)
+	return &ProbesIterator{newSliceIterator(ctx, len(probes), func(idx int) interface{} { return probes[idx] })}
+}
+
+func (store SqliteDatastore) SelectLifetimes(ctx context.Context) *LifetimesIterator {
+	probes, err := store.readProbes(ctx, "", time.Time{}, time.Time{})
+	if err != nil {
+		return &LifetimesIterator{newErrorIterator(ctx, err)}
+	}
+	var values []ProbesResult
+	for _, probe := range probes {
+		values = append(values, *probe)
+	}
+	lifetimes := collectLifetimes(values)
+	return &LifetimesIterator{newSliceIterator(ctx, len(lifetimes), func(idx int) interface{} { return lifetimes[idx] })}
+}
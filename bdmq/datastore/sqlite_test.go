@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSqliteDatastore builds a small SQLite dump of the devices and
+// devices_log tables, with timestamps in the formats dumps use, and queries
+// it.
+func TestSqliteDatastore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "bdmq-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	filename := filepath.Join(directory, "bismark.sqlite")
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recently := time.Now().UTC().Add(-30 * time.Second).Format("2006-01-02 15:04:05")
+	statements := []string{
+		"CREATE TABLE devices (id TEXT, ip TEXT, bversion TEXT, date_last_seen TEXT)",
+		"INSERT INTO devices VALUES ('OW0000000002', '2.2.2.2', '1.1', '2013-07-01 12:00:00-04')",
+		"INSERT INTO devices VALUES ('OW0000000001', '1.1.1.1', '1.0', '" + recently + "')",
+		"CREATE TABLE devices_log (id TEXT, ip TEXT, date_seen TEXT)",
+		"INSERT INTO devices_log VALUES ('OW0000000001', '1.1.1.1', '2013-07-01 12:00:00.5-04')",
+		"INSERT INTO devices_log VALUES ('OW0000000001', '1.1.1.2', '2013-07-01T11:00:00Z')",
+		"INSERT INTO devices_log VALUES ('OW0000000001', '1.1.1.1', '2013-07-02 00:00:00')",
+		"INSERT INTO devices_log VALUES ('OW0000000002', '2.2.2.2', '2013-06-30 23:59:59')",
+		"INSERT INTO devices_log VALUES ('OW0000000002', '2.2.2.2', '2013-07-01 16:00:00+00')",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := openSqliteDatastore(filename, &geolocator{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	var got []string
+	devices := store.SelectDevices(ctx, []Identifier{NodeId}, []Order{Ascending}, 0, nil)
+	for devices.Next() {
+		r := devices.Result()
+		got = append(got, fmt.Sprintf("%s %s %s %s %s", r.NodeId, r.IpAddress, r.Version, r.CountryCode, r.DeviceStatus))
+	}
+	if err := devices.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"OW0000000001 1.1.1.1 1.0 ?? up",
+		"OW0000000002 2.2.2.2 1.1 ?? down",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got devices %q, want %q", got, want)
+	}
+
+	got = nil
+	day := time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)
+	probes := store.SelectProbes(ctx, "OW0000000001", day, day.AddDate(0, 0, 1))
+	for probes.Next() {
+		r := probes.Result()
+		got = append(got, fmt.Sprintf("%s %s %s", r.NodeId, r.IpAddress, r.Timestamp.UTC().Format(time.RFC3339Nano)))
+	}
+	if err := probes.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"OW0000000001 1.1.1.2 2013-07-01T11:00:00Z",
+		"OW0000000001 1.1.1.1 2013-07-01T16:00:00.5Z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got probes %q, want %q", got, want)
+	}
+
+	got = nil
+	probes = store.SelectAllProbes(ctx, day, day.AddDate(0, 0, 1))
+	for probes.Next() {
+		r := probes.Result()
+		got = append(got, fmt.Sprintf("%s %s %s", r.NodeId, r.IpAddress, r.Timestamp.UTC().Format(time.RFC3339Nano)))
+	}
+	if err := probes.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"OW0000000001 1.1.1.2 2013-07-01T11:00:00Z",
+		"OW0000000001 1.1.1.1 2013-07-01T16:00:00.5Z",
+		"OW0000000002 2.2.2.2 2013-07-01T16:00:00Z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got all probes %q, want %q", got, want)
+	}
+
+	got = nil
+	lifetimes := store.SelectLifetimes(ctx)
+	for lifetimes.Next() {
+		r := lifetimes.Result()
+		got = append(got, fmt.Sprintf("%s %s %s", r.NodeId, r.FirstProbe.UTC().Format(time.RFC3339Nano), r.LastProbe.UTC().Format(time.RFC3339Nano)))
+	}
+	if err := lifetimes.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"OW0000000001 2013-07-01T11:00:00Z 2013-07-02T00:00:00Z",
+		"OW0000000002 2013-06-30T23:59:59Z 2013-07-01T16:00:00Z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got lifetimes %q, want %q", got, want)
+	}
+}
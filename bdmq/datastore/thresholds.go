@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+var (
+	onlineThreshold, staleThreshold time.Duration
+	thresholdsFile                  string
+)
+
+func init() {
+	flag.DurationVar(&onlineThreshold, "online_threshold", 90*time.Second, "A device is online (up) if its last probe was at most this long ago")
+	flag.DurationVar(&staleThreshold, "stale_threshold", 10*time.Minute, "A device is stale if its last probe was at most this long ago, and offline (down) otherwise")
+	flag.StringVar(&thresholdsFile, "thresholds_file", "", "Read the default and per-version status thresholds from this JSON file; see LoadThresholds")
+}
+
+// StatusThresholds say how old a device's last probe can be before it's no
+// longer online or stale.
+type StatusThresholds struct {
+	Online, Stale time.Duration
+}
+
+func (t StatusThresholds) DeviceStatus(outage time.Duration) DeviceStatus {
+	switch {
+	case outage <= t.Online:
+		return Online
+	case outage <= t.Stale:
+		return Stale
+	default:
+		return Offline
+	}
+}
+
+// Thresholds decide the status of every device. Versions overrides the
+// default thresholds for firmware versions that probe on a different
+// schedule.
+type Thresholds struct {
+	Default  StatusThresholds
+	Versions map[string]StatusThresholds
+}
+
+// DefaultThresholds uses the --online_threshold and --stale_threshold flags
+// for every version.
+func DefaultThresholds() *Thresholds {
+	return &Thresholds{Default: StatusThresholds{onlineThreshold, staleThreshold}}
+}
+
+func (t *Thresholds) ForVersion(version string) StatusThresholds {
+	if override, ok := t.Versions[version]; ok {
+		return override
+	}
+	return t.Default
+}
+
+func (t *Thresholds) DeviceStatus(version string, outage time.Duration) DeviceStatus {
+	return t.ForVersion(version).DeviceStatus(outage)
+}
+
+// overriddenVersions returns the versions with their own thresholds in a
+// stable order.
+func (t *Thresholds) overriddenVersions() []string {
+	var versions []string
+	for version := range t.Versions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func (t *Thresholds) validate() error {
+	check := func(name string, thresholds StatusThresholds) error {
+		if thresholds.Online < 0 || thresholds.Stale < thresholds.Online {
+			return fmt.Errorf("Invalid %s thresholds: need 0 <= online (%s) <= stale (%s)", name, thresholds.Online, thresholds.Stale)
+		}
+		return nil
+	}
+	if err := check("default", t.Default); err != nil {
+		return err
+	}
+	for _, version := range t.overriddenVersions() {
+		if err := check("version "+version, t.Versions[version]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type thresholdsJson struct {
+	Online   string                    `json:"online"`
+	Stale    string                    `json:"stale"`
+	Versions map[string]thresholdsJson `json:"versions"`
+}
+
+func (j thresholdsJson) parse(defaults StatusThresholds) (StatusThresholds, error) {
+	thresholds := defaults
+	var err error
+	if j.Online != "" {
+		if thresholds.Online, err = ParseDuration(j.Online); err != nil {
+			return thresholds, err
+		}
+	}
+	if j.Stale != "" {
+		if thresholds.Stale, err = ParseDuration(j.Stale); err != nil {
+			return thresholds, err
+		}
+	}
+	return thresholds, nil
+}
+
+// ParseThresholds parses a JSON thresholds file like
+//
+//	{"online": "90s", "stale": "10m", "versions": {"1.0": {"stale": "30m"}}}
+//
+// Omitted defaults come from the flags and omitted version thresholds come
+// from the defaults.
+func ParseThresholds(contents []byte) (*Thresholds, error) {
+	var parsed thresholdsJson
+	if err := json.Unmarshal(contents, &parsed); err != nil {
+		return nil, err
+	}
+	thresholds := DefaultThresholds()
+	var err error
+	if thresholds.Default, err = parsed.parse(thresholds.Default); err != nil {
+		return nil, err
+	}
+	if len(parsed.Versions) > 0 {
+		thresholds.Versions = make(map[string]StatusThresholds)
+	}
+	for version, override := range parsed.Versions {
+		if thresholds.Versions[version], err = override.parse(thresholds.Default); err != nil {
+			return nil, err
+		}
+	}
+	if err := thresholds.validate(); err != nil {
+		return nil, err
+	}
+	return thresholds, nil
+}
+
+// LoadThresholds reads --thresholds_file if it's set and otherwise returns
+// DefaultThresholds.
+func LoadThresholds() (*Thresholds, error) {
+	if thresholdsFile == "" {
+		thresholds := DefaultThresholds()
+		return thresholds, thresholds.validate()
+	}
+	contents, err := ioutil.ReadFile(thresholdsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading thresholds: %s", err)
+	}
+	thresholds, err := ParseThresholds(contents)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing thresholds %s: %s", thresholdsFile, err)
+	}
+	return thresholds, nil
+}
@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func ExampleParseThresholds() {
+	thresholds, err := ParseThresholds([]byte(`{"stale": "15m", "versions": {"1.0": {"online": "5m"}, "0.9": {"online": "10m", "stale": "2h"}}}`))
+	if err != nil {
+		panic(err)
+	}
+	for _, version := range []string{"1.1", "1.0", "0.9"} {
+		fmt.Printf("%s: %+v\n", version, thresholds.ForVersion(version))
+	}
+	for _, version := range []string{"1.1", "1.0", "0.9"} {
+		fmt.Printf("%s offline for 12m: %s\n", version, thresholds.DeviceStatus(version, 12*time.Minute))
+	}
+
+	_, err = ParseThresholds([]byte(`{"online": "1h", "stale": "10m"}`))
+	fmt.Println(err)
+	_, err = ParseThresholds([]byte(`{"versions": {"1.0": {"stale": "soon"}}}`))
+	fmt.Println(err)
+
+	// Output:
+	//
+	// 1.1: {Online:1m30s Stale:15m0s}
+	// 1.0: {Online:5m0s Stale:15m0s}
+	// 0.9: {Online:10m0s Stale:2h0m0s}
+	// 1.1 offline for 12m: stale
+	// 1.0 offline for 12m: stale
+	// 0.9 offline for 12m: stale
+	// Invalid default thresholds: need 0 <= online (1h0m0s) <= stale (10m0s)
+	// Invalid duration: soon
+}
+
+// TestStatusCountsAgree checks that SelectVersions and SelectCountries count
+// exactly the devices that SelectDevices says have each status, including
+// devices right on the thresholds.
+func TestStatusCountsAgree(t *testing.T) {
+	now := time.Date(2013, 7, 2, 12, 0, 0, 0, time.UTC)
+	var devices []DevicesResult
+	for idx, outage := range []time.Duration{0, 90 * time.Second, 91 * time.Second, 10 * time.Minute, 10*time.Minute + time.Second, 30 * time.Minute, time.Hour, 48 * time.Hour} {
+		for _, version := range []string{"1.0", "1.1"} {
+			devices = append(devices, DevicesResult{
+				NodeId:      fmt.Sprintf("OW%s%010d", version[2:], idx),
+				CountryCode: []string{"US", "GB", "KE"}[idx%3],
+				Version:     version,
+				LastSeen:    now.Add(-outage),
+			})
+		}
+	}
+
+	for _, thresholds := range []*Thresholds{
+		{Default: StatusThresholds{90 * time.Second, 10 * time.Minute}},
+		{Default: StatusThresholds{90 * time.Second, 10 * time.Minute}, Versions: map[string]StatusThresholds{"1.0": {10 * time.Minute, time.Hour}}},
+	} {
+		store := NewMemoryDatastore(devices, nil, now, thresholds)
+		wantVersions, wantCountries := make(map[string][Offline + 1]int), make(map[string][Offline + 1]int)
+		for results := store.SelectDevices(context.Background(), nil, nil, 0, nil); results.Next(); {
+			device := results.Result()
+			counts := wantVersions[device.Version]
+			counts[device.DeviceStatus]++
+			wantVersions[device.Version] = counts
+			counts = wantCountries[device.CountryCode]
+			counts[device.DeviceStatus]++
+			wantCountries[device.CountryCode] = counts
+		}
+		gotVersions, gotCountries := make(map[string][Offline + 1]int), make(map[string][Offline + 1]int)
+		for versions := store.SelectVersions(context.Background()); versions.Next(); {
+			r := versions.Result()
+			gotVersions[r.Version] = [Offline + 1]int{r.OnlineCount, r.StaleCount, r.OfflineCount}
+		}
+		for countries := store.SelectCountries(context.Background()); countries.Next(); {
+			r := countries.Result()
+			gotCountries[r.Country] = [Offline + 1]int{r.OnlineCount, r.StaleCount, r.OfflineCount}
+		}
+		for _, version := range []string{"1.0", "1.1"} {
+			if gotVersions[version] != wantVersions[version] {
+				t.Errorf("%+v: version %s has %v online/stale/offline, but devices says %v", thresholds, version, gotVersions[version], wantVersions[version])
+			}
+		}
+		for _, country := range []string{"US", "GB", "KE"} {
+			if gotCountries[country] != wantCountries[country] {
+				t.Errorf("%+v: country %s has %v online/stale/offline, but devices says %v", thresholds, country, gotCountries[country], wantCountries[country])
+			}
+		}
+	}
+
+	// The override for version 1.0 applies to devices and to the counts.
+	store := NewMemoryDatastore(devices, nil, now, &Thresholds{Default: StatusThresholds{90 * time.Second, 10 * time.Minute}, Versions: map[string]StatusThresholds{"1.0": {10 * time.Minute, time.Hour}}})
+	for versions := store.SelectVersions(context.Background()); versions.Next(); {
+		r := versions.Result()
+		got := [Offline + 1]int{r.OnlineCount, r.StaleCount, r.OfflineCount}
+		want := map[string][Offline + 1]int{"1.0": {4, 3, 1}, "1.1": {2, 2, 4}}[r.Version]
+		if got != want {
+			t.Errorf("Version %s has %v online/stale/offline, want %v", r.Version, got, want)
+		}
+	}
+}
@@ -69,14 +69,3 @@ func (status DeviceStatus) String() string {
 		panic(fmt.Errorf("Missing Order.DeviceStatus() case"))
 	}
 }
-
-func OutageDurationToDeviceStatus(outageDurationSeconds float64) DeviceStatus {
-	switch {
-	case outageDurationSeconds <= 90:
-		return Online
-	case outageDurationSeconds <= 600:
-		return Stale
-	default:
-		return Offline
-	}
-}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/sburnett/bismark-tools/bdmq/commands"
+	"github.com/sburnett/bismark-tools/common/config"
 	"os"
 	"path/filepath"
 )
@@ -14,8 +15,21 @@ func main() {
 		commands.NewStatus(),
 		commands.NewVersions(),
 		commands.NewCountries(),
+		commands.NewIsps(),
+		commands.NewSummarize(),
+		commands.NewSnapshot(),
+		commands.NewDiff(),
 		commands.NewList(),
+		commands.NewHistory(),
+		commands.NewChurn(),
+		commands.NewCollisions(),
+		commands.NewWatch(),
+		commands.NewAlert(),
+		commands.NewServe(),
+		commands.NewReport(),
+		commands.NewExporter(),
 	}
+	cmds = append(cmds, commands.NewShell(cmds))
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <command> [command options...]\n", filepath.Base(os.Args[0]))
@@ -27,6 +41,9 @@ func main() {
 		}
 	}
 	flag.Parse()
+	if err := config.Setup(); err != nil {
+		panic(err)
+	}
 
 	if flag.NArg() < 1 {
 		flag.Usage()
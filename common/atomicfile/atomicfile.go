@@ -0,0 +1,46 @@
+// Package atomicfile replaces files by writing a temporary file in the same
+// directory and renaming it into place, so that readers never see a partly
+// written file and an interrupted write leaves the old file alone.
+package atomicfile
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Write replaces filename with whatever write writes, giving it permissions
+// perm. If write fails then filename is unchanged.
+func Write(filename string, perm os.FileMode, write func(io.Writer) error) error {
+	handle, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	if err := write(handle); err != nil {
+		handle.Close()
+		os.Remove(handle.Name())
+		return err
+	}
+	if err := handle.Close(); err != nil {
+		os.Remove(handle.Name())
+		return err
+	}
+	if err := os.Chmod(handle.Name(), perm); err != nil {
+		os.Remove(handle.Name())
+		return err
+	}
+	if err := os.Rename(handle.Name(), filename); err != nil {
+		os.Remove(handle.Name())
+		return err
+	}
+	return nil
+}
+
+// WriteFile replaces filename with contents, like ioutil.WriteFile.
+func WriteFile(filename string, contents []byte, perm os.FileMode) error {
+	return Write(filename, perm, func(writer io.Writer) error {
+		_, err := writer.Write(contents)
+		return err
+	})
+}
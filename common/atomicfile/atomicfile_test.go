@@ -0,0 +1,48 @@
+package atomicfile
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	directory, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	filename := filepath.Join(directory, "state.json")
+
+	if err := WriteFile(filename, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	failed := fmt.Errorf("failed")
+	if err := Write(filename, 0644, func(writer io.Writer) error {
+		writer.Write([]byte("partial"))
+		return failed
+	}); err != failed {
+		t.Errorf("Got error %v, want %v", err, failed)
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "first" {
+		t.Errorf("A failed write changed the file to %q", contents)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("Got permissions %s, want -rw-r--r--", info.Mode().Perm())
+	}
+	if entries, _ := ioutil.ReadDir(directory); len(entries) != 1 {
+		t.Errorf("Left temporary files behind: %d entries", len(entries))
+	}
+}
@@ -0,0 +1,284 @@
+// Package config reads the configuration file shared by bdmq and
+// availability-intervals. The file holds named profiles, each with the
+// database to connect to and defaults for command line options:
+//
+//	{
+//	  "default_profile": "production",
+//	  "profiles": {
+//	    "production": {
+//	      "database": {"host": "localhost", "port": 5432, "dbname": "bismark_mgmt", "user": "bismark", "password": "...", "sslmode": "disable"},
+//	      "geoip_asn_database": "/usr/share/GeoIP/GeoIPASNum.dat",
+//	      "thresholds_file": "/home/bismark/etc/thresholds.json",
+//	      "format": "table"
+//	    },
+//	    "staging": {"database": {"host": "staging.example.com", "dbname": "bismark_mgmt"}}
+//	  }
+//	}
+//
+// Every key in a profile besides database sets the command line option of
+// the same name. Programs ignore options they don't have, so one profile can
+// serve them all.
+//
+// Settings come from, in order of preference: the command line, environment
+// variables, the profile and the options' defaults. BDM_<OPTION> overrides an
+// option (e.g., BDM_FORMAT=csv) and BDM_PG_HOST, BDM_PG_PORT,
+// BDM_PG_MGMT_DBNAME, BDM_PG_USER, BDM_PG_PASSWORD and BDM_PG_SSLMODE, or the
+// usual PGHOST, PGPORT and so on, override the database.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var configFile, profileName string
+
+func init() {
+	flag.StringVar(&configFile, "config", DefaultPath(), "Read database profiles and option defaults from this JSON file; see package config")
+	flag.StringVar(&profileName, "profile", "", "Use this profile from the --config file instead of its default_profile")
+}
+
+// DefaultPath returns ~/.bdm.json, or "" if there's no home directory.
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".bdm.json")
+}
+
+// Database says how to connect to Postgres. Empty fields are left to the
+// Postgres driver's defaults.
+type Database struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Name     string `json:"dbname"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	SslMode  string `json:"sslmode"`
+}
+
+func quoteConnectionValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// The settings of a connection string, in the order we write them.
+var connectionKeys = []string{"host", "port", "dbname", "user", "password", "sslmode"}
+
+func formatConnection(settings map[string]string) string {
+	var formatted []string
+	for _, key := range connectionKeys {
+		if value := settings[key]; value != "" {
+			formatted = append(formatted, key+"="+quoteConnectionValue(value))
+		}
+	}
+	return strings.Join(formatted, " ")
+}
+
+func (database Database) settings() map[string]string {
+	settings := map[string]string{
+		"host":     database.Host,
+		"dbname":   database.Name,
+		"user":     database.User,
+		"password": database.Password,
+		"sslmode":  database.SslMode,
+	}
+	if database.Port != 0 {
+		settings["port"] = fmt.Sprint(database.Port)
+	}
+	return settings
+}
+
+// ConnectionString returns a Postgres connection string like
+// "host=localhost dbname=bismark_mgmt" with the fields that are set.
+func (database Database) ConnectionString() string {
+	return formatConnection(database.settings())
+}
+
+// A Profile is one named set of settings.
+type Profile struct {
+	Database Database
+	// Options maps option names to values, as they'd appear on the
+	// command line.
+	Options map[string]string
+}
+
+func (profile *Profile) UnmarshalJSON(contents []byte) error {
+	var parsed map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &parsed); err != nil {
+		return err
+	}
+	profile.Options = make(map[string]string)
+	for key, value := range parsed {
+		if key == "database" {
+			if err := json.Unmarshal(value, &profile.Database); err != nil {
+				return fmt.Errorf("Invalid database: %s", err)
+			}
+			continue
+		}
+		// Options can be strings or bare numbers and booleans.
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			text = string(value)
+		}
+		profile.Options[key] = text
+	}
+	return nil
+}
+
+// A Config is the contents of a configuration file.
+type Config struct {
+	DefaultProfile string              `json:"default_profile"`
+	Profiles       map[string]*Profile `json:"profiles"`
+}
+
+// Parse parses a configuration file like the one in the package
+// documentation.
+func Parse(contents []byte) (*Config, error) {
+	var parsed Config
+	if err := json.Unmarshal(contents, &parsed); err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// Load reads a configuration file.
+func Load(filename string) (*Config, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config: %s", err)
+	}
+	config, err := Parse(contents)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing config %s: %s", filename, err)
+	}
+	return config, nil
+}
+
+// Profile returns the profile with a name, or the default profile if name is
+// empty. It returns nil if name is empty and there's no default profile.
+func (config *Config) Profile(name string) (*Profile, error) {
+	if name == "" {
+		name = config.DefaultProfile
+	}
+	if name == "" {
+		return nil, nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		var names []string
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("No profile named %s; the profiles are %s", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// Environment variables that override each database field, in order of
+// preference.
+var databaseVariables = map[string][]string{
+	"host":     {"BDM_PG_HOST", "PGHOST"},
+	"port":     {"BDM_PG_PORT", "PGPORT"},
+	"dbname":   {"BDM_PG_MGMT_DBNAME", "PGDATABASE"},
+	"user":     {"BDM_PG_USER", "PGUSER"},
+	"password": {"BDM_PG_PASSWORD", "PGPASSWORD"},
+	"sslmode":  {"BDM_PG_SSLMODE", "PGSSLMODE"},
+}
+
+// databaseConnection returns the connection string for profile's database
+// with the environment's overrides.
+func databaseConnection(profile *Profile, getenv func(string) string) string {
+	var database Database
+	if profile != nil {
+		database = profile.Database
+	}
+	settings := database.settings()
+	for _, key := range connectionKeys {
+		for _, variable := range databaseVariables[key] {
+			if value := getenv(variable); value != "" {
+				settings[key] = value
+				break
+			}
+		}
+	}
+	return formatConnection(settings)
+}
+
+// Apply sets every option in flagset that wasn't set on the command line from
+// the environment (using getenv) or profile, which may be nil. The database
+// becomes the --postgres option.
+func Apply(flagset *flag.FlagSet, profile *Profile, getenv func(string) string) error {
+	onCommandLine := make(map[string]bool)
+	flagset.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	var err error
+	flagset.VisitAll(func(f *flag.Flag) {
+		if err != nil || onCommandLine[f.Name] || f.Name == "config" || f.Name == "profile" {
+			return
+		}
+		value, source := getenv("BDM_"+strings.ToUpper(f.Name)), "environment"
+		if value == "" && f.Name == "postgres" {
+			value, source = databaseConnection(profile, getenv), "profile"
+		} else if value == "" && profile != nil {
+			value, source = profile.Options[f.Name], "profile"
+		}
+		if value == "" {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("Invalid --%s in %s: %s: %s", f.Name, source, value, setErr)
+		}
+	})
+	return err
+}
+
+// Setup applies the --profile (or BDM_PROFILE) profile from the --config (or
+// BDM_CONFIG) file to the command line options. Call it after flag.Parse. It's
+// fine for the default config file not to exist.
+func Setup() error {
+	var filenameSet, profileSet bool
+	flag.Visit(func(f *flag.Flag) {
+		filenameSet = filenameSet || f.Name == "config"
+		profileSet = profileSet || f.Name == "profile"
+	})
+	filename, name := configFile, profileName
+	if value := os.Getenv("BDM_CONFIG"); value != "" && !filenameSet {
+		filename, filenameSet = value, true
+	}
+	if value := os.Getenv("BDM_PROFILE"); value != "" && !profileSet {
+		name = value
+	}
+
+	var profile *Profile
+	if filename != "" {
+		if _, err := os.Stat(filename); os.IsNotExist(err) && !filenameSet {
+			filename = ""
+		}
+	}
+	if filename != "" {
+		config, err := Load(filename)
+		if err != nil {
+			return err
+		}
+		if profile, err = config.Profile(name); err != nil {
+			return err
+		}
+	}
+	if profile == nil && name != "" {
+		return fmt.Errorf("No profile named %s", name)
+	}
+	return Apply(flag.CommandLine, profile, os.Getenv)
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+const exampleConfig = `{
+  "default_profile": "production",
+  "profiles": {
+    "production": {
+      "database": {"host": "localhost", "port": 5432, "dbname": "bismark_mgmt", "user": "bismark", "password": "it's secret", "sslmode": "disable"},
+      "format": "table",
+      "stale_threshold": "30m",
+      "verbose": true
+    },
+    "staging": {
+      "database": {"host": "staging.example.com", "dbname": "bismark_mgmt"},
+      "format": "csv",
+      "geoip_database": "/tmp/GeoIP.dat"
+    }
+  }
+}`
+
+func printProfile(config *Config, name string) {
+	profile, err := config.Profile(name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if profile == nil {
+		fmt.Println("no profile")
+		return
+	}
+	fmt.Println(profile.Database.ConnectionString())
+	fmt.Println(profile.Options)
+}
+
+func ExampleParse() {
+	config, err := Parse([]byte(exampleConfig))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	printProfile(config, "")
+	printProfile(config, "staging")
+	printProfile(config, "testing")
+	printProfile(&Config{}, "")
+
+	// Output:
+	// host=localhost port=5432 dbname=bismark_mgmt user=bismark password='it\'s secret' sslmode=disable
+	// map[format:table stale_threshold:30m verbose:true]
+	// host=staging.example.com dbname=bismark_mgmt
+	// map[format:csv geoip_database:/tmp/GeoIP.dat]
+	// No profile named testing; the profiles are production, staging
+	// no profile
+	//
+}
+
+func ExampleApply() {
+	config, _ := Parse([]byte(exampleConfig))
+	profile, _ := config.Profile("staging")
+	environment := map[string]string{
+		"BDM_GEOIP_DATABASE": "/usr/share/GeoIP/GeoIP.dat",
+		"PGUSER":             "postgres",
+		"BDM_PG_HOST":        "db.example.com",
+		"PGHOST":             "ignored.example.com",
+	}
+
+	flagset := flag.NewFlagSet("example", flag.ContinueOnError)
+	format := flagset.String("format", "table", "")
+	geoipDatabase := flagset.String("geoip_database", "", "")
+	postgres := flagset.String("postgres", "", "")
+	staleThreshold := flagset.Duration("stale_threshold", 10*time.Minute, "")
+	flagset.Parse([]string{"--format=json"})
+
+	if err := Apply(flagset, profile, func(name string) string { return environment[name] }); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(*format)
+	fmt.Println(*geoipDatabase)
+	fmt.Println(*postgres)
+	fmt.Println(*staleThreshold)
+
+	profile.Options["stale_threshold"] = "soon"
+	fmt.Println(Apply(flagset, profile, func(string) string { return "" }))
+
+	// Output:
+	// json
+	// /usr/share/GeoIP/GeoIP.dat
+	// host=db.example.com dbname=bismark_mgmt user=postgres
+	// 10m0s
+	// Invalid --stale_threshold in profile: soon: parse error
+	//
+}
@@ -0,0 +1,140 @@
+// Package postgres holds what bdmq and availability-intervals share for
+// reading the BISmark management database and dumps of its tables.
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/bmizerany/pq"
+)
+
+// Open connects to the database named by a connection string like
+// "host=localhost dbname=bismark_mgmt"; the usual PG* environment variables
+// fill in the rest.
+func Open(connection string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to Postgres database: %s", err)
+	}
+	return db, nil
+}
+
+// Environment variables the driver uses for settings missing from a
+// connection string.
+var environmentVariables = map[string]string{
+	"host":    "PGHOST",
+	"port":    "PGPORT",
+	"dbname":  "PGDATABASE",
+	"user":    "PGUSER",
+	"sslmode": "PGSSLMODE",
+}
+
+// parseConnection splits a connection string like "host=localhost
+// dbname='bismark mgmt'", or a URL like postgres://host/dbname, into its
+// settings.
+func parseConnection(connection string) (map[string]string, error) {
+	settings := make(map[string]string)
+	if strings.HasPrefix(connection, "postgres://") || strings.HasPrefix(connection, "postgresql://") {
+		parsed, err := url.Parse(connection)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid connection URL: %s", err)
+		}
+		for key, values := range parsed.Query() {
+			settings[key] = values[len(values)-1]
+		}
+		settings["host"], settings["port"] = parsed.Hostname(), parsed.Port()
+		settings["dbname"] = strings.TrimPrefix(parsed.Path, "/")
+		if parsed.User != nil {
+			settings["user"] = parsed.User.Username()
+		}
+		return settings, nil
+	}
+
+	remaining := strings.TrimSpace(connection)
+	for remaining != "" {
+		equals := strings.Index(remaining, "=")
+		if equals < 0 {
+			return nil, fmt.Errorf("Invalid connection string: missing = after %s", remaining)
+		}
+		key := strings.TrimSpace(remaining[:equals])
+		remaining = strings.TrimLeft(remaining[equals+1:], " \t\n")
+		quoted := strings.HasPrefix(remaining, "'")
+		if quoted {
+			remaining = remaining[1:]
+		}
+		var value []byte
+		for {
+			if remaining == "" {
+				if quoted {
+					return nil, fmt.Errorf("Invalid connection string: unterminated quote in %s", key)
+				}
+				break
+			}
+			c := remaining[0]
+			remaining = remaining[1:]
+			if c == '\\' && remaining != "" {
+				value = append(value, remaining[0])
+				remaining = remaining[1:]
+			} else if (quoted && c == '\'') || (!quoted && strings.ContainsRune(" \t\n", rune(c))) {
+				break
+			} else {
+				value = append(value, c)
+			}
+		}
+		settings[key] = string(value)
+		remaining = strings.TrimSpace(remaining)
+	}
+	return settings, nil
+}
+
+// Identity describes the database a connection string connects to, filling
+// in settings from the environment (using getenv) like the driver does and
+// leaving out the password, so it's safe to record.
+func Identity(connection string, getenv func(string) string) (string, error) {
+	settings, err := parseConnection(connection)
+	if err != nil {
+		return "", err
+	}
+	delete(settings, "password")
+	for key, variable := range environmentVariables {
+		if settings[key] == "" {
+			settings[key] = getenv(variable)
+		}
+	}
+	var keys []string
+	for key, value := range settings {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	formatted := make([]string, len(keys))
+	for idx, key := range keys {
+		formatted[idx] = fmt.Sprintf("%s=%q", key, settings[key])
+	}
+	return strings.Join(formatted, " "), nil
+}
+
+// Layouts of timestamps in SQLite and CSV dumps of the Postgres tables.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+// ParseTimestamp parses a timestamp from a dump of the Postgres tables.
+// Timestamps without a time zone are in UTC.
+func ParseTimestamp(text string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if timestamp, err := time.Parse(layout, text); err == nil {
+			return timestamp, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid timestamp: %s", text)
+}
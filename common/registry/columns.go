@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sburnett/lexicographic-tuples"
+	"github.com/sburnett/transformer"
+	"github.com/sburnett/transformer/store"
+)
+
+// Columns adds registry attributes to the CSV and SQLite output of the
+// processing pipelines. A nil *Columns adds nothing.
+type Columns struct {
+	Registry *Registry
+	Names    []string
+}
+
+// NewColumns loads the registry in filename and adds the comma separated
+// columns in names. It returns nil if filename is empty, and an error if
+// there are columns but no registry to read them from.
+func NewColumns(filename, names string) (*Columns, error) {
+	var columnNames []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			columnNames = append(columnNames, name)
+		}
+	}
+	if filename == "" {
+		if len(columnNames) > 0 {
+			return nil, fmt.Errorf("Registry columns %s need a registry", strings.Join(columnNames, ","))
+		}
+		return nil, nil
+	}
+	registry, err := Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Columns{Registry: registry, Names: columnNames}, nil
+}
+
+func (columns *Columns) empty() bool {
+	return columns == nil || len(columns.Names) == 0
+}
+
+// Values returns each column's value for a node, or "" where the node or
+// attribute is missing. The tags column has the node's tags separated by
+// spaces.
+func (columns *Columns) Values(id string) []string {
+	node := columns.Registry.Lookup(id)
+	values := make([]string, len(columns.Names))
+	for idx, name := range columns.Names {
+		if name == "tags" {
+			if node != nil {
+				values[idx] = strings.Join(node.Tags, " ")
+			}
+		} else {
+			values[idx] = node.Attribute(name)
+		}
+	}
+	return values
+}
+
+// Transformer appends Values to the value of each record. The node ID is
+// element nodeIndex of each record's key and every element before it must
+// be a string. It returns nil, which copies records unchanged, if there are
+// no columns.
+func (columns *Columns) Transformer(nodeIndex int) transformer.Transformer {
+	if columns.empty() {
+		return nil
+	}
+	return transformer.MakeMapFunc(func(record *store.Record) *store.Record {
+		keys := make([]interface{}, nodeIndex+1)
+		for idx := range keys {
+			keys[idx] = new(string)
+		}
+		lex.DecodeOrDie(record.Key, keys...)
+		var values []interface{}
+		for _, value := range columns.Values(*keys[nodeIndex].(*string)) {
+			values = append(values, value)
+		}
+		value := append([]byte{}, record.Value...)
+		return &store.Record{
+			Key:   record.Key,
+			Value: append(value, lex.EncodeOrDie(values...)...),
+		}
+	})
+}
+
+// Writer returns manager.Writer(name, keyNames, valueNames, pointers...)
+// with the columns appended to valueNames, for records from Transformer.
+func (columns *Columns) Writer(manager store.Manager, name string, keyNames, valueNames []string, pointers ...interface{}) store.Writer {
+	if !columns.empty() {
+		valueNames = append(append([]string{}, valueNames...), columns.Names...)
+		for idx := 0; idx < len(columns.Names); idx++ {
+			pointers = append(pointers, new(string))
+		}
+	}
+	arguments := []interface{}{name, keyNames, valueNames}
+	return manager.Writer(append(arguments, pointers...)...)
+}
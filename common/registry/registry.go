@@ -0,0 +1,196 @@
+// Package registry maps router IDs to what we know about each deployment:
+// the partner, household, hardware model, study cohort and so on. The
+// registry is a CSV or JSON file kept under version control alongside the
+// spreadsheet it's exported from.
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Node is one router in the registry. Attribute names are lower case.
+type Node struct {
+	Id         string            `json:"id"`
+	Tags       []string          `json:"tags"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// HasTag reports whether the node has tag, ignoring case.
+func (node *Node) HasTag(tag string) bool {
+	if node == nil {
+		return false
+	}
+	for _, t := range node.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Attribute returns the value of an attribute, or "" if the node doesn't
+// have it.
+func (node *Node) Attribute(name string) string {
+	if node == nil {
+		return ""
+	}
+	return node.Attributes[strings.ToLower(name)]
+}
+
+// A Registry holds every node from a registry file. Version identifies the
+// revision of the file, so that results can say which one they used.
+type Registry struct {
+	Version string
+	nodes   map[string]*Node
+}
+
+func normalizeId(id string) string {
+	return strings.ToUpper(strings.TrimSpace(id))
+}
+
+func newRegistry(version string, nodes []*Node) (*Registry, error) {
+	registry := &Registry{version, make(map[string]*Node)}
+	for _, node := range nodes {
+		node.Id = normalizeId(node.Id)
+		if node.Id == "" {
+			return nil, fmt.Errorf("Node without an id")
+		}
+		if _, ok := registry.nodes[node.Id]; ok {
+			return nil, fmt.Errorf("Duplicate node: %s", node.Id)
+		}
+		attributes := make(map[string]string)
+		for name, value := range node.Attributes {
+			attributes[strings.ToLower(name)] = value
+		}
+		node.Attributes = attributes
+		registry.nodes[node.Id] = node
+	}
+	return registry, nil
+}
+
+// Lookup returns the node with an ID, ignoring case, or nil if it isn't in
+// the registry. A nil Registry has no nodes.
+func (registry *Registry) Lookup(id string) *Node {
+	if registry == nil {
+		return nil
+	}
+	return registry.nodes[normalizeId(id)]
+}
+
+// Ids returns the ID of every node in the registry in sorted order.
+func (registry *Registry) Ids() []string {
+	var ids []string
+	if registry == nil {
+		return ids
+	}
+	for id := range registry.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ParseJson parses a registry like
+//
+//	{"version": "3", "nodes": [{"id": "OW00AABBCCDDEE", "tags": ["cohort2013"], "attributes": {"partner": "gatech"}}]}
+func ParseJson(contents []byte) (*Registry, error) {
+	var parsed struct {
+		Version string  `json:"version"`
+		Nodes   []*Node `json:"nodes"`
+	}
+	if err := json.Unmarshal(contents, &parsed); err != nil {
+		return nil, err
+	}
+	return newRegistry(parsed.Version, parsed.Nodes)
+}
+
+// ParseCsv parses a registry with a header row naming its columns. The id
+// column is required, the tags column holds space separated tags and every
+// other column is an attribute. Empty attributes are omitted. Lines starting
+// with # are comments, except that "# version: <version>" sets the version.
+func ParseCsv(reader io.Reader) (*Registry, error) {
+	var version string
+	var body bytes.Buffer
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			comment := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			if strings.HasPrefix(comment, "version:") {
+				version = strings.TrimSpace(strings.TrimPrefix(comment, "version:"))
+			}
+			continue
+		}
+		body.WriteString(line)
+		body.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := csv.NewReader(&body).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return newRegistry(version, nil)
+	}
+	header := rows[0]
+	idColumn, tagsColumn := -1, -1
+	for idx, name := range header {
+		header[idx] = strings.ToLower(strings.TrimSpace(name))
+		switch header[idx] {
+		case "id":
+			idColumn = idx
+		case "tags":
+			tagsColumn = idx
+		}
+	}
+	if idColumn < 0 {
+		return nil, fmt.Errorf("Missing id column")
+	}
+
+	var nodes []*Node
+	for _, row := range rows[1:] {
+		node := &Node{Id: row[idColumn], Attributes: make(map[string]string)}
+		for idx, value := range row {
+			value = strings.TrimSpace(value)
+			switch {
+			case idx == idColumn:
+			case idx == tagsColumn:
+				node.Tags = strings.Fields(value)
+			case value != "":
+				node.Attributes[header[idx]] = value
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return newRegistry(version, nodes)
+}
+
+// Load reads a registry from a .json file or otherwise a CSV file.
+func Load(filename string) (*Registry, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading registry: %s", err)
+	}
+	var registry *Registry
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		registry, err = ParseJson(contents)
+	} else {
+		registry, err = ParseCsv(bytes.NewReader(contents))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing registry %s: %s", filename, err)
+	}
+	return registry, nil
+}
@@ -0,0 +1,75 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+func printRegistry(registry *Registry, err error) {
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("version:", registry.Version)
+	for _, id := range registry.Ids() {
+		node := registry.Lookup(id)
+		fmt.Println(node.Id, node.Tags, node.Attributes)
+	}
+}
+
+func ExampleParseCsv() {
+	printRegistry(ParseCsv(strings.NewReader(`# version: 2013-07-01
+ID,Tags,Partner,Model
+ow00aabbccddee,cohort2013 pilot,gatech,WNDR3800
+OW0011223344FF,,"Nairobi Uni",
+`)))
+	printRegistry(ParseCsv(strings.NewReader("partner\ngatech\n")))
+	printRegistry(ParseCsv(strings.NewReader("id,partner\nOW00AABBCCDDEE,gatech\nOW00AABBCCDDEE,\n")))
+
+	// Output:
+	//
+	// version: 2013-07-01
+	// OW0011223344FF [] map[partner:Nairobi Uni]
+	// OW00AABBCCDDEE [cohort2013 pilot] map[model:WNDR3800 partner:gatech]
+	// Missing id column
+	// Duplicate node: OW00AABBCCDDEE
+}
+
+func ExampleParseJson() {
+	registry, err := ParseJson([]byte(`{"version": "3", "nodes": [{"id": "OW00AABBCCDDEE", "tags": ["cohort2013"], "attributes": {"Partner": "gatech"}}]}`))
+	printRegistry(registry, err)
+	node := registry.Lookup("ow00aabbccddee")
+	fmt.Println(node.HasTag("COHORT2013"), node.HasTag("pilot"), node.Attribute("partner"))
+	fmt.Println(registry.Lookup("OW0000000000").Attribute("partner") == "")
+
+	// Output:
+	//
+	// version: 3
+	// OW00AABBCCDDEE [cohort2013] map[partner:gatech]
+	// true false gatech
+	// true
+}
+
+func ExampleColumns_Values() {
+	registry, _ := ParseCsv(strings.NewReader("id,tags,partner\nOW00AABBCCDDEE,cohort2013 pilot,gatech\n"))
+	columns := &Columns{registry, []string{"partner", "tags", "model"}}
+	fmt.Printf("%q\n", columns.Values("OW00AABBCCDDEE"))
+	fmt.Printf("%q\n", columns.Values("OW0000000000"))
+
+	// Output:
+	//
+	// ["gatech" "cohort2013 pilot" ""]
+	// ["" "" ""]
+}
+
+func ExampleNewColumns() {
+	fmt.Println(NewColumns("", ""))
+	fmt.Println(NewColumns("", " partner, "))
+	fmt.Println(NewColumns("", "Partner,tags"))
+
+	// Output:
+	//
+	// <nil> <nil>
+	// <nil> Registry columns partner need a registry
+	// <nil> Registry columns partner,tags need a registry
+}
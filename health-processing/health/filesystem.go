@@ -6,17 +6,18 @@ import (
 	"strings"
 
 	"github.com/sburnett/bismark-tools/common"
+	"github.com/sburnett/bismark-tools/common/registry"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
-func FilesystemUsagePipeline(levelDbManager, csvManager store.Manager) transformer.Pipeline {
+func FilesystemUsagePipeline(levelDbManager, csvManager store.Manager, columns *registry.Columns) transformer.Pipeline {
 	logsStore := levelDbManager.Seeker("logs")
 	filesystemUsageStore := levelDbManager.ReadingWriter("filesystem")
 	var mount, node string
 	var timestamp, used, free int64
-	csvStore := csvManager.Writer("filesystem.csv", []string{"mount", "node", "timestamp"}, []string{"used", "free"}, &mount, &node, &timestamp, &used, &free)
+	csvStore := columns.Writer(csvManager, "filesystem.csv", []string{"mount", "node", "timestamp"}, []string{"used", "free"}, &mount, &node, &timestamp, &used, &free)
 
 	return []transformer.PipelineStage{
 		transformer.PipelineStage{
@@ -26,9 +27,10 @@ func FilesystemUsagePipeline(levelDbManager, csvManager store.Manager) transform
 			Writer:      filesystemUsageStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteFilesystemUsageCsv",
-			Reader: filesystemUsageStore,
-			Writer: csvStore,
+			Name:        "WriteFilesystemUsageCsv",
+			Reader:      filesystemUsageStore,
+			Transformer: columns.Transformer(1),
+			Writer:      csvStore,
 		},
 	}
 }
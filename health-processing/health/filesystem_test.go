@@ -22,7 +22,7 @@ func runFilesystemUsagePipeline(logs map[string]string) {
 
 	csvManager := store.NewCsvStdoutManager()
 
-	transformer.RunPipeline(FilesystemUsagePipeline(levelDbManager, csvManager))
+	transformer.RunPipeline(FilesystemUsagePipeline(levelDbManager, csvManager, nil))
 	csvManager.PrintToStdout("filesystem.csv")
 }
 
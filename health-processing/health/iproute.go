@@ -5,18 +5,19 @@ import (
 	"strings"
 
 	"github.com/sburnett/bismark-tools/common"
+	"github.com/sburnett/bismark-tools/common/registry"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
-func IpRoutePipeline(levelDbManager, sqliteManager store.Manager) transformer.Pipeline {
+func IpRoutePipeline(levelDbManager, sqliteManager store.Manager, columns *registry.Columns) transformer.Pipeline {
 	logsStore := levelDbManager.Seeker("logs")
 	defaultRoutesStore := levelDbManager.ReadingWriter("default-routes")
 	var node string
 	var timestamp int64
 	var gateway string
-	sqliteStore := sqliteManager.Writer("defaultroutes", []string{"node", "timestamp"}, []string{"gateway"}, &node, &timestamp, &gateway)
+	sqliteStore := columns.Writer(sqliteManager, "defaultroutes", []string{"node", "timestamp"}, []string{"gateway"}, &node, &timestamp, &gateway)
 	return []transformer.PipelineStage{
 		transformer.PipelineStage{
 			Name:        "ExtractDefaultRoute",
@@ -25,9 +26,10 @@ func IpRoutePipeline(levelDbManager, sqliteManager store.Manager) transformer.Pi
 			Writer:      defaultRoutesStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteDefaultRoutesSqlite",
-			Reader: defaultRoutesStore,
-			Writer: sqliteStore,
+			Name:        "WriteDefaultRoutesSqlite",
+			Reader:      defaultRoutesStore,
+			Transformer: columns.Transformer(0),
+			Writer:      sqliteStore,
 		},
 	}
 }
@@ -7,18 +7,19 @@ import (
 	"strings"
 
 	"github.com/sburnett/bismark-tools/common"
+	"github.com/sburnett/bismark-tools/common/registry"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
-func MemoryUsagePipeline(levelDbManager, csvManager, sqliteManager store.Manager) transformer.Pipeline {
+func MemoryUsagePipeline(levelDbManager, csvManager, sqliteManager store.Manager, columns *registry.Columns) transformer.Pipeline {
 	logsStore := levelDbManager.Seeker("logs")
 	memoryUsageStore := levelDbManager.ReadingWriter("memory")
 	var node string
 	var timestamp, used, free int64
-	csvStore := csvManager.Writer("memory.csv", []string{"node", "timestamp"}, []string{"used", "free"}, &node, &timestamp, &used, &free)
-	sqliteStore := sqliteManager.Writer("memory", []string{"node", "timestamp"}, []string{"used", "free"}, &node, &timestamp, &used, &free)
+	csvStore := columns.Writer(csvManager, "memory.csv", []string{"node", "timestamp"}, []string{"used", "free"}, &node, &timestamp, &used, &free)
+	sqliteStore := columns.Writer(sqliteManager, "memory", []string{"node", "timestamp"}, []string{"used", "free"}, &node, &timestamp, &used, &free)
 	return []transformer.PipelineStage{
 		transformer.PipelineStage{
 			Name:        "Memory",
@@ -27,14 +28,16 @@ func MemoryUsagePipeline(levelDbManager, csvManager, sqliteManager store.Manager
 			Writer:      memoryUsageStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteMemoryUsageCsv",
-			Reader: memoryUsageStore,
-			Writer: csvStore,
+			Name:        "WriteMemoryUsageCsv",
+			Reader:      memoryUsageStore,
+			Transformer: columns.Transformer(0),
+			Writer:      csvStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteMemoryUsageSqlite",
-			Reader: memoryUsageStore,
-			Writer: sqliteStore,
+			Name:        "WriteMemoryUsageSqlite",
+			Reader:      memoryUsageStore,
+			Transformer: columns.Transformer(0),
+			Writer:      sqliteStore,
 		},
 	}
 }
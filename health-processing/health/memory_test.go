@@ -22,7 +22,7 @@ func runMemoryUsagePipeline(logs map[string]string) {
 	}
 	logsStore.EndWriting()
 
-	transformer.RunPipeline(MemoryUsagePipeline(levelDbManager, csvManager))
+	transformer.RunPipeline(MemoryUsagePipeline(levelDbManager, csvManager, store.NewSqliteManager("/dev/null"), nil))
 
 	csvManager.PrintToStdout("memory.csv")
 }
@@ -5,20 +5,21 @@ import (
 	"strings"
 
 	"github.com/sburnett/bismark-tools/common"
+	"github.com/sburnett/bismark-tools/common/registry"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
-func PackagesPipeline(levelDbManager, csvManager, sqliteManager store.Manager) transformer.Pipeline {
+func PackagesPipeline(levelDbManager, csvManager, sqliteManager store.Manager, columns *registry.Columns) transformer.Pipeline {
 	logsStore := levelDbManager.Seeker("logs")
 	installedPackagesStore := levelDbManager.ReadingWriter("installed-packages")
 	versionChangesStore := levelDbManager.ReadingWriter("version-changes")
 	var node, packageName string
 	var timestamp int64
 	var version string
-	csvStore := csvManager.Writer("packages.csv", []string{"node", "package", "timestamp"}, []string{"version"}, &node, &packageName, &timestamp, &version)
-	sqliteStore := sqliteManager.Writer("packages", []string{"node", "package", "timestamp"}, []string{"version"}, &node, &packageName, &timestamp, &version)
+	csvStore := columns.Writer(csvManager, "packages.csv", []string{"node", "package", "timestamp"}, []string{"version"}, &node, &packageName, &timestamp, &version)
+	sqliteStore := columns.Writer(sqliteManager, "packages", []string{"node", "package", "timestamp"}, []string{"version"}, &node, &packageName, &timestamp, &version)
 	return []transformer.PipelineStage{
 		transformer.PipelineStage{
 			Name:        "OpkgListInstalled",
@@ -33,14 +34,16 @@ func PackagesPipeline(levelDbManager, csvManager, sqliteManager store.Manager) t
 			Writer:      versionChangesStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteVersionChangesSqlite",
-			Reader: versionChangesStore,
-			Writer: sqliteStore,
+			Name:        "WriteVersionChangesSqlite",
+			Reader:      versionChangesStore,
+			Transformer: columns.Transformer(0),
+			Writer:      sqliteStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteVersionChangesCsv",
-			Reader: versionChangesStore,
-			Writer: csvStore,
+			Name:        "WriteVersionChangesCsv",
+			Reader:      versionChangesStore,
+			Transformer: columns.Transformer(0),
+			Writer:      csvStore,
 		},
 	}
 }
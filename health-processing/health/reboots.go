@@ -1,18 +1,19 @@
 package health
 
 import (
+	"github.com/sburnett/bismark-tools/common/registry"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
-func RebootsPipeline(levelDbManager, csvManager, sqliteManager store.Manager) transformer.Pipeline {
+func RebootsPipeline(levelDbManager, csvManager, sqliteManager store.Manager, columns *registry.Columns) transformer.Pipeline {
 	uptimeStore := levelDbManager.Seeker("uptime")
 	rebootsStore := levelDbManager.ReadingWriter("reboots")
 	var node string
 	var timestamp int64
-	rebootsCsvStore := csvManager.Writer("reboots.csv", []string{"node", "boot_timestamp"}, []string{}, &node, &timestamp)
-	rebootsSqliteStore := sqliteManager.Writer("reboots", []string{"node", "boot_timestamp"}, []string{}, &node, &timestamp)
+	rebootsCsvStore := columns.Writer(csvManager, "reboots.csv", []string{"node", "boot_timestamp"}, []string{}, &node, &timestamp)
+	rebootsSqliteStore := columns.Writer(sqliteManager, "reboots", []string{"node", "boot_timestamp"}, []string{}, &node, &timestamp)
 
 	return []transformer.PipelineStage{
 		transformer.PipelineStage{
@@ -22,14 +23,16 @@ func RebootsPipeline(levelDbManager, csvManager, sqliteManager store.Manager) tr
 			Writer:      rebootsStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteRebootsCsv",
-			Reader: rebootsStore,
-			Writer: rebootsCsvStore,
+			Name:        "WriteRebootsCsv",
+			Reader:      rebootsStore,
+			Transformer: columns.Transformer(0),
+			Writer:      rebootsCsvStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteRebootsSqlite",
-			Reader: rebootsStore,
-			Writer: rebootsSqliteStore,
+			Name:        "WriteRebootsSqlite",
+			Reader:      rebootsStore,
+			Transformer: columns.Transformer(0),
+			Writer:      rebootsSqliteStore,
 		},
 	}
 }
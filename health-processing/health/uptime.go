@@ -6,18 +6,19 @@ import (
 	"strings"
 
 	"github.com/sburnett/bismark-tools/common"
+	"github.com/sburnett/bismark-tools/common/registry"
 	"github.com/sburnett/lexicographic-tuples"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
-func UptimePipeline(levelDbManager, csvManager, sqliteManager store.Manager) transformer.Pipeline {
+func UptimePipeline(levelDbManager, csvManager, sqliteManager store.Manager, columns *registry.Columns) transformer.Pipeline {
 	logsStore := levelDbManager.Seeker("logs")
 	uptimeStore := levelDbManager.ReadingWriter("uptime")
 	var node string
 	var timestamp, uptime int64
-	csvStore := csvManager.Writer("uptime.csv", []string{"node", "timestamp"}, []string{"uptime"}, &node, &timestamp, &uptime)
-	sqliteStore := sqliteManager.Writer("uptime", []string{"node", "timestamp"}, []string{"uptime"}, &node, &timestamp, &uptime)
+	csvStore := columns.Writer(csvManager, "uptime.csv", []string{"node", "timestamp"}, []string{"uptime"}, &node, &timestamp, &uptime)
+	sqliteStore := columns.Writer(sqliteManager, "uptime", []string{"node", "timestamp"}, []string{"uptime"}, &node, &timestamp, &uptime)
 	return []transformer.PipelineStage{
 		transformer.PipelineStage{
 			Name:        "Uptime",
@@ -26,14 +27,16 @@ func UptimePipeline(levelDbManager, csvManager, sqliteManager store.Manager) tra
 			Writer:      uptimeStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteUptimeCsv",
-			Reader: uptimeStore,
-			Writer: csvStore,
+			Name:        "WriteUptimeCsv",
+			Reader:      uptimeStore,
+			Transformer: columns.Transformer(0),
+			Writer:      csvStore,
 		},
 		transformer.PipelineStage{
-			Name:   "WriteUptimeSqlite",
-			Reader: uptimeStore,
-			Writer: sqliteStore,
+			Name:        "WriteUptimeSqlite",
+			Reader:      uptimeStore,
+			Transformer: columns.Transformer(0),
+			Writer:      sqliteStore,
 		},
 	}
 }
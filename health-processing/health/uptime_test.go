@@ -22,7 +22,7 @@ func runUptimePipeline(logs map[string]string) {
 	}
 	logsStore.EndWriting()
 
-	transformer.RunPipeline(UptimePipeline(levelDbManager, csvManager))
+	transformer.RunPipeline(UptimePipeline(levelDbManager, csvManager, store.NewSqliteManager("/dev/null"), nil))
 
 	csvManager.PrintToStdout("uptime.csv")
 }
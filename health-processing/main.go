@@ -4,12 +4,27 @@ import (
 	"flag"
 	"fmt"
 
+	"github.com/sburnett/bismark-tools/common/registry"
 	"github.com/sburnett/bismark-tools/health-processing/health"
 	"github.com/sburnett/cube"
 	"github.com/sburnett/transformer"
 	"github.com/sburnett/transformer/store"
 )
 
+// registryFlags adds flags for appending node registry attributes to a
+// pipeline's output. Call the returned function after parsing the flags.
+func registryFlags(flagset *flag.FlagSet) func() *registry.Columns {
+	filename := flagset.String("registry", "", "Read node tags and attributes from this registry file.")
+	names := flagset.String("registry_columns", "", "Add these comma separated registry attributes (or tags) to each row of output.")
+	return func() *registry.Columns {
+		columns, err := registry.NewColumns(*filename, *names)
+		if err != nil {
+			panic(err)
+		}
+		return columns
+	}
+}
+
 func pipelineIndex() transformer.Pipeline {
 	flagset := flag.NewFlagSet("index", flag.ExitOnError)
 	tarballsPath := flagset.String("tarballs_path", "/data/users/sburnett/bismark-health", "Read tarballs from this directory.")
@@ -22,8 +37,9 @@ func pipelineFilesystem() transformer.Pipeline {
 	flagset := flag.NewFlagSet("filesystem", flag.ExitOnError)
 	dbRoot := flagset.String("health_leveldb_root", "/data/users/sburnett/bismark-health-leveldb", "Write leveldbs in this directory.")
 	csvOutput := flagset.String("csv_output", "/dev/null", "Write filesystem usage in CSV format to this file.")
+	columns := registryFlags(flagset)
 	flagset.Parse(flag.Args()[1:])
-	return health.FilesystemUsagePipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput))
+	return health.FilesystemUsagePipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), columns())
 }
 
 func pipelineMemory() transformer.Pipeline {
@@ -31,8 +47,9 @@ func pipelineMemory() transformer.Pipeline {
 	dbRoot := flagset.String("health_leveldb_root", "/data/users/sburnett/bismark-health-leveldb", "Write leveldbs in this directory.")
 	csvOutput := flagset.String("csv_output", "/dev/null", "Write memory usage in CSV format to this file.")
 	sqliteFilename := flagset.String("sqlite_filename", "/dev/null", "Write to this sqlite database.")
+	columns := registryFlags(flagset)
 	flagset.Parse(flag.Args()[1:])
-	return health.MemoryUsagePipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), store.NewSqliteManager(*sqliteFilename))
+	return health.MemoryUsagePipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), store.NewSqliteManager(*sqliteFilename), columns())
 }
 
 func pipelineUptime() transformer.Pipeline {
@@ -40,8 +57,9 @@ func pipelineUptime() transformer.Pipeline {
 	dbRoot := flagset.String("health_leveldb_root", "/data/users/sburnett/bismark-health-leveldb", "Write leveldbs in this directory.")
 	csvOutput := flagset.String("csv_output", "/dev/null", "Write memory usage in CSV format to this file.")
 	sqliteFilename := flagset.String("sqlite_filename", "/dev/null", "Write to this sqlite database.")
+	columns := registryFlags(flagset)
 	flagset.Parse(flag.Args()[1:])
-	return health.UptimePipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), store.NewSqliteManager(*sqliteFilename))
+	return health.UptimePipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), store.NewSqliteManager(*sqliteFilename), columns())
 }
 
 func pipelineReboots() transformer.Pipeline {
@@ -49,8 +67,9 @@ func pipelineReboots() transformer.Pipeline {
 	dbRoot := flagset.String("health_leveldb_root", "/data/users/sburnett/bismark-health-leveldb", "Write leveldbs in this directory.")
 	csvOutput := flagset.String("csv_output", "/dev/null", "Write reboots to a CSV file in this directory.")
 	sqliteFilename := flagset.String("sqlite_filename", "/dev/null", "Write to this sqlite database.")
+	columns := registryFlags(flagset)
 	flagset.Parse(flag.Args()[1:])
-	return health.RebootsPipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), store.NewSqliteManager(*sqliteFilename))
+	return health.RebootsPipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), store.NewSqliteManager(*sqliteFilename), columns())
 }
 
 func pipelineSummarize() transformer.Pipeline {
@@ -66,16 +85,18 @@ func pipelinePackages() transformer.Pipeline {
 	dbRoot := flagset.String("health_leveldb_root", "/data/users/sburnett/bismark-health-leveldb", "Write leveldbs in this directory.")
 	csvOutput := flagset.String("csv_output", "/dev/null", "Write reboots to a CSV file in this directory.")
 	sqliteFilename := flagset.String("sqlite_filename", "/dev/null", "Write to this sqlite database.")
+	columns := registryFlags(flagset)
 	flagset.Parse(flag.Args()[1:])
-	return health.PackagesPipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), store.NewSqliteManager(*sqliteFilename))
+	return health.PackagesPipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), store.NewSqliteManager(*sqliteFilename), columns())
 }
 
 func pipelineIpRoute() transformer.Pipeline {
 	flagset := flag.NewFlagSet("iproute", flag.ExitOnError)
 	dbRoot := flagset.String("health_leveldb_root", "/data/users/sburnett/bismark-health-leveldb", "Write leveldbs in this directory.")
 	sqliteFilename := flagset.String("sqlite_filename", "/dev/null", "Write to this sqlite database.")
+	columns := registryFlags(flagset)
 	flagset.Parse(flag.Args()[1:])
-	return health.IpRoutePipeline(store.NewLevelDbManager(*dbRoot), store.NewSqliteManager(*sqliteFilename))
+	return health.IpRoutePipeline(store.NewLevelDbManager(*dbRoot), store.NewSqliteManager(*sqliteFilename), columns())
 }
 
 func pipelineDevicesCount() transformer.Pipeline {
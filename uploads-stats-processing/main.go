@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 
+	"github.com/sburnett/bismark-tools/common/registry"
 	"github.com/sburnett/bismark-tools/uploads-stats-processing/stats"
 	"github.com/sburnett/cube"
 	"github.com/sburnett/transformer"
@@ -14,8 +15,14 @@ func pipelineCsv() transformer.Pipeline {
 	flagset := flag.NewFlagSet("csv", flag.ExitOnError)
 	csvOutput := flagset.String("csv_output", "/dev/null", "Write upload statistics to a file in this directory.")
 	dbRoot := flagset.String("uploads_leveldb_root", "/data/users/sburnett/bismark-upload-stats-leveldb", "Write leveldbs in this directory.")
+	registryFilename := flagset.String("registry", "", "Read node tags and attributes from this registry file.")
+	registryColumns := flagset.String("registry_columns", "", "Add these comma separated registry attributes (or tags) to each row of output.")
 	flagset.Parse(flag.Args()[1:])
-	return stats.CsvPipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput))
+	columns, err := registry.NewColumns(*registryFilename, *registryColumns)
+	if err != nil {
+		panic(err)
+	}
+	return stats.CsvPipeline(store.NewLevelDbManager(*dbRoot), store.NewCsvFileManager(*csvOutput), columns)
 }
 
 func pipelineStats() transformer.Pipeline {